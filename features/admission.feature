@@ -0,0 +1,80 @@
+Feature: Admission Hooks
+  In order to enforce policies on resources
+  As an operator of the system
+  I need to be able to deny writes before they are committed
+
+  Scenario: Invalid resources are denied by an admission hook
+    Given the resource "features.Account" is registered
+      And an admission hook denies invalid CREATE writes with the message "names must start with the team prefix"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "NOT_FOUND"
+
+  Scenario: Writes that break a policy are denied by an admission hook
+    Given the resource "features.Account" is registered
+      And an admission hook denies unadmitted DELETE writes with the message "the account still has active services"
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+
+  Scenario: Writes are denied when an admission hook that fails closed does not respond
+    Given the resource "features.Account" is registered
+      And an unresponsive admission hook that fails closed
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive an error with code "UNAVAILABLE"
+
+  Scenario: Writes are allowed when an admission hook that fails open does not respond
+    Given the resource "features.Account" is registered
+      And an unresponsive admission hook that fails open
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
@@ -0,0 +1,79 @@
+Feature: Authentication
+  In order to know who is making changes to resources
+  As an operator of the system
+  I need callers to be authenticated with their credentials
+
+  Scenario: Callers are authenticated with a JWT
+    Given the resource "features.Account" is registered
+      And JWTs for the audience "control-plane" are trusted
+      And changes are dispatched to a sink
+      And using a JWT for "joe" with the audience "control-plane" that expires in "1h"
+     When creating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+      """
+     Then I will receive a successful response
+      And the next dispatched change will be "ADDED" for "accounts/default-account" by "user:joe"
+
+  Scenario: Expired JWTs are rejected
+    Given the resource "features.Account" is registered
+      And JWTs for the audience "control-plane" are trusted
+      And using a JWT for "joe" with the audience "control-plane" that expires in "-1h"
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "UNAUTHENTICATED"
+
+  Scenario: JWTs issued for another audience are rejected
+    Given the resource "features.Account" is registered
+      And JWTs for the audience "control-plane" are trusted
+      And using a JWT for "joe" with the audience "billing" that expires in "1h"
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "UNAUTHENTICATED"
+
+  Scenario: Callers without credentials are rejected
+    Given the resource "features.Account" is registered
+      And JWTs for the audience "control-plane" are trusted
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "UNAUTHENTICATED"
+
+  Scenario: Callers are authenticated with their client certificate
+    Given the resource "features.Account" is registered
+      And the server is serving TLS to clients with certificates
+      And client certificates are used to authenticate callers
+      And connecting with the client certificate "joe"
+      And changes are dispatched to a sink
+     When creating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+      """
+     Then I will receive a successful response
+      And the next dispatched change will be "ADDED" for "accounts/default-account" by "user:joe"
@@ -0,0 +1,201 @@
+Feature: Batch Requests
+  In order to provision many resources at once
+  As a user of the system
+  I need to be able to make a batch of requests in a single transaction
+
+  Scenario: Creating a batch of resources
+    Given the resource "features.Account" is registered
+     When batch creating the following resources:
+       """
+        {
+          "requests": [
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "First Account",
+                "name": "accounts/first-account"
+              }
+            },
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "Second Account",
+                "name": "accounts/second-account"
+              }
+            }
+          ]
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 2
+      And the response value "resources[0].name" will be "accounts/first-account"
+      And the response value "resources[1].name" will be "accounts/second-account"
+      And the response value "statuses" will have a length of 0
+     When batch getting the following resources:
+       """
+        {
+          "requests": [
+            {"resource_type": "features.Account", "name": "accounts/second-account"},
+            {"resource_type": "features.Account", "name": "accounts/first-account"}
+          ]
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources[0].displayName" will be "Second Account"
+      And the response value "resources[1].displayName" will be "First Account"
+
+  Scenario: None of the resources are created when one of them fails
+    Given the resource "features.Account" is registered
+     When batch creating the following resources:
+       """
+        {
+          "requests": [
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "First Account",
+                "name": "accounts/first-account"
+              }
+            },
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "First Account Again",
+                "name": "accounts/first-account"
+              }
+            }
+          ]
+        }
+       """
+     Then I will receive an error with code "ALREADY_EXISTS"
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+     Then I will receive an error with code "NOT_FOUND"
+
+  Scenario: Partial success returns the status of each request
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+     When batch updating the following resources:
+       """
+        {
+          "allow_partial_success": true,
+          "requests": [
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "Renamed Account",
+                "name": "accounts/first-account"
+              },
+              "update_mask": "displayName"
+            },
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "Missing Account",
+                "name": "accounts/missing-account"
+              },
+              "update_mask": "displayName"
+            }
+          ]
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources[0].displayName" will be "Renamed Account"
+      And the response value "statuses[0].code" will be ""
+      And the response value "statuses[1].code" will be "5"
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "displayName" will be "Renamed Account"
+
+  Scenario: Deleting a batch of resources
+    Given the resource "features.Account" is registered
+      And batch creating the following resources:
+       """
+        {
+          "requests": [
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "First Account",
+                "name": "accounts/first-account"
+              }
+            },
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "Second Account",
+                "name": "accounts/second-account"
+              }
+            }
+          ]
+        }
+       """
+     When batch deleting the following resources:
+       """
+        {
+          "requests": [
+            {"resource_type": "features.Account", "name": "accounts/first-account"},
+            {"resource_type": "features.Account", "name": "accounts/second-account"}
+          ]
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources[0].deleteTime" will be within "10s" from now
+      And the response value "resources[1].deleteTime" will be within "10s" from now
+
+  Scenario: Each request of a batch is authorized
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.viewer" is registered with the permissions "resourcemanager.resources.get"
+      And the role "roles/resourcemanager.viewer" is granted to "allUsers" on "accounts/first-account"
+      And batch creating the following resources:
+       """
+        {
+          "requests": [
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "First Account",
+                "name": "accounts/first-account"
+              }
+            },
+            {
+              "resource": {
+                "@type": "features.Account",
+                "display_name": "Second Account",
+                "name": "accounts/second-account"
+              }
+            }
+          ]
+        }
+       """
+      And authorization is enabled
+     When batch getting the following resources:
+       """
+        {
+          "requests": [
+            {"resource_type": "features.Account", "name": "accounts/first-account"},
+            {"resource_type": "features.Account", "name": "accounts/second-account"}
+          ]
+        }
+       """
+     Then I will receive an error with code "PERMISSION_DENIED"
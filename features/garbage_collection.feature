@@ -0,0 +1,218 @@
+Feature: Garbage Collection
+  In order to clean up resources that are owned by other resources
+  As a user of the system
+  I need dependents to be deleted once all of their owners are deleted
+
+  Scenario: Dependents are deleted once all of their owners are deleted
+    Given the resource "features.Account" is registered
+      And the resource "features.ApiKey" is registered
+      And the garbage collector is running
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Second Account",
+            "name": "accounts/second-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Deploy Key",
+            "name": "apiKeys/deploy-key",
+            "owner_references": [
+              {"resource_type": "features.Account", "name": "accounts/first-account"},
+              {"resource_type": "features.Account", "name": "accounts/second-account"}
+            ]
+          }
+        }
+       """
+     When listing the dependents of the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "apiKeys/deploy-key"
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+      And purging the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+      And getting the following resource:
+       """
+        {
+          "resource_type": "features.ApiKey",
+          "name": "apiKeys/deploy-key"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "deleteTime" will be ""
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/second-account"
+        }
+       """
+     Then the "features.ApiKey" resource "apiKeys/deploy-key" will eventually be deleted
+
+  Scenario: Dependents that can not be deleted do not stop the other dependents from being deleted
+    Given the resource "features.Account" is registered
+      And the resource "features.ApiKey" is registered
+      And an admission hook denies deletes of "apiKeys/protected-key"
+      And the garbage collector is running
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Protected Key",
+            "name": "apiKeys/protected-key",
+            "owner_references": [
+              {"resource_type": "features.Account", "name": "accounts/first-account"}
+            ]
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Deploy Key",
+            "name": "apiKeys/deploy-key",
+            "owner_references": [
+              {"resource_type": "features.Account", "name": "accounts/first-account"}
+            ]
+          }
+        }
+       """
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+     Then the "features.ApiKey" resource "apiKeys/deploy-key" will eventually be deleted
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.ApiKey",
+          "name": "apiKeys/protected-key"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "deleteTime" will be ""
+
+  Scenario: Owner references must be for registered resource types
+    Given the resource "features.ApiKey" is registered
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Deploy Key",
+            "name": "apiKeys/deploy-key",
+            "owner_references": [
+              {"resource_type": "features.Service", "name": "services/api"}
+            ]
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | owner_references[0].resource_type | Unknown resource type "features.Service" |
+
+  Scenario: Dependents the caller is not allowed to get are not listed
+    Given the resource "features.Account" is registered
+      And the resource "features.ApiKey" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on "accounts/first-account"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on "apiKeys/visible-key"
+      And the role "roles/apiKeys.creator" is registered with the permissions "resourcemanager.resources.create"
+      And the role "roles/apiKeys.creator" is granted to "allUsers" on "apiKeys/hidden-key"
+      And authorization is enabled
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Visible Key",
+            "name": "apiKeys/visible-key",
+            "owner_references": [
+              {"resource_type": "features.Account", "name": "accounts/first-account"}
+            ]
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Hidden Key",
+            "name": "apiKeys/hidden-key",
+            "owner_references": [
+              {"resource_type": "features.Account", "name": "accounts/first-account"}
+            ]
+          }
+        }
+       """
+     When listing the dependents of the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/first-account"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "apiKeys/visible-key"
@@ -0,0 +1,230 @@
+Feature: Hierarchical Resources
+  In order to organize resources under other resources
+  As a user of the system
+  I need resources to only be created under parents that exist
+
+  Scenario: Resources can only be created under live parents
+    Given the resource "features.Account" is registered
+      And the resource "features.User" is registered
+     When creating the following resource:
+       """
+        {
+          "parent": "accounts/missing-account",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Joe Smith",
+            "name": "accounts/missing-account/users/joe"
+          }
+        }
+       """
+     Then I will receive an error with code "NOT_FOUND"
+     When creating the following resource:
+       """
+        {
+          "parent": "organizations/default",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Joe Smith",
+            "name": "organizations/default/users/joe"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | parent | The parent must match one of the patterns: accounts/{account} |
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When creating the following resource:
+       """
+        {
+          "parent": "accounts/default-account",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Joe Smith",
+            "name": "accounts/default-account/users/joe"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account",
+          "force": true
+        }
+       """
+     Then I will receive a successful response
+     When creating the following resource:
+       """
+        {
+          "parent": "accounts/default-account",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Jane Smith",
+            "name": "accounts/default-account/users/jane"
+          }
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+
+  Scenario: Parents with live children can only be deleted when forced
+    Given the resource "features.Account" is registered
+      And the resource "features.User" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "parent": "accounts/default-account",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Joe Smith",
+            "name": "accounts/default-account/users/joe"
+          }
+        }
+       """
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.User",
+          "name": "accounts/default-account/users/joe"
+        }
+       """
+     Then I will receive a successful response
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive a successful response
+     When undeleting the following resource
+       """
+        {
+          "resource_type": "features.User",
+          "name": "accounts/default-account/users/joe"
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+
+  Scenario: Forced deletes cascade to the children of a resource
+    Given the resource "features.Account" is registered
+      And the resource "features.User" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "parent": "accounts/default-account",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Joe Smith",
+            "name": "accounts/default-account/users/joe"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "parent": "accounts/default-account",
+          "resource": {
+            "@type": "features.User",
+            "display_name": "Jane Smith",
+            "name": "accounts/default-account/users/jane"
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.User",
+          "name": "accounts/default-account/users/jane"
+        }
+       """
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account",
+          "force": true
+        }
+       """
+     Then I will receive a successful response
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.User",
+          "name": "accounts/default-account/users/joe"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "deleteTime" will be within "1s" from now
+     When undeleting the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive a successful response
+     When listing the following resources:
+      """
+       {
+         "parent": "accounts/default-account",
+         "resource_type": "features.User"
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "accounts/default-account/users/joe"
+     When purging the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive a successful response
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.User",
+          "name": "accounts/default-account/users/jane"
+        }
+       """
+     Then I will receive an error with code "NOT_FOUND"
@@ -0,0 +1,406 @@
+Feature: IAM Policy Management
+  In order to control access to resources
+  As a user of the system
+  I need to be able to grant roles on resources
+
+  Scenario: Successfully set and get an IAM policy
+    Given the role "roles/resourcemanager.viewer" is registered with the permissions "resourcemanager.resources.get,resourcemanager.resources.list"
+     When setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.viewer",
+                "members": ["user:joe"]
+              }
+            ]
+          }
+        }
+      """
+     Then I will receive a successful response
+      And the response value "bindings[0].role" will be "roles/resourcemanager.viewer"
+     When getting the IAM policy:
+      """
+        {
+          "resource": "accounts/default-account"
+        }
+      """
+     Then I will receive a successful response
+      And the response value "bindings[0].members[0]" will be "user:joe"
+
+  Scenario: Error when setting a policy with an unknown role
+     When setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/unknown",
+                "members": ["user:joe"]
+              }
+            ]
+          }
+        }
+      """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | policy.bindings[0].role | Unknown role "roles/unknown" |
+
+  Scenario: Error when setting a policy with a stale etag
+    Given the role "roles/resourcemanager.viewer" is registered with the permissions "resourcemanager.resources.get"
+     When setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "etag": "c3RhbGU=",
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.viewer",
+                "members": ["user:joe"]
+              }
+            ]
+          }
+        }
+      """
+     Then I will receive an error with code "ABORTED"
+
+  Scenario: Permissions are inherited from parent resources
+    Given the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.admin",
+                "members": ["allUsers"]
+              }
+            ]
+          }
+        }
+      """
+     When testing the following IAM permissions:
+      """
+        {
+          "resource": "accounts/default-account/keys/default-key",
+          "permissions": [
+            "resourcemanager.resources.get",
+            "resourcemanager.resources.delete",
+            "billing.invoices.get"
+          ]
+        }
+      """
+     Then I will receive a successful response
+      And the response value "permissions" will have a length of 2
+     When testing the following IAM permissions:
+      """
+        {
+          "resource": "accounts/other-account",
+          "permissions": [
+            "resourcemanager.resources.get"
+          ]
+        }
+      """
+     Then I will receive a successful response
+      And the response value "permissions" will have a length of 0
+
+  Scenario: Callers without the required permissions are denied
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.viewer" is registered with the permissions "resourcemanager.resources.get"
+      And the role "roles/resourcemanager.viewer" is granted to "allUsers" on "accounts/default-account"
+      And authorization is enabled
+     When creating the following resource:
+      """
+        {
+          "parent": "",
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+      """
+     Then I will receive an error with code "PERMISSION_DENIED"
+
+  Scenario: Fields are redacted and protected from callers without field permissions
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And the role "roles/billing.admin" is registered with the permissions "billing.accounts.get,billing.accounts.update"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on ""
+      And creating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account",
+            "billing_email": "billing@example.com"
+          }
+        }
+      """
+      And authorization is enabled
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive a successful response
+      And the response value "billingEmail" will be ""
+     When updating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/default-account",
+            "billing_email": "finance@example.com"
+          },
+          "update_mask": "billingEmail"
+        }
+      """
+     Then I will receive an error with code "PERMISSION_DENIED"
+      And the BadRequest error details will be for the following fields
+        | billing_email | Permission "billing.accounts.update" is required to write the field |
+    Given the role "roles/billing.admin" is granted to "allUsers" on "accounts/default-account"
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive a successful response
+      And the response value "billingEmail" will be "billing@example.com"
+
+  Scenario: Replacing a resource without an update mask requires permission to write protected fields
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on ""
+      And creating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account",
+            "billing_email": "billing@example.com"
+          }
+        }
+      """
+      And authorization is enabled
+     When updating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Renamed Account",
+            "name": "accounts/default-account"
+          }
+        }
+      """
+     Then I will receive an error with code "PERMISSION_DENIED"
+      And the BadRequest error details will be for the following fields
+        | billing_email | Permission "billing.accounts.update" is required to write the field |
+
+  Scenario: Protected fields outside of the update mask are not written
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*,billing.accounts.get"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on ""
+      And creating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account",
+            "billing_email": "billing@example.com"
+          }
+        }
+      """
+      And authorization is enabled
+     When updating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Renamed Account",
+            "name": "accounts/default-account",
+            "billing_email": "attacker@example.com"
+          },
+          "update_mask": "displayName"
+        }
+      """
+     Then I will receive a successful response
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive a successful response
+      And the response value "displayName" will be "My Renamed Account"
+      And the response value "billingEmail" will be "billing@example.com"
+
+  Scenario: Callers are only allowed to access the resources they have been granted
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.viewer" is registered with the permissions "resourcemanager.resources.get"
+      And the role "roles/resourcemanager.viewer" is granted to "allUsers" on "accounts/default-account"
+      And authorization is enabled
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "NOT_FOUND"
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/other-account"
+        }
+      """
+     Then I will receive an error with code "PERMISSION_DENIED"
+     When deleting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "PERMISSION_DENIED"
+
+  Scenario: Callers are denied access to streams they have not been granted
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.viewer" is registered with the permissions "resourcemanager.resources.get"
+      And the role "roles/resourcemanager.viewer" is granted to "allUsers" on ""
+      And authorization is enabled
+     When watching the following resources:
+      """
+        {
+          "resource_type": "features.Account"
+        }
+      """
+      And receiving the next watch event
+     Then I will receive an error with code "PERMISSION_DENIED"
+
+  Scenario: Streams are terminated when access is revoked while watching
+    Given the resource "features.Account" is registered
+      And setting the following IAM policy:
+      """
+        {
+          "resource": "",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.admin",
+                "members": ["allUsers"]
+              }
+            ]
+          }
+        }
+      """
+      And authorization is enabled
+     When watching the following resources:
+      """
+        {
+          "resource_type": "features.Account"
+        }
+      """
+      And setting the following IAM policy:
+      """
+        {
+          "resource": "",
+          "policy": {}
+        }
+      """
+     Then I will receive a successful response
+     When receiving the next watch event
+     Then I will receive an error with code "PERMISSION_DENIED"
+
+  Scenario: Permissions granted on a resource apply to its collections
+    Given the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.admin",
+                "members": ["allUsers"]
+              }
+            ]
+          }
+        }
+      """
+     When testing the following IAM permissions:
+      """
+        {
+          "resource": "accounts/default-account/keys",
+          "permissions": [
+            "resourcemanager.resources.list"
+          ]
+        }
+      """
+     Then I will receive a successful response
+      And the response value "permissions" will have a length of 1
+
+  Scenario: Policies can grant the predefined roles
+    Given the resource "features.Account" is registered
+      And setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.viewer",
+                "members": ["allUsers"]
+              }
+            ]
+          }
+        }
+      """
+      And authorization is enabled
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "NOT_FOUND"
+     When deleting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "PERMISSION_DENIED"
+
+  Scenario: Servers without an authorizer refuse to start when policies are set
+    Given setting the following IAM policy:
+      """
+        {
+          "resource": "accounts/default-account",
+          "policy": {
+            "bindings": [
+              {
+                "role": "roles/resourcemanager.viewer",
+                "members": ["allUsers"]
+              }
+            ]
+          }
+        }
+      """
+     Then creating a server without an authorizer will fail
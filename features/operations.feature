@@ -0,0 +1,267 @@
+Feature: Long-running Operations
+  In order to make slow changes to resources without exceeding deadlines
+  As a user of the system
+  I need mutations to be able to run as long-running operations
+
+  Scenario: Creating a resource that is created by a long-running operation
+    Given the resource "features.Backup" is registered
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the response value "@type" will be "type.googleapis.com/google.longrunning.Operation"
+      And the response value "metadata.resourceName" will be "backups/nightly"
+      And the response value "metadata.verb" will be "CREATE"
+     When waiting for the operation to finish
+     Then I will receive a successful response
+      And the response value "done" will be "true"
+      And the response value "metadata.progressPercent" will be "100"
+      And the response value "response.name" will be "backups/nightly"
+      And the response value "response.displayName" will be "Nightly Backup"
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.Backup",
+          "name": "backups/nightly"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "displayName" will be "Nightly Backup"
+
+  Scenario: Long-running operations finish with the error of the mutation
+    Given the resource "features.Backup" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+     Then I will receive a successful response
+      And the response value "done" will be "true"
+      And the response value "error.code" will be "6"
+      And the response value "response" will be ""
+
+  Scenario: Mutations that are not long-running return the resource
+    Given the resource "features.Backup" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Weekly Backup",
+            "name": "backups/nightly"
+          },
+          "update_mask": "displayName"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "@type" will be "type.googleapis.com/features.Backup"
+      And the response value "displayName" will be "Weekly Backup"
+
+  Scenario: Listing the operations that match a filter
+    Given the resource "features.Backup" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Backup",
+          "name": "backups/nightly"
+        }
+       """
+      And waiting for the operation to finish
+     When listing the following operations:
+       """
+        {
+          "name": "operations",
+          "filter": "done = true AND metadata.verb = \"DELETE\""
+        }
+       """
+     Then I will receive a successful response
+      And the response value "operations" will have a length of 1
+      And the response value "operations[0].metadata.resourceName" will be "backups/nightly"
+      And the response value "operations[0].response.deleteTime" will be within "10s" from now
+
+  Scenario: Cancelling an operation that has already finished
+    Given the resource "features.Backup" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+     When cancelling the operation
+      And getting the operation
+     Then I will receive a successful response
+      And the response value "done" will be "true"
+      And the response value "metadata.cancelRequested" will be ""
+      And the response value "response.name" will be "backups/nightly"
+
+  Scenario: Deleted operations can no longer be retrieved
+    Given the resource "features.Backup" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+     When deleting the operation
+      And getting the operation
+     Then I will receive an error with code "NOT_FOUND"
+
+  Scenario: Operations can only be retrieved by callers that are allowed to get the resource
+    Given the resource "features.Backup" is registered
+      And the role "roles/backups.creator" is registered with the permissions "resourcemanager.resources.create"
+      And the role "roles/backups.creator" is granted to "allUsers" on "backups/nightly"
+      And authorization is enabled
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+     When getting the operation
+     Then I will receive an error with code "PERMISSION_DENIED"
+     When cancelling the operation
+     Then I will receive an error with code "PERMISSION_DENIED"
+
+  Scenario: Listing only the operations of the resources the caller is allowed to get
+    Given the resource "features.Backup" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on "backups/nightly"
+      And the role "roles/backups.creator" is registered with the permissions "resourcemanager.resources.create"
+      And the role "roles/backups.creator" is granted to "allUsers" on "backups/weekly"
+      And authorization is enabled
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+      And waiting for the operation to finish
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Weekly Backup",
+            "name": "backups/weekly"
+          }
+        }
+       """
+     When listing the following operations:
+       """
+        {
+          "name": "operations"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "operations" will have a length of 1
+      And the response value "operations[0].metadata.resourceName" will be "backups/nightly"
+
+  Scenario: Operations only include the fields of the resource the caller is allowed to read
+    Given the resource "features.Backup" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*,backups.keys.update"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on ""
+      And authorization is enabled
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly",
+            "encryption_key": "s3cr3t"
+          }
+        }
+       """
+     When waiting for the operation to finish
+     Then I will receive a successful response
+      And the response value "done" will be "true"
+      And the response value "response.displayName" will be "Nightly Backup"
+      And the response value "response.encryptionKey" will be ""
+
+  Scenario: Operations that were left running by a stopped server are failed
+    Given the resource "features.Backup" is registered
+      And an operation for "backups/nightly" was left running by a server that has stopped
+      And the purger is running
+     When waiting for the operation to finish
+     Then I will receive a successful response
+      And the response value "done" will be "true"
+      And the response value "error.code" will be "10"
+
+  Scenario: Operations are not started once the server is drained
+    Given the resource "features.Backup" is registered
+      And the server is drained
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Backup",
+            "display_name": "Nightly Backup",
+            "name": "backups/nightly"
+          }
+        }
+       """
+     Then I will receive an error with code "UNAVAILABLE"
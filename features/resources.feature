@@ -139,6 +139,63 @@ Feature: Resource CRUD Management
        """
       And I will receive an error with code "NOT_FOUND"
 
+  Scenario: Deleted resources are purged once their retention period has passed
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Other Account",
+            "name": "accounts/other-account",
+            "finalizers": ["billing.example.com/invoices"]
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/other-account"
+        }
+       """
+     When the purger is running with a retention of "0s"
+     Then the "features.Account" resource "accounts/default-account" will eventually be purged
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/other-account"
+        }
+       """
+     Then I will receive a successful response
+     When removing the following finalizer:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/other-account",
+          "finalizer": "billing.example.com/invoices"
+        }
+       """
+     Then the "features.Account" resource "accounts/other-account" will eventually be purged
+
 
   Scenario: NotFound error when resource doesn't exist
     Given the resource "features.Account" is registered
@@ -210,3 +267,796 @@ Feature: Resource CRUD Management
         }
       """
      Then I will receive an error with code "UNIMPLEMENTED"
+
+  Scenario: Soft-deleted resources are only listed when requested
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account"
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 0
+      And the response trailer "x-granted-permissions" will be "resourcemanager.resources.listDeleted"
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "show_deleted": true
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+
+  Scenario: Watching resources streams the current state and later changes
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "parent": "",
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/existing-account"
+          }
+        }
+       """
+     When watching the following resources:
+      """
+       {
+         "resource_type": "features.Account"
+       }
+      """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+      And the response value "resource.name" will be "accounts/existing-account"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My New Account",
+            "name": "accounts/new-account"
+          }
+        }
+       """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+      And the response value "resource.name" will be "accounts/new-account"
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/new-account"
+        }
+       """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "DELETED"
+      And the response value "resource.name" will be "accounts/new-account"
+
+  Scenario: Watches can be resumed from a resource version
+    Given the resource "features.Account" is registered
+     When watching the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "filter": "display_name = \"Watched Account\""
+       }
+      """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Watched Account",
+            "name": "accounts/watched-account"
+          }
+        }
+       """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Ignored Account",
+            "name": "accounts/ignored-account"
+          }
+        }
+       """
+      And purging the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/watched-account"
+        }
+       """
+      And resuming the watch from the last resource version
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "PURGED"
+      And the response value "resource.name" will be "accounts/watched-account"
+
+  Scenario: Watching with an invalid resource version
+    Given the resource "features.Account" is registered
+     When watching the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "resource_version": "not-a-version"
+       }
+      """
+      And receiving the next watch event
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | resource_version | Resource version "not-a-version" is not valid |
+
+  Scenario: Resources are stamped with a generation and resource version
+    Given the resource "features.Account" is registered
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the response value "generation" will be "1"
+      And the response value "resourceVersion" will be "1"
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Renamed Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the response value "generation" will be "2"
+      And the response value "resourceVersion" will be "2"
+     When deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "generation" will be "2"
+      And the response value "resourceVersion" will be "3"
+
+  Scenario: Listing the resources that changed since a resource version
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Second Account",
+            "name": "accounts/second-account"
+          }
+        }
+       """
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "since_resource_version": "1"
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "accounts/second-account"
+      And the response value "resourceVersion" will be "2"
+
+  Scenario: Changes to resources are dispatched from the outbox in order
+    Given the resource "features.Account" is registered
+      And changes are dispatched to a sink
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+      And purging the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then the next dispatched change will be "ADDED" for "accounts/default-account" by "allUsers"
+      And the next dispatched change will be "DELETED" for "accounts/default-account" by "allUsers"
+      And the next dispatched change will be "PURGED" for "accounts/default-account" by "allUsers"
+
+  Scenario: Changes are dispatched once when several servers dispatch to the same sink
+    Given the resource "features.Account" is registered
+      And changes are dispatched to a sink
+      And changes are dispatched to the same sink by another server
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then the next dispatched change will be "ADDED" for "accounts/default-account" by "allUsers"
+      And no other change will be dispatched
+
+  Scenario: Defaults are set on the fields that were not provided
+    Given the resource "features.Account" is registered
+      And a defaulter for "features.Account" sets the "tier" label to "standard"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the response value "plan" will be "PLAN_FREE"
+      And the response value "settings.timeZone" will be "UTC"
+      And the response value "labels.tier" will be "standard"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Paid Account",
+            "name": "accounts/paid-account",
+            "plan": "PLAN_PAID",
+            "billing_email": "billing@example.com",
+            "settings": {
+              "timeZone": "America/Chicago"
+            },
+            "labels": {
+              "tier": "premium"
+            }
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the response value "plan" will be "PLAN_PAID"
+      And the response value "settings.timeZone" will be "America/Chicago"
+      And the response value "labels.tier" will be "premium"
+
+  Scenario: Resources that break their validation rules are rejected
+    Given the resource "features.Account" is registered
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "An account with a display name that is far longer than it should be",
+            "name": "accounts/default-account",
+            "plan": "PLAN_PAID"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | display_name  | The display name must be at most 64 characters |
+        | billing_email | A billing email is required for paid accounts  |
+
+  Scenario: Transition rules are validated against the existing resource
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Paid Account",
+            "name": "accounts/paid-account",
+            "plan": "PLAN_PAID",
+            "billing_email": "billing@example.com"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Paid Account",
+            "name": "accounts/paid-account",
+            "plan": "PLAN_FREE"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | plan | Paid accounts can not be moved to the free plan |
+
+  Scenario: Labels and annotations must be valid
+    Given the resource "features.Account" is registered
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account",
+            "labels": {
+              "city": "dallas",
+              "Team": "platform",
+              "owner": " joe smith"
+            },
+            "annotations": {
+              "example-integration.com/config": "{}",
+              "example-integration.com/": "",
+              "first": "1",
+              "second": "2",
+              "third": "3"
+            }
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | labels["Team"]                       | Label keys must start with a lowercase letter, be at most 63 characters and only contain lowercase letters, numbers, underscores and dashes |
+        | labels["owner"]                      | Label values must not be empty, must only contain letters, numbers, dashes, underscores or spaces and must not start or end in spaces       |
+        | annotations                          | A resource can have at most 4 annotations                                                                                                    |
+        | annotations["example-integration.com/"] | Annotation keys must be an optional DNS subdomain prefix and a slash followed by a name of at most 63 characters that starts and ends with a letter or number |
+
+  Scenario: Listing resources with a label selector
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "API Account",
+            "name": "accounts/api-account",
+            "labels": {
+              "env": "prod",
+              "tier": "api"
+            }
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Canary Account",
+            "name": "accounts/canary-account",
+            "labels": {
+              "env": "prod",
+              "tier": "web",
+              "canary": "true"
+            }
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Development Account",
+            "name": "accounts/dev-account",
+            "labels": {
+              "env": "dev",
+              "tier": "web"
+            }
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Web Account",
+            "name": "accounts/web-account",
+            "labels": {
+              "env": "staging",
+              "tier": "web"
+            }
+          }
+        }
+       """
+      And updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/web-account",
+            "display_name": "Web Account",
+            "labels": {
+              "env": "prod",
+              "tier": "web"
+            }
+          }
+        }
+       """
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "label_selector": "env=prod,tier in (web,api),!canary",
+         "page_size": 1
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "accounts/api-account"
+      And the response value "nextPageToken" will be "YWNjb3VudHMvYXBpLWFjY291bnQ"
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "label_selector": "env=prod,tier in (web,api),!canary",
+         "page_size": 1,
+         "page_token": "YWNjb3VudHMvYXBpLWFjY291bnQ"
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "accounts/web-account"
+      And the response value "nextPageToken" will be ""
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "label_selector": "env!=prod"
+       }
+      """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 1
+      And the response value "resources[0].name" will be "accounts/dev-account"
+
+  Scenario: Listing resources with an invalid label selector
+    Given the resource "features.Account" is registered
+     When listing the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "label_selector": "env in prod"
+       }
+      """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+      And the BadRequest error details will be for the following fields
+        | label_selector | expected a set of values in parentheses |
+
+  Scenario: Watching resources with a label selector
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Development Account",
+            "name": "accounts/dev-account",
+            "labels": {
+              "env": "dev"
+            }
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Production Account",
+            "name": "accounts/prod-account",
+            "labels": {
+              "env": "prod"
+            }
+          }
+        }
+       """
+     When watching the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "label_selector": "env=prod"
+       }
+      """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+      And the response value "resource.name" will be "accounts/prod-account"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Staging Account",
+            "name": "accounts/staging-account",
+            "labels": {
+              "env": "staging"
+            }
+          }
+        }
+       """
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Second Production Account",
+            "name": "accounts/second-prod-account",
+            "labels": {
+              "env": "prod"
+            }
+          }
+        }
+       """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+      And the response value "resource.name" will be "accounts/second-prod-account"
+
+  Scenario: Resources that stop matching the label selector of a watch are reported as deleted
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Production Account",
+            "name": "accounts/prod-account",
+            "labels": {
+              "env": "prod"
+            }
+          }
+        }
+       """
+     When watching the following resources:
+      """
+       {
+         "resource_type": "features.Account",
+         "label_selector": "env=prod"
+       }
+      """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Production Account",
+            "name": "accounts/prod-account",
+            "labels": {
+              "env": "dev"
+            }
+          }
+        }
+       """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "DELETED"
+      And the response value "resource.name" will be "accounts/prod-account"
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Production Account",
+            "name": "accounts/prod-account",
+            "labels": {
+              "env": "prod"
+            }
+          }
+        }
+       """
+      And receiving the next watch event
+     Then I will receive a successful response
+      And the response value "type" will be "ADDED"
+      And the response value "resource.name" will be "accounts/prod-account"
+
+  Scenario: Unique fields can not be shared by resources with the same parent
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "parent": "organizations/first",
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Shared Name",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+     When creating the following resource:
+       """
+        {
+          "parent": "organizations/first",
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Shared Name",
+            "name": "accounts/second-account"
+          }
+        }
+       """
+     Then I will receive an error with code "ALREADY_EXISTS"
+      And the ResourceInfo error details will be for "accounts/first-account"
+     When creating the following resource:
+       """
+        {
+          "parent": "organizations/second",
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Shared Name",
+            "name": "accounts/second-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When creating the following resource:
+       """
+        {
+          "parent": "organizations/first",
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "Third Name",
+            "name": "accounts/third-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/third-account",
+            "display_name": "Shared Name"
+          }
+        }
+       """
+     Then I will receive an error with code "ALREADY_EXISTS"
+      And the ResourceInfo error details will be for "accounts/first-account"
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/first-account",
+            "display_name": "Renamed Account"
+          }
+        }
+       """
+     Then I will receive a successful response
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/third-account",
+            "display_name": "Shared Name"
+          }
+        }
+       """
+     Then I will receive a successful response
+
+  Scenario: Resources with finalizers can not be purged
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account",
+            "finalizers": ["billing.example.com/invoices"]
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     When purging the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/default-account",
+            "display_name": "My Testing Account",
+            "finalizers": ["billing.example.com/invoices", "dns.example.com/records"]
+          }
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+     When updating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "name": "accounts/default-account",
+            "display_name": "My Testing Account"
+          }
+        }
+       """
+     Then I will receive an error with code "FAILED_PRECONDITION"
+     When removing the following finalizer:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account",
+          "finalizer": "billing.example.com/invoices"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "finalizers" will have a length of 0
+     When purging the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then I will receive a successful response
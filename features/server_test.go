@@ -2,14 +2,32 @@ package features
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,13 +39,20 @@ import (
 	"github.com/stackpath/control-plane/server"
 	"github.com/stackpath/control-plane/server/serverpb"
 	"github.com/stretchr/objx"
+	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 var opt = godog.Options{
@@ -47,13 +72,92 @@ type serverFeature struct {
 	responseError error
 	server        *grpc.Server
 	listener      net.Listener
-	clientConn    grpc.ClientConnInterface
+	clientConn    *grpc.ClientConn
 	request       interface{}
 	response      interface{}
+	trailer       metadata.MD
+	watch         grpc.ClientStream
+	watchRequest  *serverpb.WatchResourcesRequest
+	watchCancel   context.CancelFunc
+	changes       chan *server.Change
+	webhooks      *webhookReceiver
 	nextPageToken string
+	// The name of the last long-running operation that was started
+	operationName string
 	ctx           context.Context
 	db            *sql.DB
 	backend       server.API
+	// Another server sharing the database, such as a second replica
+	otherBackend server.API
+	// The resource in the data of the last webhook that was received
+	webhookResource map[string]interface{}
+	// Whether the permissions of the caller should be checked by the server
+	authorizationEnabled bool
+	// The options the server of the scenario is started with
+	serverOptions []server.GRPCOption
+	// A temporary directory for the files the scenario writes
+	tempDir string
+	// The certificates of a scenario that is served over TLS, and the client
+	// certificate that is presented when connecting to the server.
+	certificates      *testCertificates
+	clientCertificate *tls.Certificate
+	// The key that signs the JWTs that are trusted by the server
+	jwtKey *ecdsa.PrivateKey
+}
+
+// Authorizes callers using the backend once authorization has been enabled
+// for a scenario. All permissions are granted until then.
+type featureAuthorizer struct {
+	feature *serverFeature
+}
+
+func (a *featureAuthorizer) TestPermissions(ctx context.Context, principal *server.Principal, resource string, permissions []string) ([]string, error) {
+	if !a.feature.authorizationEnabled {
+		return permissions, nil
+	}
+	return a.feature.backend.TestPermissions(ctx, principal, resource, permissions)
+}
+
+// Collects the changes that are dispatched from the outbox.
+type channelSink struct {
+	changes chan *server.Change
+}
+
+func (s *channelSink) Deliver(ctx context.Context, change *server.Change) error {
+	select {
+	case s.changes <- change:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A local HTTP server that records the webhooks it receives.
+type webhookReceiver struct {
+	*httptest.Server
+	requests chan *receivedWebhook
+	// The status code the receiver responds with.
+	statusCode int32
+	// The secret the webhooks should be signed with.
+	secret string
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	receiver := &webhookReceiver{
+		requests:   make(chan *receivedWebhook, 100),
+		statusCode: http.StatusOK,
+	}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		receiver.requests <- &receivedWebhook{header: req.Header, body: body}
+		w.WriteHeader(int(atomic.LoadInt32(&receiver.statusCode)))
+	}))
+	return receiver
 }
 
 func TestMain(m *testing.M) {
@@ -139,6 +243,23 @@ func (f *serverFeature) theErrorDetailsWillBeForTheFollowingFields(details *godo
 	return nil
 }
 
+func (f *serverFeature) theResourceInfoErrorDetailsWillBeFor(resourceName string) error {
+	errStatus, ok := status.FromError(f.responseError)
+	if !ok {
+		return fmt.Errorf("error was not able to be converted to a gRPC status: %v", f.responseError)
+	}
+
+	for _, detail := range errStatus.Details() {
+		if v, ok := detail.(*errdetails.ResourceInfo); ok {
+			if v.ResourceName != resourceName {
+				return fmt.Errorf("expected the resource info to be for %q, got %q", resourceName, v.ResourceName)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("response error did not contain a resource info error detail")
+}
+
 func (f *serverFeature) iWillReceiveASuccessfulResponse() error {
 	if f.responseError != nil {
 		return fmt.Errorf(
@@ -175,6 +296,14 @@ func (f *serverFeature) theResponseValueWillHaveLength(path string, expectedLen
 	return nil
 }
 
+func (f *serverFeature) theResponseTrailerWillBe(key, expected string) error {
+	actual := strings.Join(f.trailer.Get(key), ",")
+	if actual != expected {
+		return fmt.Errorf("expected trailer %q to be %q, got %q", key, expected, actual)
+	}
+	return nil
+}
+
 func (f *serverFeature) stashingTheNextPageTokenFromTheResponse() error {
 	if t, ok := f.response.(interface{ GetNextPageToken() string }); !ok {
 		return fmt.Errorf("the response does satisfy the next page token interface")
@@ -234,6 +363,30 @@ func (f *serverFeature) theResourceIsRegistered(resourceType string) error {
 	return f.backend.CreateResourceDescriptor(resource.Interface())
 }
 
+func (f *serverFeature) authorizationIsEnabled() error {
+	f.authorizationEnabled = true
+	return nil
+}
+
+func (f *serverFeature) creatingAServerWithoutAnAuthorizerWillFail() error {
+	if _, err := server.GRPCAPI(f.backend); err == nil {
+		return fmt.Errorf("expected creating the server to fail")
+	}
+	return nil
+}
+
+func (f *serverFeature) theRoleIsGrantedToOn(role, member, resource string) error {
+	return f.backend.CreateRoleBinding(server.RoleBinding{
+		Resource: resource,
+		Role:     role,
+		Members:  []string{member},
+	})
+}
+
+func (f *serverFeature) theRoleIsRegisteredWithThePermissions(role, permissions string) error {
+	return f.backend.CreateRole(role, strings.Split(permissions, ","))
+}
+
 func (f *serverFeature) callGRPCMethodFromInput(message protoreflect.ProtoMessage) func(*messages.PickleStepArgument_PickleDocString) error {
 	return func(resourcesJSON *messages.PickleStepArgument_PickleDocString) error {
 		// Get the Request message based on the type specified in the message
@@ -275,12 +428,510 @@ func (f *serverFeature) callGRPCMethodFromInput(message protoreflect.ProtoMessag
 		f.response = messageType.New().Interface()
 
 		// Invoke the API call
-		f.responseError = f.clientConn.Invoke(f.ctx, methodName, message, f.response)
+		f.trailer = nil
+		f.responseError = f.clientConn.Invoke(f.ctx, methodName, message, f.response, grpc.Trailer(&f.trailer))
 
 		return nil
 	}
 }
 
+// Opens a watch with the request in the doc string. Errors returned by the
+// server are received along with the first event of the watch.
+func (f *serverFeature) watchingTheFollowingResources(requestJSON *messages.PickleStepArgument_PickleDocString) error {
+	req := &serverpb.WatchResourcesRequest{}
+	if err := protojson.Unmarshal([]byte(requestJSON.Content), req); err != nil {
+		return fmt.Errorf("failed to unmarshal watch request: %v", err)
+	}
+	return f.startWatch(req)
+}
+
+// Opens a new watch with the previous watch request that resumes
+// after the last event that was received.
+func (f *serverFeature) resumingTheWatchFromTheLastResourceVersion() error {
+	event, ok := f.response.(*serverpb.WatchResourcesResponse)
+	if !ok || f.watchRequest == nil {
+		return fmt.Errorf("no watch event has been received")
+	}
+
+	req := proto.Clone(f.watchRequest).(*serverpb.WatchResourcesRequest)
+	req.ResourceVersion = event.ResourceVersion
+	return f.startWatch(req)
+}
+
+func (f *serverFeature) startWatch(req *serverpb.WatchResourcesRequest) error {
+	if f.watchCancel != nil {
+		f.watchCancel()
+	}
+
+	var ctx context.Context
+	ctx, f.watchCancel = context.WithCancel(f.ctx)
+	stream, err := f.clientConn.NewStream(
+		ctx,
+		&grpc.StreamDesc{ServerStreams: true},
+		"/stackpath.resourcemanager.v1.Resources/WatchResources",
+	)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	f.watch = stream
+	f.watchRequest = req
+	return nil
+}
+
+// Waits for the next event on the open watch and stores it as the response.
+func (f *serverFeature) receivingTheNextWatchEvent() error {
+	if f.watch == nil {
+		return fmt.Errorf("no watch has been opened")
+	}
+
+	event := &serverpb.WatchResourcesResponse{}
+	received := make(chan error, 1)
+	go func() {
+		received <- f.watch.RecvMsg(event)
+	}()
+
+	select {
+	case err := <-received:
+		f.response = event
+		f.responseError = err
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timed out waiting for the next watch event")
+	}
+}
+
+func (f *serverFeature) changesAreDispatchedToASink() error {
+	f.changes = make(chan *server.Change)
+	f.backend.StartDispatcher("features", &channelSink{changes: f.changes})
+	return nil
+}
+
+// Starts a dispatcher on another server that delivers to the same sink, as
+// happens when several replicas of the server are running.
+func (f *serverFeature) changesAreDispatchedToTheSameSinkByAnotherServer() error {
+	if f.changes == nil {
+		return fmt.Errorf("changes are not being dispatched")
+	}
+	f.otherBackend = server.New(f.db)
+	f.otherBackend.StartDispatcher("features", &channelSink{changes: f.changes})
+	return nil
+}
+
+func (f *serverFeature) noOtherChangeWillBeDispatched() error {
+	select {
+	case change := <-f.changes:
+		return fmt.Errorf("expected no other change, got %q for %q", change.Type, change.Name)
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// Waits for the next change to be dispatched from the outbox and verifies
+// the type of the change, the resource it was made to and who made it.
+func (f *serverFeature) theNextDispatchedChangeWillBe(changeType, name, principal string) error {
+	if f.changes == nil {
+		return fmt.Errorf("changes are not being dispatched")
+	}
+
+	select {
+	case change := <-f.changes:
+		if change.Type.String() != changeType {
+			return fmt.Errorf("expected change type to be %q, got %q", changeType, change.Type)
+		}
+		if change.Name != name {
+			return fmt.Errorf("expected change to be for %q, got %q", name, change.Name)
+		}
+		if change.Principal != principal {
+			return fmt.Errorf("expected change to be made by %q, got %q", principal, change.Principal)
+		}
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timed out waiting for the next dispatched change")
+	}
+}
+
+func (f *serverFeature) webhooksAreEnabled() error {
+	if f.webhooks == nil {
+		f.webhooks = newWebhookReceiver()
+	}
+	return f.backend.StartWebhooks(server.WebhookConfig{
+		// The receiver is listening on the loopback address
+		AllowPrivateNetworks: true,
+		Authorizer:           &featureAuthorizer{feature: f},
+		MaxAttempts:          3,
+		MinBackoff:           10 * time.Millisecond,
+		MaxBackoff:           50 * time.Millisecond,
+	})
+}
+
+func (f *serverFeature) theWebhookReceiverRespondsWithStatus(statusCode int) error {
+	if f.webhooks == nil {
+		return fmt.Errorf("webhooks have not been enabled")
+	}
+	atomic.StoreInt32(&f.webhooks.statusCode, int32(statusCode))
+	return nil
+}
+
+// Creates a webhook subscription that sends the webhooks for the resource
+// type to the local webhook receiver.
+func (f *serverFeature) subscribingToWebhooksWithTheSecret(name, resourceType, secret string) error {
+	return f.subscribingToWebhooksUnderWithTheSecret(name, resourceType, "", secret)
+}
+
+// Creates a webhook subscription that sends the webhooks for the resources of
+// the type under the parent to the local webhook receiver.
+func (f *serverFeature) subscribingToWebhooksUnderWithTheSecret(name, resourceType, parent, secret string) error {
+	if f.webhooks == nil {
+		return fmt.Errorf("webhooks have not been enabled")
+	}
+	f.webhooks.secret = secret
+
+	resource, err := anypb.New(&serverpb.WebhookSubscription{
+		Name:         name,
+		ResourceType: resourceType,
+		Parent:       parent,
+		Url:          f.webhooks.URL,
+		Secret:       secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	f.response = &anypb.Any{}
+	f.responseError = f.clientConn.Invoke(
+		f.ctx,
+		"/stackpath.resourcemanager.v1.Resources/CreateResource",
+		&serverpb.CreateResourceRequest{Resource: resource},
+		f.response,
+	)
+	return nil
+}
+
+// Waits for the next webhook and verifies it is a signed CloudEvent
+// for the provided event type and resource.
+func (f *serverFeature) theWebhookReceiverWillReceiveAnEventFor(eventType, name string) error {
+	if f.webhooks == nil {
+		return fmt.Errorf("webhooks have not been enabled")
+	}
+
+	var webhook *receivedWebhook
+	select {
+	case webhook = <-f.webhooks.requests:
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timed out waiting for the next webhook")
+	}
+
+	if contentType := webhook.header.Get("Content-Type"); contentType != "application/cloudevents+json" {
+		return fmt.Errorf("expected the content type to be %q, got %q", "application/cloudevents+json", contentType)
+	}
+
+	mac := hmac.New(sha256.New, []byte(f.webhooks.secret))
+	mac.Write(webhook.body)
+	if expected, actual := "sha256="+hex.EncodeToString(mac.Sum(nil)), webhook.header.Get("X-Webhook-Signature"); actual != expected {
+		return fmt.Errorf("expected the webhook signature to be %q, got %q", expected, actual)
+	}
+
+	var event struct {
+		SpecVersion string `json:"specversion"`
+		Type        string `json:"type"`
+		Subject     string `json:"subject"`
+		Data        struct {
+			Resource map[string]interface{} `json:"resource"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(webhook.body, &event); err != nil {
+		return fmt.Errorf("failed to parse the webhook body: %v", err)
+	}
+	f.webhookResource = event.Data.Resource
+	if event.SpecVersion != "1.0" {
+		return fmt.Errorf("expected the CloudEvents spec version to be %q, got %q", "1.0", event.SpecVersion)
+	}
+	if expected := "com.stackpathapis.resourcemanager.resource." + eventType; event.Type != expected {
+		return fmt.Errorf("expected the event type to be %q, got %q", expected, event.Type)
+	}
+	if event.Subject != name {
+		return fmt.Errorf("expected the event subject to be %q, got %q", name, event.Subject)
+	}
+	return nil
+}
+
+func (f *serverFeature) theWebhookResourceWillNotInclude(field string) error {
+	if f.webhookResource == nil {
+		return fmt.Errorf("no webhook has been received")
+	}
+	if value, ok := f.webhookResource[field]; ok {
+		return fmt.Errorf("expected the webhook resource to not include %q, got %v", field, value)
+	}
+	return nil
+}
+
+func (f *serverFeature) theWebhookReceiverWillNotReceiveAnyEvents() error {
+	if f.webhooks == nil {
+		return fmt.Errorf("webhooks have not been enabled")
+	}
+
+	select {
+	case webhook := <-f.webhooks.requests:
+		return fmt.Errorf("expected no webhooks, got %s", webhook.body)
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// Lists the webhook deliveries in the doc string starting after the page of
+// the stashed next page token.
+func (f *serverFeature) listingTheNextPageOfTheFollowingWebhookDeliveries(requestJSON *messages.PickleStepArgument_PickleDocString) error {
+	req := &serverpb.ListWebhookDeliveriesRequest{}
+	if err := protojson.Unmarshal([]byte(requestJSON.Content), req); err != nil {
+		return err
+	}
+	req.PageToken = f.nextPageToken
+
+	resp := &serverpb.ListWebhookDeliveriesResponse{}
+	f.response = resp
+	f.responseError = f.clientConn.Invoke(f.ctx, "/stackpath.resourcemanager.v1.Resources/ListWebhookDeliveries", req, resp)
+	return nil
+}
+
+// Lists the webhook deliveries of the subscription until all of them are in
+// the expected state. The last list response is stored as the response.
+func (f *serverFeature) theWebhookDeliveriesForWillEventuallyBe(subscription, state string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := &serverpb.ListWebhookDeliveriesResponse{}
+		f.response = resp
+		f.responseError = f.clientConn.Invoke(
+			f.ctx,
+			"/stackpath.resourcemanager.v1.Resources/ListWebhookDeliveries",
+			&serverpb.ListWebhookDeliveriesRequest{Parent: subscription},
+			resp,
+		)
+		if f.responseError != nil {
+			return nil
+		}
+
+		finished := len(resp.Deliveries) > 0
+		for _, delivery := range resp.Deliveries {
+			if delivery.State.String() != state {
+				finished = false
+			}
+		}
+		if finished {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the webhook deliveries to be %s: %v", state, resp.Deliveries)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (f *serverFeature) theGarbageCollectorIsRunning() error {
+	f.backend.StartGarbageCollector(50 * time.Millisecond)
+	return nil
+}
+
+func (f *serverFeature) theResourceWillEventuallyBeDeleted(resourceType, name string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := &anypb.Any{}
+		f.response = resp
+		f.responseError = f.clientConn.Invoke(
+			f.ctx,
+			"/stackpath.resourcemanager.v1.Resources/GetResource",
+			&serverpb.GetResourceRequest{Name: name, ResourceType: resourceType},
+			resp,
+		)
+		if f.responseError != nil {
+			return f.responseError
+		}
+
+		resource, err := resp.UnmarshalNew()
+		if err != nil {
+			return err
+		}
+		if resource.ProtoReflect().Has(resource.ProtoReflect().Descriptor().Fields().ByName("delete_time")) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %q to be deleted", name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Stashes the name of the long-running operation that was returned in place
+// of a resource so the operation steps can refer to it.
+func (f *serverFeature) stashOperationName() error {
+	if resp, ok := f.response.(*anypb.Any); ok {
+		op := &longrunning.Operation{}
+		if err := resp.UnmarshalTo(op); err == nil {
+			f.operationName = op.Name
+		}
+	}
+	if f.operationName == "" {
+		return fmt.Errorf("no long-running operation has been started")
+	}
+	return nil
+}
+
+// Invokes the method of the operations service for the stashed operation.
+func (f *serverFeature) callOperationsMethod(method string, req, resp proto.Message) error {
+	if err := f.stashOperationName(); err != nil {
+		return err
+	}
+	req.ProtoReflect().Set(req.ProtoReflect().Descriptor().Fields().ByName("name"), protoreflect.ValueOfString(f.operationName))
+
+	f.response = resp
+	f.responseError = f.clientConn.Invoke(f.ctx, "/google.longrunning.Operations/"+method, req, resp)
+	return nil
+}
+
+func (f *serverFeature) waitingForTheOperationToFinish() error {
+	return f.callOperationsMethod("WaitOperation", &longrunning.WaitOperationRequest{Timeout: durationpb.New(5 * time.Second)}, &longrunning.Operation{})
+}
+
+func (f *serverFeature) gettingTheOperation() error {
+	return f.callOperationsMethod("GetOperation", &longrunning.GetOperationRequest{}, &longrunning.Operation{})
+}
+
+func (f *serverFeature) cancellingTheOperation() error {
+	return f.callOperationsMethod("CancelOperation", &longrunning.CancelOperationRequest{}, &emptypb.Empty{})
+}
+
+func (f *serverFeature) deletingTheOperation() error {
+	return f.callOperationsMethod("DeleteOperation", &longrunning.DeleteOperationRequest{}, &emptypb.Empty{})
+}
+
+// Stores an operation that has not finished and has not received a heartbeat
+// for an hour, as if the server running it was stopped.
+func (f *serverFeature) anOperationWasLeftRunningByAServerThatHasStopped(resourceName string) error {
+	metadata, err := anypb.New(&serverpb.OperationMetadata{ResourceName: resourceName, Verb: "CREATE"})
+	if err != nil {
+		return err
+	}
+	op := &longrunning.Operation{Name: "operations/orphaned", Metadata: metadata}
+	data, err := protojson.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	stoppedTime := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	if _, err := f.db.Exec(
+		"INSERT INTO resource_operation (name, done, data, create_time, update_time) VALUES ($1, false, $2, $3, $3)",
+		op.Name,
+		string(data),
+		stoppedTime,
+	); err != nil {
+		return err
+	}
+	f.operationName = op.Name
+	return nil
+}
+
+func (f *serverFeature) thePurgerIsRunning() error {
+	f.backend.StartPurger(50*time.Millisecond, time.Hour)
+	return nil
+}
+
+func (f *serverFeature) thePurgerIsRunningWithARetentionOf(retention string) error {
+	duration, err := time.ParseDuration(retention)
+	if err != nil {
+		return err
+	}
+	f.backend.StartPurger(50*time.Millisecond, duration)
+	return nil
+}
+
+func (f *serverFeature) theResourceWillEventuallyBePurged(resourceType, name string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := &anypb.Any{}
+		f.response = resp
+		f.responseError = f.clientConn.Invoke(
+			f.ctx,
+			"/stackpath.resourcemanager.v1.Resources/GetResource",
+			&serverpb.GetResourceRequest{Name: name, ResourceType: resourceType},
+			resp,
+		)
+		if status.Code(f.responseError) == codes.NotFound {
+			return nil
+		}
+		if f.responseError != nil {
+			return f.responseError
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %q to be purged", name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (f *serverFeature) theServerIsDrained() error {
+	f.backend.Drain()
+	return nil
+}
+
+// Registers an admission hook that denies the operation. Denials for invalid
+// resources are rejected as invalid arguments.
+func (f *serverFeature) anAdmissionHookDeniesWritesWithTheMessage(reason, operation, message string) error {
+	return f.backend.CreateAdmissionHook(server.AdmissionHookConfig{
+		Name:       "deny-" + strings.ToLower(operation),
+		Operations: []server.AdmissionOperation{server.AdmissionOperation(operation)},
+		Hook: server.AdmissionHookFunc(func(ctx context.Context, req *server.AdmissionRequest) error {
+			return &server.AdmissionDenial{Message: message, Invalid: reason == "invalid"}
+		}),
+	})
+}
+
+// Registers an admission hook that denies the deletes of a single resource.
+func (f *serverFeature) anAdmissionHookDeniesDeletesOf(name string) error {
+	return f.backend.CreateAdmissionHook(server.AdmissionHookConfig{
+		Name:       "deny-delete-" + name,
+		Operations: []server.AdmissionOperation{server.AdmissionDelete},
+		Hook: server.AdmissionHookFunc(func(ctx context.Context, req *server.AdmissionRequest) error {
+			if req.Name != name {
+				return nil
+			}
+			return &server.AdmissionDenial{Message: "the resource can not be deleted"}
+		}),
+	})
+}
+
+// Registers an admission hook that never responds within its timeout.
+func (f *serverFeature) anUnresponsiveAdmissionHookThatFails(policy string) error {
+	return f.backend.CreateAdmissionHook(server.AdmissionHookConfig{
+		Name:          "unresponsive",
+		Timeout:       10 * time.Millisecond,
+		FailurePolicy: server.FailurePolicy("FAIL_" + strings.ToUpper(policy)),
+		Hook: server.AdmissionHookFunc(func(ctx context.Context, req *server.AdmissionRequest) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	})
+}
+
+// Registers a defaulter that sets a label on the resources of the type.
+func (f *serverFeature) aDefaulterSetsTheLabelTo(resourceType, key, value string) error {
+	return f.backend.CreateDefaulter(resourceType, server.DefaulterFunc(func(ctx context.Context, existing, resource proto.Message) error {
+		labels := resource.ProtoReflect().Mutable(resource.ProtoReflect().Descriptor().Fields().ByName("labels")).Map()
+		if !labels.Has(protoreflect.ValueOfString(key).MapKey()) {
+			labels.Set(protoreflect.ValueOfString(key).MapKey(), protoreflect.ValueOfString(value))
+		}
+		return nil
+	}))
+}
+
 func (f *serverFeature) noResourcesAreRegistered() error {
 	// Do nothing
 	return nil
@@ -319,6 +970,319 @@ func (f *serverFeature) theResponseValueWillBeWithinFromNow(path, threshold stri
 	return nil
 }
 
+// Starts the gRPC server for the backend with the options of the scenario and
+// connects the client to it. Any server that is already running for the
+// scenario is stopped first.
+func (f *serverFeature) startServer() error {
+	if f.server != nil {
+		f.clientConn.Close()
+		f.server.Stop()
+	}
+
+	var err error
+	f.listener, err = net.Listen("tcp", ":33000")
+	if err != nil {
+		return fmt.Errorf("failed to create tcp listener: %v", err)
+	}
+
+	opts := append([]server.GRPCOption{
+		server.WithAuthorizer(&featureAuthorizer{feature: f}),
+		// Re-check streams often so revoked access is noticed within a step.
+		server.WithStreamAuthorizationInterval(50 * time.Millisecond),
+	}, f.serverOptions...)
+	f.server, err = server.GRPCAPI(f.backend, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create new API server: %v", err)
+	}
+
+	// Start the server in the background
+	go f.server.Serve(f.listener)
+
+	return f.connect()
+}
+
+// Connects the client to the server. Connections are made over TLS when the
+// server is serving TLS.
+func (f *serverFeature) connect() error {
+	if f.clientConn != nil {
+		f.clientConn.Close()
+	}
+
+	dialOption := grpc.WithInsecure()
+	if f.certificates != nil {
+		dialOption = grpc.WithTransportCredentials(credentials.NewTLS(f.clientTLSConfig()))
+	}
+
+	var err error
+	f.clientConn, err = grpc.Dial(f.listener.Addr().String(), dialOption)
+	if err != nil {
+		return fmt.Errorf("failed to create client connection: %v", err)
+	}
+	return nil
+}
+
+// Returns the temporary directory of the scenario, creating it when needed.
+func (f *serverFeature) scenarioDir() (string, error) {
+	if f.tempDir == "" {
+		dir, err := ioutil.TempDir("", "features")
+		if err != nil {
+			return "", err
+		}
+		f.tempDir = dir
+	}
+	return f.tempDir, nil
+}
+
+// A certificate authority that issues the certificates of a scenario. The
+// certificates are written to the provided directory so they can be loaded
+// by the server.
+type testCertificates struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestCertificates(dir string) (*testCertificates, error) {
+	certs := &testCertificates{dir: dir}
+
+	var err error
+	certs.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "features-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &certs.caKey.PublicKey, certs.caKey)
+	if err != nil {
+		return nil, err
+	}
+	if certs.ca, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+
+	certs.caFile = filepath.Join(dir, "ca.pem")
+	certs.serial = 1
+	return certs, ioutil.WriteFile(certs.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+}
+
+// Issues a certificate for the common name that is signed by the authority
+// and writes it to the certificate and key files named after the common name.
+// Server certificates are valid for localhost.
+func (c *testCertificates) issue(commonName string, serverCert bool) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	c.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(c.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if serverCert {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, &key.PublicKey, c.caKey)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile = filepath.Join(c.dir, commonName+".pem")
+	keyFile = filepath.Join(c.dir, commonName+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// Returns the TLS configuration clients use to connect to the server. The
+// client certificate is presented when one has been issued for the scenario.
+func (f *serverFeature) clientTLSConfig() *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.certificates.ca)
+
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if f.clientCertificate != nil {
+		config.Certificates = []tls.Certificate{*f.clientCertificate}
+	}
+	return config
+}
+
+// Restarts the server so it terminates TLS with a certificate issued for the
+// scenario. Client certificates are required when requested.
+func (f *serverFeature) theServerIsServingTLS(clientCerts string) error {
+	dir, err := f.scenarioDir()
+	if err != nil {
+		return err
+	}
+	if f.certificates, err = newTestCertificates(dir); err != nil {
+		return err
+	}
+	certFile, keyFile, err := f.certificates.issue("localhost", true)
+	if err != nil {
+		return err
+	}
+
+	config := server.TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	if clientCerts != "" {
+		config.ClientCAFile = f.certificates.caFile
+		config.RequireClientCert = true
+	}
+	creds, err := server.NewTLSCredentials(config)
+	if err != nil {
+		return err
+	}
+	f.serverOptions = append(f.serverOptions, server.WithServerOptions(grpc.Creds(creds)))
+	return f.startServer()
+}
+
+// Reconnects to the server presenting a client certificate for the common name.
+func (f *serverFeature) connectingWithTheClientCertificate(commonName string) error {
+	if f.certificates == nil {
+		return fmt.Errorf("the server is not serving TLS")
+	}
+	certFile, keyFile, err := f.certificates.issue(commonName, false)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	f.clientCertificate = &certificate
+	return f.connect()
+}
+
+// Makes a TLS handshake with the server and verifies the application
+// protocol that was negotiated through ALPN.
+func (f *serverFeature) aTLSHandshakeWillNegotiate(protocol string) error {
+	if f.certificates == nil {
+		return fmt.Errorf("the server is not serving TLS")
+	}
+
+	config := f.clientTLSConfig()
+	config.NextProtos = []string{protocol}
+	conn, err := tls.Dial("tcp", f.listener.Addr().String(), config)
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	defer conn.Close()
+
+	if negotiated := conn.ConnectionState().NegotiatedProtocol; negotiated != protocol {
+		return fmt.Errorf("expected the negotiated protocol to be %q, got %q", protocol, negotiated)
+	}
+	return nil
+}
+
+// Restarts the server so it authenticates callers with JWTs that are
+// signed by a key generated for the scenario and issued for the audience.
+func (f *serverFeature) jwtsForTheAudienceAreTrusted(audience string) error {
+	dir, err := f.scenarioDir()
+	if err != nil {
+		return err
+	}
+	if f.jwtKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return err
+	}
+
+	keySet, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": "features",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(f.jwtKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(f.jwtKey.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, keySet, 0600); err != nil {
+		return err
+	}
+
+	authenticator, err := server.NewJWTAuthenticator(jwksFile, "", audience)
+	if err != nil {
+		return err
+	}
+	f.serverOptions = append(f.serverOptions, server.WithAuthenticators(authenticator))
+	return f.startServer()
+}
+
+// Signs a JWT for the subject with the trusted key and sends it as the bearer
+// token of the following requests.
+func (f *serverFeature) usingAJWTForWithTheAudienceThatExpiresIn(subject, audience, expiresIn string) error {
+	if f.jwtKey == nil {
+		return fmt.Errorf("no JWTs are trusted")
+	}
+	duration, err := time.ParseDuration(expiresIn)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q provided: %v", expiresIn, err)
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": "features", "typ": "JWT"})
+	if err != nil {
+		return err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"sub": subject,
+		"aud": audience,
+		"exp": time.Now().Add(duration).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, f.jwtKey, digest[:])
+	if err != nil {
+		return err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	f.ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	return nil
+}
+
+// Restarts the server so it authenticates callers with the common name of
+// their verified client certificate.
+func (f *serverFeature) clientCertificatesAreUsedToAuthenticateCallers() error {
+	if f.certificates == nil {
+		return fmt.Errorf("the server is not serving TLS")
+	}
+	authenticator, err := server.NewCertificateAuthenticator("")
+	if err != nil {
+		return err
+	}
+	f.serverOptions = append(f.serverOptions, server.WithAuthenticators(authenticator))
+	return f.startServer()
+}
+
 func (f *serverFeature) registerSteps(suite *godog.Suite) {
 	suite.Step(`^the resource "([^"]*)" is registered$`, f.theResourceIsRegistered)
 	suite.Step(`^creating the following resource:$`, f.callGRPCMethodFromInput(&serverpb.CreateResourceRequest{}))
@@ -327,15 +1291,71 @@ func (f *serverFeature) registerSteps(suite *godog.Suite) {
 	suite.Step(`^updating the following resource:$`, f.callGRPCMethodFromInput(&serverpb.UpdateResourceRequest{}))
 	suite.Step(`^undeleting the following resource$`, f.callGRPCMethodFromInput(&serverpb.UndeleteResourceRequest{}))
 	suite.Step(`^purging the following resource$`, f.callGRPCMethodFromInput(&serverpb.PurgeResourceRequest{}))
+	suite.Step(`^removing the following finalizer:$`, f.callGRPCMethodFromInput(&serverpb.RemoveFinalizerRequest{}))
+	suite.Step(`^the role "([^"]*)" is registered with the permissions "([^"]*)"$`, f.theRoleIsRegisteredWithThePermissions)
+	suite.Step(`^authorization is enabled$`, f.authorizationIsEnabled)
+	suite.Step(`^creating a server without an authorizer will fail$`, f.creatingAServerWithoutAnAuthorizerWillFail)
+	suite.Step(`^the role "([^"]*)" is granted to "([^"]*)" on "([^"]*)"$`, f.theRoleIsGrantedToOn)
+	suite.Step(`^getting the IAM policy:$`, f.callGRPCMethodFromInput(&serverpb.GetIamPolicyRequest{}))
+	suite.Step(`^setting the following IAM policy:$`, f.callGRPCMethodFromInput(&serverpb.SetIamPolicyRequest{}))
+	suite.Step(`^testing the following IAM permissions:$`, f.callGRPCMethodFromInput(&serverpb.TestIamPermissionsRequest{}))
 	suite.Step(`^I will receive an error with code ("[^"]*")$`, f.iWillReceiveAnErrorWithCode)
 	suite.Step(`^the BadRequest error details will be for the following fields$`, f.theErrorDetailsWillBeForTheFollowingFields)
+	suite.Step(`^the ResourceInfo error details will be for "([^"]*)"$`, f.theResourceInfoErrorDetailsWillBeFor)
 	suite.Step(`^I will receive a successful response$`, f.iWillReceiveASuccessfulResponse)
 	suite.Step(`^the response value "([^"]*)" will be "([^"]*)"$`, f.theResponseValueWillBe)
 	suite.Step(`^the response value "([^"]*)" will have a length of (\d+)$`, f.theResponseValueWillHaveLength)
 	suite.Step(`^the response value "([^"]*)" will be within "([^"]*)" from now$`, f.theResponseValueWillBeWithinFromNow)
+	suite.Step(`^the response trailer "([^"]*)" will be "([^"]*)"$`, f.theResponseTrailerWillBe)
+	suite.Step(`^listing the following resources:$`, f.callGRPCMethodFromInput(&serverpb.ListResourcesRequest{}))
 	suite.Step(`^stashing the next page token from the response$`, f.stashingTheNextPageTokenFromTheResponse)
 	suite.Step(`^using the stashed next page token$`, f.usingTheStashedNextPageToken)
 	suite.Step(`^no resources are registered$`, f.noResourcesAreRegistered)
+	suite.Step(`^watching the following resources:$`, f.watchingTheFollowingResources)
+	suite.Step(`^resuming the watch from the last resource version$`, f.resumingTheWatchFromTheLastResourceVersion)
+	suite.Step(`^receiving the next watch event$`, f.receivingTheNextWatchEvent)
+	suite.Step(`^changes are dispatched to a sink$`, f.changesAreDispatchedToASink)
+	suite.Step(`^the next dispatched change will be "([^"]*)" for "([^"]*)" by "([^"]*)"$`, f.theNextDispatchedChangeWillBe)
+	suite.Step(`^changes are dispatched to the same sink by another server$`, f.changesAreDispatchedToTheSameSinkByAnotherServer)
+	suite.Step(`^no other change will be dispatched$`, f.noOtherChangeWillBeDispatched)
+	suite.Step(`^webhooks are enabled$`, f.webhooksAreEnabled)
+	suite.Step(`^the garbage collector is running$`, f.theGarbageCollectorIsRunning)
+	suite.Step(`^the "([^"]*)" resource "([^"]*)" will eventually be deleted$`, f.theResourceWillEventuallyBeDeleted)
+	suite.Step(`^listing the dependents of the following resource:$`, f.callGRPCMethodFromInput(&serverpb.ListDependentsRequest{}))
+	suite.Step(`^batch creating the following resources:$`, f.callGRPCMethodFromInput(&serverpb.BatchCreateResourcesRequest{}))
+	suite.Step(`^batch getting the following resources:$`, f.callGRPCMethodFromInput(&serverpb.BatchGetResourcesRequest{}))
+	suite.Step(`^batch updating the following resources:$`, f.callGRPCMethodFromInput(&serverpb.BatchUpdateResourcesRequest{}))
+	suite.Step(`^batch deleting the following resources:$`, f.callGRPCMethodFromInput(&serverpb.BatchDeleteResourcesRequest{}))
+	suite.Step(`^transacting the following operations:$`, f.callGRPCMethodFromInput(&serverpb.TransactRequest{}))
+	suite.Step(`^the server is serving TLS( to clients with certificates)?$`, f.theServerIsServingTLS)
+	suite.Step(`^connecting with the client certificate "([^"]*)"$`, f.connectingWithTheClientCertificate)
+	suite.Step(`^a TLS handshake will negotiate "([^"]*)"$`, f.aTLSHandshakeWillNegotiate)
+	suite.Step(`^JWTs for the audience "([^"]*)" are trusted$`, f.jwtsForTheAudienceAreTrusted)
+	suite.Step(`^using a JWT for "([^"]*)" with the audience "([^"]*)" that expires in "([^"]*)"$`, f.usingAJWTForWithTheAudienceThatExpiresIn)
+	suite.Step(`^client certificates are used to authenticate callers$`, f.clientCertificatesAreUsedToAuthenticateCallers)
+	suite.Step(`^waiting for the operation to finish$`, f.waitingForTheOperationToFinish)
+	suite.Step(`^getting the operation$`, f.gettingTheOperation)
+	suite.Step(`^cancelling the operation$`, f.cancellingTheOperation)
+	suite.Step(`^deleting the operation$`, f.deletingTheOperation)
+	suite.Step(`^an operation for "([^"]*)" was left running by a server that has stopped$`, f.anOperationWasLeftRunningByAServerThatHasStopped)
+	suite.Step(`^the purger is running$`, f.thePurgerIsRunning)
+	suite.Step(`^the purger is running with a retention of "([^"]*)"$`, f.thePurgerIsRunningWithARetentionOf)
+	suite.Step(`^the "([^"]*)" resource "([^"]*)" will eventually be purged$`, f.theResourceWillEventuallyBePurged)
+	suite.Step(`^the server is drained$`, f.theServerIsDrained)
+	suite.Step(`^listing the following operations:$`, f.callGRPCMethodFromInput(&longrunning.ListOperationsRequest{}))
+	suite.Step(`^a defaulter for "([^"]*)" sets the "([^"]*)" label to "([^"]*)"$`, f.aDefaulterSetsTheLabelTo)
+	suite.Step(`^an admission hook denies (invalid|unadmitted) ([A-Z]+) writes with the message "([^"]*)"$`, f.anAdmissionHookDeniesWritesWithTheMessage)
+	suite.Step(`^an admission hook denies deletes of "([^"]*)"$`, f.anAdmissionHookDeniesDeletesOf)
+	suite.Step(`^an unresponsive admission hook that fails (open|closed)$`, f.anUnresponsiveAdmissionHookThatFails)
+	suite.Step(`^the webhook receiver responds with status (\d+)$`, f.theWebhookReceiverRespondsWithStatus)
+	suite.Step(`^subscribing "([^"]*)" to "([^"]*)" webhooks with the secret "([^"]*)"$`, f.subscribingToWebhooksWithTheSecret)
+	suite.Step(`^subscribing "([^"]*)" to "([^"]*)" webhooks under "([^"]*)" with the secret "([^"]*)"$`, f.subscribingToWebhooksUnderWithTheSecret)
+	suite.Step(`^the webhook receiver will receive a "([^"]*)" event for "([^"]*)"$`, f.theWebhookReceiverWillReceiveAnEventFor)
+	suite.Step(`^the webhook resource will not include "([^"]*)"$`, f.theWebhookResourceWillNotInclude)
+	suite.Step(`^the webhook receiver will not receive any events$`, f.theWebhookReceiverWillNotReceiveAnyEvents)
+	suite.Step(`^the webhook deliveries for "([^"]*)" will eventually be "([^"]*)"$`, f.theWebhookDeliveriesForWillEventuallyBe)
+	suite.Step(`^listing the following webhook deliveries:$`, f.callGRPCMethodFromInput(&serverpb.ListWebhookDeliveriesRequest{}))
+	suite.Step(`^listing the next page of the following webhook deliveries:$`, f.listingTheNextPageOfTheFollowingWebhookDeliveries)
 }
 
 func FeatureContext(s *godog.Suite) {
@@ -345,15 +1365,6 @@ func FeatureContext(s *godog.Suite) {
 	feature.registerSteps(s)
 
 	s.BeforeScenario(func(*messages.Pickle) {
-		feature.listener, err = net.Listen("tcp", ":33000")
-		if err != nil {
-			log.Fatalf("failed to create tcp listener: %v", err)
-		}
-
-		feature.clientConn, err = grpc.Dial(feature.listener.Addr().String(), grpc.WithInsecure())
-		if err != nil {
-			log.Fatalf("failed to create client connection: %v", err)
-		}
 		feature.ctx = context.Background()
 		feature.db, err = sql.Open("txdb", "postgres://root@localhost:26257/resources?sslmode=disable")
 		if err != nil {
@@ -368,20 +1379,48 @@ func FeatureContext(s *godog.Suite) {
 		// be empty by default. Test cases must register the types they want
 		// to exist in the server.
 		feature.backend = server.New(feature.db)
-
-		api, err := server.GRPCAPI(feature.backend)
-		if err != nil {
-			log.Fatalf("failed to create new API server: %v", err)
+		if err := feature.backend.Migrate(feature.ctx); err != nil {
+			log.Fatalf("failed to create system tables: %v", err)
 		}
-		feature.server = api
 
-		// Start the server in the background
-		go feature.server.Serve(feature.listener)
+		feature.authorizationEnabled = false
+		feature.operationName = ""
+		if err := feature.startServer(); err != nil {
+			log.Fatalf("failed to start the gRPC server: %v", err)
+		}
 	})
 
 	s.AfterScenario(func(*messages.Pickle, error) {
-		feature.listener.Close()
+		if feature.watchCancel != nil {
+			feature.watchCancel()
+			feature.watchCancel = nil
+		}
+		feature.watch = nil
+		feature.watchRequest = nil
+		feature.clientConn.Close()
+		feature.clientConn = nil
 		feature.server.Stop()
+		feature.server = nil
+		feature.serverOptions = nil
+		if feature.tempDir != "" {
+			os.RemoveAll(feature.tempDir)
+			feature.tempDir = ""
+		}
+		feature.certificates = nil
+		feature.clientCertificate = nil
+		feature.jwtKey = nil
+		// Stop any dispatchers before the database is removed
+		feature.backend.Drain()
+		if feature.otherBackend != nil {
+			feature.otherBackend.Drain()
+			feature.otherBackend = nil
+		}
+		feature.changes = nil
+		if feature.webhooks != nil {
+			feature.webhooks.Close()
+			feature.webhooks = nil
+		}
+		feature.webhookResource = nil
 		if _, err := feature.db.Exec("DROP DATABASE IF EXISTS resources"); err != nil {
 			log.Fatalf("failed to delete database: %v", err)
 		}
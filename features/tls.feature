@@ -0,0 +1,43 @@
+Feature: TLS
+  In order to protect the requests that are made to the server
+  As an operator of the system
+  I need the server to terminate TLS and verify client certificates
+
+  Scenario: Serving gRPC over TLS
+    Given the resource "features.Account" is registered
+      And the server is serving TLS
+     Then a TLS handshake will negotiate "h2"
+     When creating the following resource:
+      """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+      """
+     Then I will receive a successful response
+      And the response value "name" will be "accounts/default-account"
+
+  Scenario: Connections without a client certificate are rejected when one is required
+    Given the resource "features.Account" is registered
+      And the server is serving TLS to clients with certificates
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "UNAVAILABLE"
+     When connecting with the client certificate "joe"
+     Then a TLS handshake will negotiate "h2"
+     When getting the following resource:
+      """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+      """
+     Then I will receive an error with code "NOT_FOUND"
@@ -0,0 +1,165 @@
+Feature: Transactions
+  In order to make related changes to resources together
+  As a user of the system
+  I need to be able to make a list of operations in a single transaction
+
+  Scenario: Making operations across resources in a transaction
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+     When transacting the following operations:
+       """
+        {
+          "operations": [
+            {
+              "assert_etag": {"resource_type": "features.Account", "name": "accounts/first-account"},
+              "etag": "1"
+            },
+            {
+              "create": {
+                "resource": {
+                  "@type": "features.Account",
+                  "display_name": "Second Account",
+                  "name": "accounts/second-account"
+                }
+              }
+            },
+            {
+              "update": {
+                "resource": {
+                  "@type": "features.Account",
+                  "display_name": "Renamed Account",
+                  "name": "accounts/first-account"
+                },
+                "update_mask": "displayName"
+              }
+            }
+          ]
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources" will have a length of 3
+      And the response value "resources[0].displayName" will be "First Account"
+      And the response value "resources[1].name" will be "accounts/second-account"
+      And the response value "resources[2].displayName" will be "Renamed Account"
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/second-account"
+        }
+       """
+     Then I will receive a successful response
+      And the response value "displayName" will be "Second Account"
+
+  Scenario: None of the operations are committed when an etag assertion fails
+    Given the resource "features.Account" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "First Account",
+            "name": "accounts/first-account"
+          }
+        }
+       """
+     When transacting the following operations:
+       """
+        {
+          "operations": [
+            {
+              "create": {
+                "resource": {
+                  "@type": "features.Account",
+                  "display_name": "Second Account",
+                  "name": "accounts/second-account"
+                }
+              }
+            },
+            {
+              "assert_etag": {"resource_type": "features.Account", "name": "accounts/first-account"},
+              "etag": "100"
+            }
+          ]
+        }
+       """
+     Then I will receive an error with code "ABORTED"
+     When getting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/second-account"
+        }
+       """
+     Then I will receive an error with code "NOT_FOUND"
+
+  Scenario: Transactions fail with the error of the failed operation
+    Given the resource "features.Account" is registered
+     When transacting the following operations:
+       """
+        {
+          "operations": [
+            {
+              "create": {
+                "resource": {
+                  "@type": "features.Account",
+                  "display_name": "First Account",
+                  "name": "accounts/first-account"
+                }
+              }
+            },
+            {
+              "delete": {"resource_type": "features.Account", "name": "accounts/missing-account"}
+            }
+          ]
+        }
+       """
+     Then I will receive an error with code "NOT_FOUND"
+
+  Scenario: Etag assertions compare the resource version rather than the etag of the resource
+    Given the resource "features.ApiKey" is registered
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.ApiKey",
+            "display_name": "Deploy Key",
+            "name": "apiKeys/deploy-key",
+            "etag": "client-etag"
+          }
+        }
+       """
+     When transacting the following operations:
+       """
+        {
+          "operations": [
+            {
+              "assert_etag": {"resource_type": "features.ApiKey", "name": "apiKeys/deploy-key"},
+              "etag": "client-etag"
+            }
+          ]
+        }
+       """
+     Then I will receive an error with code "ABORTED"
+     When transacting the following operations:
+       """
+        {
+          "operations": [
+            {
+              "assert_etag": {"resource_type": "features.ApiKey", "name": "apiKeys/deploy-key"},
+              "etag": "1"
+            }
+          ]
+        }
+       """
+     Then I will receive a successful response
+      And the response value "resources[0].displayName" will be "Deploy Key"
@@ -0,0 +1,231 @@
+Feature: Resource Webhooks
+  In order to react to changes made to resources
+  As a partner integrating with the control plane
+  I need to receive webhooks when resources change
+
+  Scenario: Webhooks are sent for the lifecycle of a resource
+    Given the resource "features.Account" is registered
+      And webhooks are enabled
+      And subscribing "webhookSubscriptions/accounts" to "features.Account" webhooks with the secret "s3cr3t"
+     Then I will receive a successful response
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+      And undeleting the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+     Then the webhook receiver will receive a "created" event for "accounts/default-account"
+      And the webhook receiver will receive a "deleted" event for "accounts/default-account"
+      And the webhook receiver will receive a "undeleted" event for "accounts/default-account"
+      And the webhook deliveries for "webhookSubscriptions/accounts" will eventually be "SUCCEEDED"
+      And the response value "deliveries" will have a length of 3
+      And the response value "deliveries[0].eventType" will be "CREATED"
+      And the response value "deliveries[0].attempts" will be "1"
+
+  Scenario: Listing the webhook deliveries of a subscription a page at a time
+    Given the resource "features.Account" is registered
+      And webhooks are enabled
+      And subscribing "webhookSubscriptions/accounts" to "features.Account" webhooks with the secret "s3cr3t"
+      And creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+      And deleting the following resource:
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+      And undeleting the following resource
+       """
+        {
+          "resource_type": "features.Account",
+          "name": "accounts/default-account"
+        }
+       """
+      And the webhook receiver will receive a "created" event for "accounts/default-account"
+      And the webhook receiver will receive a "deleted" event for "accounts/default-account"
+      And the webhook receiver will receive a "undeleted" event for "accounts/default-account"
+      And the webhook deliveries for "webhookSubscriptions/accounts" will eventually be "SUCCEEDED"
+     When listing the following webhook deliveries:
+       """
+        {
+          "parent": "webhookSubscriptions/accounts",
+          "page_size": 2
+        }
+       """
+     Then I will receive a successful response
+      And the response value "deliveries" will have a length of 2
+      And the response value "deliveries[0].eventType" will be "CREATED"
+      And the response value "deliveries[1].eventType" will be "DELETED"
+      And stashing the next page token from the response
+     When listing the next page of the following webhook deliveries:
+       """
+        {
+          "parent": "webhookSubscriptions/accounts",
+          "page_size": 2
+        }
+       """
+     Then I will receive a successful response
+      And the response value "deliveries" will have a length of 1
+      And the response value "deliveries[0].eventType" will be "UNDELETED"
+      And the response value "nextPageToken" will be ""
+     When listing the following webhook deliveries:
+       """
+        {
+          "parent": "webhookSubscriptions/accounts",
+          "page_size": -1
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+
+  Scenario: Webhooks are dead-lettered when the receiver keeps failing
+    Given the resource "features.Account" is registered
+      And webhooks are enabled
+      And the webhook receiver responds with status 500
+      And subscribing "webhookSubscriptions/accounts" to "features.Account" webhooks with the secret "s3cr3t"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then the webhook deliveries for "webhookSubscriptions/accounts" will eventually be "DEAD_LETTERED"
+      And the response value "deliveries[0].attempts" will be "3"
+      And the response value "deliveries[0].lastError" will be "the receiver responded with status 500"
+
+  Scenario: Webhooks are only sent for the resources under the parent of the subscription
+    Given the resource "features.Account" is registered
+      And webhooks are enabled
+      And subscribing "webhookSubscriptions/accounts" to "features.Account" webhooks under "accounts/other-account" with the secret "s3cr3t"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the webhook receiver will not receive any events
+
+  Scenario: Webhooks only include the fields the subscriber is allowed to read
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*,billing.accounts.update"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on ""
+      And authorization is enabled
+      And webhooks are enabled
+      And subscribing "webhookSubscriptions/accounts" to "features.Account" webhooks with the secret "s3cr3t"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account",
+            "billing_email": "billing@example.com"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the webhook receiver will receive a "created" event for "accounts/default-account"
+      And the webhook resource will not include "billingEmail"
+
+  Scenario: Webhooks are not sent for resources the subscriber is not allowed to get
+    Given the resource "features.Account" is registered
+      And the role "roles/resourcemanager.admin" is registered with the permissions "resourcemanager.resources.*"
+      And the role "roles/resourcemanager.admin" is granted to "allUsers" on "webhookSubscriptions/accounts"
+      And the role "roles/accounts.creator" is registered with the permissions "resourcemanager.resources.create"
+      And the role "roles/accounts.creator" is granted to "allUsers" on "accounts/default-account"
+      And authorization is enabled
+      And webhooks are enabled
+      And subscribing "webhookSubscriptions/accounts" to "features.Account" webhooks with the secret "s3cr3t"
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "features.Account",
+            "display_name": "My Testing Account",
+            "name": "accounts/default-account"
+          }
+        }
+       """
+     Then I will receive a successful response
+      And the webhook receiver will not receive any events
+
+  Scenario: Error when subscribing to webhooks for webhook subscriptions
+    Given webhooks are enabled
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "stackpath.resourcemanager.v1.WebhookSubscription",
+            "name": "webhookSubscriptions/subscriptions",
+            "resource_type": "stackpath.resourcemanager.v1.WebhookSubscription",
+            "url": "https://example.com/webhooks"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+
+  Scenario: Error when subscribing to webhooks for an unknown resource type
+    Given webhooks are enabled
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "stackpath.resourcemanager.v1.WebhookSubscription",
+            "name": "webhookSubscriptions/unknown",
+            "resource_type": "features.Unknown",
+            "url": "https://example.com/webhooks"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
+
+  Scenario: Error when subscribing to webhooks with a URL that is not http or https
+    Given the resource "features.Account" is registered
+      And webhooks are enabled
+     When creating the following resource:
+       """
+        {
+          "resource": {
+            "@type": "stackpath.resourcemanager.v1.WebhookSubscription",
+            "name": "webhookSubscriptions/accounts",
+            "resource_type": "features.Account",
+            "url": "file:///etc/passwd"
+          }
+        }
+       """
+     Then I will receive an error with code "INVALID_ARGUMENT"
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/spf13/cobra"
 	"github.com/stackpath/control-plane/features"
 	"github.com/stackpath/control-plane/server"
+	"google.golang.org/grpc"
 )
 
 // Create the root command
@@ -24,6 +31,29 @@ var startCmd = &cobra.Command{
 
 func main() {
 	startCmd.PersistentFlags().String("grpc.listen-address", "The listening address that the gRPC should bind to", ":8080")
+	startCmd.PersistentFlags().Duration("grpc.shutdown-timeout", 30*time.Second, "The amount of time in-flight RPCs have to complete before the server is forcefully stopped")
+	startCmd.PersistentFlags().String("grpc.tls-cert-file", "", "The PEM encoded certificate file used to serve TLS. TLS is disabled when not provided")
+	startCmd.PersistentFlags().String("grpc.tls-key-file", "", "The PEM encoded private key file for the TLS certificate")
+	startCmd.PersistentFlags().String("grpc.tls-client-ca-file", "", "The PEM encoded CA bundle that client certificates are verified against")
+	startCmd.PersistentFlags().Bool("grpc.tls-require-client-cert", false, "Reject connections that do not present a verified client certificate")
+	startCmd.PersistentFlags().String("auth.token-file", "", "A CSV file of static bearer tokens in the format \"token,principal\"")
+	startCmd.PersistentFlags().String("auth.jwks-file", "", "A JWKS file containing the keys that JWT bearer tokens must be signed by")
+	startCmd.PersistentFlags().String("auth.jwt-issuer", "", "The issuer that JWT bearer tokens must be issued by")
+	startCmd.PersistentFlags().String("auth.jwt-audience", "", "The audience that JWT bearer tokens must be intended for")
+	startCmd.PersistentFlags().Bool("auth.client-cert", false, "Authenticate callers using their verified TLS client certificate")
+	startCmd.PersistentFlags().String("auth.client-cert-subject-file", "", "A CSV file mapping client certificate subjects to principals in the format \"subject,principal\"")
+	startCmd.PersistentFlags().String("auth.policy-file", "", "A JSON file containing the roles and role bindings used to authorize callers")
+	startCmd.PersistentFlags().Bool("auth.authorization-enabled", false, "Enforce the IAM policies set on resources using the predefined roles. Enabled automatically when a policy file is provided")
+	startCmd.PersistentFlags().Duration("auth.stream-authorization-interval", time.Minute, "How often the permissions of callers are re-checked on long-lived streams")
+	startCmd.PersistentFlags().String("admission.hook-file", "", "A JSON file containing the remote admission hooks that are called before writes")
+	startCmd.PersistentFlags().Bool("purger.enabled", false, "Permanently remove soft-deleted resources once their retention period has passed, and fail operations orphaned by stopped servers")
+	startCmd.PersistentFlags().Duration("purger.interval", time.Hour, "How often the purger should check for expired soft-deleted resources. The purger is disabled when not positive")
+	startCmd.PersistentFlags().Duration("purger.retention", 32*24*time.Hour, "How long soft-deleted resources are retained before they are purged")
+	startCmd.PersistentFlags().Duration("gc.interval", time.Minute, "How often the garbage collector should check for resources whose owners have been deleted. The garbage collector is disabled when not positive")
+	startCmd.PersistentFlags().Bool("webhooks.enabled", false, "Send webhooks to the webhook subscriptions when resources change")
+	startCmd.PersistentFlags().Int("webhooks.max-attempts", 10, "The number of times a webhook is sent before it is dead-lettered")
+	startCmd.PersistentFlags().Duration("webhooks.timeout", 30*time.Second, "How long receivers have to respond to a webhook")
+	startCmd.PersistentFlags().Bool("webhooks.allow-private-networks", false, "Allow webhooks to be sent to loopback, private and link-local network addresses")
 	// Add a new command to run an empty control plane server.
 	rootCmd.AddCommand(startCmd)
 
@@ -52,21 +82,194 @@ func serverFunc(cmd *cobra.Command, args []string) error {
 
 	backend := server.New(db)
 
+	log.Print("Creating the system tables")
+	if err := backend.Migrate(context.Background()); err != nil {
+		log.Fatalf("Failed to create the system tables: %v", err)
+	}
+
 	if err := backend.CreateResourceDescriptor(&features.Account{}); err != nil {
 		log.Fatalf("Failed to register Account resource: %v", err)
 	}
 
+	var grpcOpts []server.GRPCOption
+	if certFile, _ := cmd.Flags().GetString("grpc.tls-cert-file"); certFile != "" {
+		keyFile, _ := cmd.Flags().GetString("grpc.tls-key-file")
+		clientCAFile, _ := cmd.Flags().GetString("grpc.tls-client-ca-file")
+		requireClientCert, _ := cmd.Flags().GetBool("grpc.tls-require-client-cert")
+
+		log.Printf("Enabling TLS for the gRPC server with certificate %q", certFile)
+		creds, err := server.NewTLSCredentials(server.TLSConfig{
+			CertFile:          certFile,
+			KeyFile:           keyFile,
+			ClientCAFile:      clientCAFile,
+			RequireClientCert: requireClientCert,
+		})
+		if err != nil {
+			log.Fatalf("Failed to load TLS credentials: %v", err)
+		}
+		grpcOpts = append(grpcOpts, server.WithServerOptions(grpc.Creds(creds)))
+	}
+
+	authenticators, err := authenticatorsFromFlags(cmd)
+	if err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	if len(authenticators) == 0 {
+		log.Print("No authentication methods configured, all callers will be treated as allUsers")
+	}
+	grpcOpts = append(grpcOpts, server.WithAuthenticators(authenticators...))
+
+	authorizationEnabled, _ := cmd.Flags().GetBool("auth.authorization-enabled")
+	if policyFile, _ := cmd.Flags().GetString("auth.policy-file"); policyFile != "" {
+		if err := server.LoadPolicyFile(backend, policyFile); err != nil {
+			log.Fatalf("Failed to configure authorization: %v", err)
+		}
+		authorizationEnabled = true
+	}
+	if authorizationEnabled {
+		streamInterval, _ := cmd.Flags().GetDuration("auth.stream-authorization-interval")
+		grpcOpts = append(grpcOpts, server.WithAuthorizer(backend), server.WithStreamAuthorizationInterval(streamInterval))
+	} else {
+		log.Print("Authorization is not enabled, permission checks are disabled")
+	}
+
+	if hookFile, _ := cmd.Flags().GetString("admission.hook-file"); hookFile != "" {
+		if err := server.LoadAdmissionHookFile(backend, hookFile); err != nil {
+			log.Fatalf("Failed to configure admission hooks: %v", err)
+		}
+	}
+
 	log.Print("Creating a new gRPC server")
-	srv, err := server.GRPCAPI(backend)
+	srv, err := server.GRPCAPI(backend, grpcOpts...)
 	if err != nil {
 		log.Fatalf("Failed to create a new gRPC server: %v", err)
 	}
 
+	if purgerEnabled, _ := cmd.Flags().GetBool("purger.enabled"); purgerEnabled {
+		purgeInterval, _ := cmd.Flags().GetDuration("purger.interval")
+		purgeRetention, _ := cmd.Flags().GetDuration("purger.retention")
+
+		log.Print("Starting the purger")
+		backend.StartPurger(purgeInterval, purgeRetention)
+	}
+
+	gcInterval, _ := cmd.Flags().GetDuration("gc.interval")
+	backend.StartGarbageCollector(gcInterval)
+
+	if webhooksEnabled, _ := cmd.Flags().GetBool("webhooks.enabled"); webhooksEnabled {
+		maxAttempts, _ := cmd.Flags().GetInt("webhooks.max-attempts")
+		timeout, _ := cmd.Flags().GetDuration("webhooks.timeout")
+
+		allowPrivateNetworks, _ := cmd.Flags().GetBool("webhooks.allow-private-networks")
+
+		config := server.WebhookConfig{
+			Timeout:              timeout,
+			AllowPrivateNetworks: allowPrivateNetworks,
+			MaxAttempts:          maxAttempts,
+		}
+		if authorizationEnabled {
+			config.Authorizer = backend
+		}
+
+		log.Print("Starting the webhook sender")
+		if err := backend.StartWebhooks(config); err != nil {
+			log.Fatalf("Failed to start the webhook sender: %v", err)
+		}
+	}
+
+	// Listen for termination signals so the server can be gracefully stopped.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
 	log.Print("Starting gRPC server")
-	err = srv.Serve(listener)
-	if err != nil {
-		log.Fatalf("error when running gRPC server: %v", err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		// The server stopped without being asked to. Release the background
+		// workers and database before reporting the failure.
+		backend.Shutdown(context.Background())
+		return fmt.Errorf("error when running gRPC server: %v", err)
+	case sig := <-signals:
+		log.Printf("Received %v signal, shutting down the gRPC server", sig)
+	}
+
+	shutdownTimeout, _ := cmd.Flags().GetDuration("grpc.shutdown-timeout")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Close any open watches so they do not hold up the graceful stop.
+	backend.Drain()
+
+	if err := stopServer(ctx, srv); err != nil {
+		// The shutdown timeout has passed, so cancel any running operations.
+		backend.Shutdown(ctx)
+		return err
+	}
+
+	log.Print("Draining background workers and closing the database")
+	if err := backend.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shutdown the server backend: %v", err)
 	}
 
+	log.Print("Server has been shutdown")
 	return nil
 }
+
+// Creates the authenticators that have been enabled through the command flags.
+func authenticatorsFromFlags(cmd *cobra.Command) ([]server.Authenticator, error) {
+	var authenticators []server.Authenticator
+
+	if tokenFile, _ := cmd.Flags().GetString("auth.token-file"); tokenFile != "" {
+		authenticator, err := server.NewStaticTokenAuthenticator(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if jwksFile, _ := cmd.Flags().GetString("auth.jwks-file"); jwksFile != "" {
+		issuer, _ := cmd.Flags().GetString("auth.jwt-issuer")
+		audience, _ := cmd.Flags().GetString("auth.jwt-audience")
+		authenticator, err := server.NewJWTAuthenticator(jwksFile, issuer, audience)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if clientCert, _ := cmd.Flags().GetBool("auth.client-cert"); clientCert {
+		subjectFile, _ := cmd.Flags().GetString("auth.client-cert-subject-file")
+		authenticator, err := server.NewCertificateAuthenticator(subjectFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	return authenticators, nil
+}
+
+// Gracefully stops the gRPC server so that no new RPCs are accepted and any
+// in-flight RPCs are allowed to complete. The server will be forcefully stopped
+// when the in-flight RPCs do not complete before the context is done.
+func stopServer(ctx context.Context, srv *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		// Cancel any of the RPCs that are still running
+		srv.Stop()
+		return fmt.Errorf("in-flight RPCs did not complete before the shutdown timeout: %v", ctx.Err())
+	}
+}
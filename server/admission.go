@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// The default amount of time an admission hook has to respond.
+const defaultAdmissionTimeout = 10 * time.Second
+
+// How long all of the admission hooks of a write have to respond in total.
+// Hooks are called while the transaction of the write holds the locks on the
+// resources it has written so far, which includes the earlier requests of a
+// batch or transaction and the descendants of a cascade. This bounds how long
+// each write can block other writes to those resources. The revisions of the
+// writes are only taken once the transaction commits, so hooks never block
+// the writes to other resources.
+const maxAdmissionTime = 15 * time.Second
+
+// AdmissionOperation is the type of write that is being admitted.
+type AdmissionOperation string
+
+const (
+	AdmissionCreate   AdmissionOperation = "CREATE"
+	AdmissionUpdate   AdmissionOperation = "UPDATE"
+	AdmissionDelete   AdmissionOperation = "DELETE"
+	AdmissionUndelete AdmissionOperation = "UNDELETE"
+)
+
+// FailurePolicy determines what happens to a write when an admission hook
+// fails to respond or returns an error that is not an AdmissionDenial.
+type FailurePolicy string
+
+const (
+	// Writes are rejected when the hook fails. This is the default policy.
+	FailClosed FailurePolicy = "FAIL_CLOSED"
+	// Writes are allowed when the hook fails.
+	FailOpen FailurePolicy = "FAIL_OPEN"
+)
+
+// AdmissionRequest describes a write that is about to be committed.
+type AdmissionRequest struct {
+	Operation    AdmissionOperation `json:"operation"`
+	ResourceType string             `json:"resourceType"`
+	Name         string             `json:"name"`
+	Parent       string             `json:"parent"`
+
+	// The resource before and after the write. The old resource is nil
+	// when the resource is being created.
+	OldResource *anypb.Any `json:"-"`
+	NewResource *anypb.Any `json:"-"`
+
+	// The principal that is making the write.
+	Principal string `json:"principal"`
+}
+
+// AdmissionHook decides whether a write to a resource is allowed to be
+// committed. Hooks can veto a write by returning an AdmissionDenial. Any
+// other error is treated as a failure of the hook and handled according
+// to the failure policy of the hook. Hooks must return once the provided
+// context is done, since the write waits for them to return.
+type AdmissionHook interface {
+	Admit(ctx context.Context, req *AdmissionRequest) error
+}
+
+// AdmissionHookFunc allows a function to be used as an AdmissionHook.
+type AdmissionHookFunc func(ctx context.Context, req *AdmissionRequest) error
+
+func (f AdmissionHookFunc) Admit(ctx context.Context, req *AdmissionRequest) error {
+	return f(ctx, req)
+}
+
+// AdmissionDenial is returned by admission hooks to reject a write.
+type AdmissionDenial struct {
+	// The reason the write was rejected, which is returned to the caller.
+	Message string
+
+	// Rejects the write with an InvalidArgument error since the resource itself
+	// is not valid, such as when it breaks a naming rule. Writes are rejected with
+	// a FailedPrecondition error otherwise, such as when a quota is exceeded.
+	Invalid bool
+}
+
+func (d *AdmissionDenial) Error() string {
+	return d.Message
+}
+
+// AdmissionHookConfig registers an admission hook on the server.
+type AdmissionHookConfig struct {
+	// The name of the hook that is included in errors.
+	Name string `json:"name"`
+
+	// The resource types and operations the hook is called for. The
+	// hook is called for all of them when none are provided.
+	ResourceTypes []string             `json:"resourceTypes"`
+	Operations    []AdmissionOperation `json:"operations"`
+
+	// How long the hook has to respond. Defaults to 10 seconds and can not
+	// be longer than the 15 seconds all of the hooks have to respond in.
+	Timeout time.Duration `json:"-"`
+
+	// What happens to the write when the hook fails. Defaults to FailClosed.
+	FailurePolicy FailurePolicy `json:"failurePolicy"`
+
+	// The hook that is called.
+	Hook AdmissionHook `json:"-"`
+}
+
+// Checks if the hook should be called for the write.
+func (c *AdmissionHookConfig) appliesTo(req *AdmissionRequest) bool {
+	return (len(c.ResourceTypes) == 0 || containsString(c.ResourceTypes, req.ResourceType)) &&
+		(len(c.Operations) == 0 || containsString(operationNames(c.Operations), string(req.Operation)))
+}
+
+func operationNames(operations []AdmissionOperation) []string {
+	names := make([]string, len(operations))
+	for i, operation := range operations {
+		names[i] = string(operation)
+	}
+	return names
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Registers an admission hook that is called before writes are committed.
+// Hooks are called in the order they were registered.
+func (r *resourceServer) CreateAdmissionHook(config AdmissionHookConfig) error {
+	if config.Name == "" {
+		return fmt.Errorf("an admission hook name is required")
+	}
+	if config.Hook == nil {
+		return fmt.Errorf("admission hook %q does not provide a hook", config.Name)
+	}
+	switch config.FailurePolicy {
+	case "":
+		config.FailurePolicy = FailClosed
+	case FailClosed, FailOpen:
+	default:
+		return fmt.Errorf("admission hook %q has an unknown failure policy %q", config.Name, config.FailurePolicy)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultAdmissionTimeout
+	} else if config.Timeout > maxAdmissionTime {
+		return fmt.Errorf("admission hook %q has a timeout longer than the max of %v", config.Name, maxAdmissionTime)
+	}
+
+	r.admissionHooks = append(r.admissionHooks, config)
+	return nil
+}
+
+// Calls the admission hooks that apply to the write. An InvalidArgument or
+// FailedPrecondition error will be returned when a hook denies the write,
+// and an Unavailable error when a hook that fails closed could not be called.
+// The hooks share the max admission time, so hooks that are called after the
+// time has run out fail without being called.
+func (r *resourceServer) admit(ctx context.Context, operation AdmissionOperation, parent string, oldResource, newResource proto.Message) error {
+	if len(r.admissionHooks) == 0 {
+		return nil
+	}
+
+	req := &AdmissionRequest{
+		Operation:    operation,
+		ResourceType: string(newResource.ProtoReflect().Descriptor().FullName()),
+		Name:         newResource.ProtoReflect().Get(newResource.ProtoReflect().Descriptor().Fields().ByName("name")).String(),
+		Parent:       parent,
+		Principal:    systemPrincipal,
+	}
+	if principal := principalFromContext(ctx); principal != nil {
+		req.Principal = principal.Name
+	}
+
+	var err error
+	if oldResource != nil {
+		if req.OldResource, err = anypb.New(oldResource); err != nil {
+			return err
+		}
+	}
+	if req.NewResource, err = anypb.New(newResource); err != nil {
+		return err
+	}
+
+	admissionCtx, cancel := context.WithTimeout(ctx, maxAdmissionTime)
+	defer cancel()
+
+	for i := range r.admissionHooks {
+		hook := &r.admissionHooks[i]
+		if !hook.appliesTo(req) {
+			continue
+		}
+
+		err := callAdmissionHook(admissionCtx, hook, req)
+		if err == nil {
+			continue
+		}
+
+		if denial, ok := err.(*AdmissionDenial); ok {
+			code := codes.FailedPrecondition
+			if denial.Invalid {
+				code = codes.InvalidArgument
+			}
+			return status.Errorf(code, "admission hook %q denied the request: %s", hook.Name, denial.Message)
+		}
+
+		// The caller's own cancellation is not a failure of the hook
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if hook.FailurePolicy == FailOpen {
+			continue
+		}
+		return status.Errorf(codes.Unavailable, "admission hook %q failed: %v", hook.Name, err)
+	}
+	return nil
+}
+
+// Calls the hook with its timeout. The hook is called in the goroutine of the
+// write, so it is never left running after the write has finished.
+func callAdmissionHook(ctx context.Context, hook *AdmissionHookConfig, req *AdmissionRequest) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("the hook was not called since the admission time ran out: %v", err)
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+
+	err := hook.Hook.Admit(hookCtx, req)
+	if _, denied := err.(*AdmissionDenial); err != nil && !denied && hookCtx.Err() != nil {
+		return fmt.Errorf("the hook did not respond within %v", hook.Timeout)
+	}
+	return err
+}
+
+// The response that remote HTTP admission hooks reply with.
+type httpAdmissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Message string `json:"message"`
+	// Whether the resource is not valid when the write is not allowed.
+	Invalid bool `json:"invalid"`
+}
+
+// An admission hook that sends the admission request to a remote endpoint.
+type httpAdmissionHook struct {
+	url    string
+	client *http.Client
+}
+
+// Creates an admission hook that posts the admission request as JSON to the URL.
+// The resources are included in the request in their JSON format. The endpoint
+// must respond with a 200 status code and a body in the format:
+//
+//	{"allowed": false, "message": "names must start with the team prefix", "invalid": true}
+func NewHTTPAdmissionHook(url string, client *http.Client) AdmissionHook {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpAdmissionHook{url: url, client: client}
+}
+
+func (h *httpAdmissionHook) Admit(ctx context.Context, req *AdmissionRequest) error {
+	body, err := marshalAdmissionRequest(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the hook responded with status %d", resp.StatusCode)
+	}
+
+	admission := &httpAdmissionResponse{}
+	if err := json.Unmarshal(respBody, admission); err != nil {
+		return fmt.Errorf("failed to parse the hook response: %v", err)
+	}
+	if !admission.Allowed {
+		return &AdmissionDenial{Message: admission.Message, Invalid: admission.Invalid}
+	}
+	return nil
+}
+
+// Marshals the admission request into the JSON format that is sent to
+// remote hooks. The resources are marshalled in their proto JSON format.
+func marshalAdmissionRequest(req *AdmissionRequest) ([]byte, error) {
+	body := struct {
+		*AdmissionRequest
+		OldResource json.RawMessage `json:"oldResource,omitempty"`
+		NewResource json.RawMessage `json:"newResource"`
+	}{AdmissionRequest: req}
+
+	var err error
+	if req.OldResource != nil {
+		if body.OldResource, err = protojson.Marshal(req.OldResource); err != nil {
+			return nil, err
+		}
+	}
+	if body.NewResource, err = protojson.Marshal(req.NewResource); err != nil {
+		return nil, err
+	}
+	return json.Marshal(body)
+}
+
+// Loads the remote admission hooks in a JSON file into the API. Hooks are
+// called in the order they are listed in the file.
+//
+// Example:
+//
+//	{
+//	  "hooks": [
+//	    {
+//	      "name": "naming-rules",
+//	      "url": "https://policy.example.com/admit",
+//	      "resourceTypes": ["features.Account"],
+//	      "operations": ["CREATE", "UPDATE"],
+//	      "timeout": "5s",
+//	      "failurePolicy": "FAIL_OPEN"
+//	    }
+//	  ]
+//	}
+func LoadAdmissionHookFile(backend API, file string) error {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read admission hook file: %v", err)
+	}
+
+	var config struct {
+		Hooks []struct {
+			AdmissionHookConfig
+			URL     string `json:"url"`
+			Timeout string `json:"timeout"`
+		} `json:"hooks"`
+	}
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return fmt.Errorf("failed to parse admission hook file: %v", err)
+	}
+
+	for _, hook := range config.Hooks {
+		if hook.URL == "" {
+			return fmt.Errorf("admission hook %q does not provide a url", hook.Name)
+		}
+		if hook.Timeout != "" {
+			if hook.AdmissionHookConfig.Timeout, err = time.ParseDuration(hook.Timeout); err != nil {
+				return fmt.Errorf("admission hook %q has an invalid timeout: %v", hook.Name, err)
+			}
+		}
+
+		hook.Hook = NewHTTPAdmissionHook(hook.URL, nil)
+		if err := backend.CreateAdmissionHook(hook.AdmissionHookConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,9 +9,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/stackpath/control-plane/server/serverpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
@@ -19,63 +23,383 @@ import (
 )
 
 // Creates a new stream interceptor to verify the calling user has access
-// to the requested endpoint. This interceptor will only support one-way
-// outbound streaming endpoints.
-func authStreamInterceptor() grpc.StreamServerInterceptor {
+// to the requested endpoint. The permissions of the endpoint are checked
+// against every message the client sends on the stream. Long-lived streams
+// are terminated when the caller's credentials expire or when the caller no
+// longer has the required permissions, which is checked on every interval.
+func authStreamInterceptor(authenticators []Authenticator, authorizer Authorizer, interval time.Duration) grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		// Check the authorization of the calling user
+		// Determine who the calling user is
+		ctx, err := authenticate(ss.Context(), authenticators)
+		if err != nil {
+			return err
+		}
+
+		// Check that the calling user has access to the requested endpoint
+		methodDesc, err := methodDescriptor(info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(contextWithAuthorizer(ctx, authorizer))
+		defer cancel()
 
-		// Allow the stream connection to pass through
-		return handler(srv, ss)
+		stream := &authorizedStream{
+			ServerStream: ss,
+			ctx:          ctx,
+			cancel:       cancel,
+			authorizer:   authorizer,
+			methodDesc:   methodDesc,
+		}
+		go stream.monitor(interval)
+
+		// The permissions are checked as messages are received on the stream
+		err = handler(srv, stream)
+		if revokedErr := stream.revokedError(); revokedErr != nil {
+			return revokedErr
+		}
+		return err
 	}
 }
 
-func authUnaryInterceptor() grpc.UnaryServerInterceptor {
+// Wraps a server stream so that the stream context contains the authenticated
+// principal and every message received on the stream is authorized.
+type authorizedStream struct {
+	grpc.ServerStream
+	authorizer Authorizer
+	methodDesc protoreflect.MethodDescriptor
+
+	mu sync.Mutex
+	// The context of the stream. The context is replaced once the
+	// additional permissions of the method have been evaluated.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The name of the resource that was last authorized on the stream.
+	resource   string
+	authorized bool
+	// The reason the stream was terminated by the server.
+	revoked error
+}
+
+func (s *authorizedStream) Context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctx
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.revokedError(); err != nil {
+		return err
+	}
+
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	resourceName, err := requestResourceName(m.(proto.Message))
+	if err != nil {
+		return err
+	}
+
+	ctx := s.Context()
+	if err := authorize(ctx, s.authorizer, resourceName, requiredPermissions(s.methodDesc)); err != nil {
+		return err
+	}
+	if err := authorizeFieldWrites(ctx, s.authorizer, resourceName, m.(proto.Message)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Additional permissions are only evaluated for the first message
+	// since the trailer can only be set once for the stream.
+	if !s.authorized {
+		ctx, trailer, err := authorizeAdditional(ctx, s.authorizer, resourceName, additionalPermissions(s.methodDesc))
+		if err != nil {
+			return err
+		}
+		if trailer != nil {
+			s.ServerStream.SetTrailer(trailer)
+		}
+		s.ctx = ctx
+	}
+
+	s.resource = resourceName
+	s.authorized = true
+	return nil
+}
+
+func (s *authorizedStream) SendMsg(m interface{}) error {
+	if err := s.revokedError(); err != nil {
+		return err
+	}
+
+	// Responses can not be sent before the caller has been authorized
+	// for a resource when the endpoint requires permissions.
+	s.mu.Lock()
+	authorized := s.authorized
+	s.mu.Unlock()
+	if !authorized && len(requiredPermissions(s.methodDesc)) > 0 {
+		return status.Error(codes.PermissionDenied, "the stream has not been authorized for a resource")
+	}
+
+	// Remove any fields the caller is not allowed to read
+	if err := redactResponse(s.Context(), s.authorizer, m); err != nil {
+		return err
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
+
+// Returns the error the stream was terminated with by the server.
+func (s *authorizedStream) revokedError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked
+}
+
+// Terminates the stream with the provided error. The context of
+// the stream is cancelled so the handler stops processing.
+func (s *authorizedStream) revoke(err error) {
+	s.mu.Lock()
+	if s.revoked == nil {
+		s.revoked = err
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// Watches for the credentials of the caller to expire and periodically verifies
+// the caller still has the required permissions on the last authorized resource.
+// The stream is revoked when either check fails. Monitoring stops once the
+// stream context is done.
+func (s *authorizedStream) monitor(interval time.Duration) {
+	ctx := s.Context()
+
+	var expired <-chan time.Time
+	if principal := principalFromContext(ctx); principal != nil && !principal.ExpireTime.IsZero() {
+		timer := time.NewTimer(time.Until(principal.ExpireTime))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var reauthorize <-chan time.Time
+	if s.authorizer != nil && interval > 0 && len(requiredPermissions(s.methodDesc)) > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		reauthorize = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-expired:
+			s.revoke(status.Error(codes.Unauthenticated, "the credentials used for the stream have expired"))
+			return
+		case <-reauthorize:
+			s.mu.Lock()
+			resource, authorized := s.resource, s.authorized
+			s.mu.Unlock()
+			if !authorized {
+				continue
+			}
+
+			if err := authorize(ctx, s.authorizer, resource, requiredPermissions(s.methodDesc)); err != nil {
+				if ctx.Err() == nil {
+					s.revoke(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func authUnaryInterceptor(authenticators []Authenticator, authorizer Authorizer) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		// Determine who the calling user is
+		ctx, err = authenticate(ctx, authenticators)
+		if err != nil {
+			return nil, err
+		}
+
 		// Check that the calling user has access to the requested endpoint
-		name := strings.Split(info.FullMethod, "/")
-		descr, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name[1]))
+		methodDesc, err := methodDescriptor(info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		resourceName, err := requestResourceName(req.(proto.Message))
 		if err != nil {
-			return nil, fmt.Errorf("unable to resolve method descriptor for endpoint %v: %v", info.FullMethod, err)
+			return nil, err
 		}
 
-		// Grab the descriptor for the RPC method that's being called
-		methodDesc := descr.(protoreflect.ServiceDescriptor).Methods().ByName(protoreflect.Name(name[2]))
+		// Verify the caller has all of the required permissions on the resource
+		if err := authorize(ctx, authorizer, resourceName, requiredPermissions(methodDesc)); err != nil {
+			return nil, err
+		}
 
-		var requiredPermissions []string
-		// Grab the required permissions for the endpoint
-		if proto.HasExtension(methodDesc.Options(), serverpb.E_RequiredPermissions) {
-			requiredPermissions = proto.GetExtension(methodDesc.Options(), serverpb.E_RequiredPermissions).([]string)
+		// Verify the caller is allowed to write the fields of the resource
+		if err := authorizeFieldWrites(ctx, authorizer, resourceName, req.(proto.Message)); err != nil {
+			return nil, err
 		}
 
-		msg := req.(proto.Message).ProtoReflect()
+		// Verify the caller is allowed to make each of the requests of a batch
+		if err := authorizeBatch(ctx, authorizer, methodDesc, req.(proto.Message)); err != nil {
+			return nil, err
+		}
 
-		var resourceName string
-		// Messages must meet one of the following criteria to be supported by this authorization interceptor:
-		//   * Message MUST define a "parent" field and MAY provide a value
-		//   * Message MUST define a "name" field and MUST provide a value
-		//   * Message MUST define a "resource" field and MUST provide a value
-		if msg.Descriptor().Fields().ByName("name") != nil {
-			resourceName = msg.Get(msg.Descriptor().Fields().ByName("name")).String()
-		} else if msg.Descriptor().Fields().ByJSONName("parent") != nil {
-			resourceName = msg.Get(msg.Descriptor().Fields().ByName("parent")).String()
-		} else if msg.Descriptor().Fields().ByJSONName("resource") != nil {
-			resource, err := msg.Get(msg.Descriptor().Fields().ByName("resource")).Message().Interface().(*anypb.Any).UnmarshalNew()
-			if err != nil {
+		// Let the handler know which of the additional permissions were granted
+		ctx, trailer, err := authorizeAdditional(ctx, authorizer, resourceName, additionalPermissions(methodDesc))
+		if err != nil {
+			return nil, err
+		}
+		if trailer != nil {
+			if err := grpc.SetTrailer(ctx, trailer); err != nil {
 				return nil, err
 			}
+		}
+
+		resp, err = handler(contextWithAuthorizer(ctx, authorizer), req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Remove any fields the caller is not allowed to read
+		if err := redactResponse(ctx, authorizer, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// Finds the descriptor of the RPC method for the fully qualified method name
+// that is provided by gRPC in the format `/package.Service/Method`.
+func methodDescriptor(fullMethod string) (protoreflect.MethodDescriptor, error) {
+	name := strings.Split(fullMethod, "/")
+	if len(name) != 3 {
+		return nil, fmt.Errorf("invalid method name %v", fullMethod)
+	}
+
+	descr, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name[1]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve method descriptor for endpoint %v: %v", fullMethod, err)
+	}
+
+	// Grab the descriptor for the RPC method that's being called
+	methodDesc := descr.(protoreflect.ServiceDescriptor).Methods().ByName(protoreflect.Name(name[2]))
+	if methodDesc == nil {
+		return nil, fmt.Errorf("unable to resolve method descriptor for endpoint %v", fullMethod)
+	}
+	return methodDesc, nil
+}
+
+// Authorizes each of the requests of a batch with the permissions of the RPC
+// method the request is made with, which is the method of the same service
+// that accepts the request as its input. The requests are either listed in a
+// `requests` field, or in an `operations` field where the request is the
+// populated member of the oneof of each operation. Requests that have neither
+// of the fields are not batches and are ignored.
+func authorizeBatch(ctx context.Context, authorizer Authorizer, methodDesc protoreflect.MethodDescriptor, req proto.Message) error {
+	requests := batchRequests(req)
+	if len(requests) == 0 {
+		return nil
+	}
+
+	methods := methodDesc.Parent().(protoreflect.ServiceDescriptor).Methods()
+	for _, request := range requests {
+		var requestMethod protoreflect.MethodDescriptor
+		for i := 0; i < methods.Len(); i++ {
+			if methods.Get(i).Input().FullName() == request.ProtoReflect().Descriptor().FullName() {
+				requestMethod = methods.Get(i)
+			}
+		}
+		if requestMethod == nil {
+			return fmt.Errorf("unable to resolve the method the requests of %v are made with", methodDesc.FullName())
+		}
 
-			resourceName = resource.ProtoReflect().Get(resource.ProtoReflect().Descriptor().Fields().ByJSONName("name")).String()
+		resourceName, err := requestResourceName(request)
+		if err != nil {
+			return err
 		}
+		if err := authorize(ctx, authorizer, resourceName, requiredPermissions(requestMethod)); err != nil {
+			return err
+		}
+		if err := authorizeFieldWrites(ctx, authorizer, resourceName, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// TODO: Remove. Fake using the variable.
-		_ = resourceName
+// Returns the requests that are made in a batch request.
+func batchRequests(req proto.Message) []proto.Message {
+	fields := req.ProtoReflect().Descriptor().Fields()
+
+	var requests []proto.Message
+	if field := fields.ByName("requests"); field != nil && field.IsList() && field.Message() != nil {
+		list := req.ProtoReflect().Get(field).List()
+		for i := 0; i < list.Len(); i++ {
+			requests = append(requests, list.Get(i).Message().Interface())
+		}
+	}
 
-		if len(requiredPermissions) > 0 {
-			// TODO: Add authorization checks
-			fmt.Printf("Checking that user has %q permission on resource %q\n", requiredPermissions[0], resourceName)
+	if field := fields.ByName("operations"); field != nil && field.IsList() && field.Message() != nil {
+		list := req.ProtoReflect().Get(field).List()
+		for i := 0; i < list.Len(); i++ {
+			operation := list.Get(i).Message()
+			oneofs := operation.Descriptor().Oneofs()
+			for j := 0; j < oneofs.Len(); j++ {
+				if member := operation.WhichOneof(oneofs.Get(j)); member != nil && member.Message() != nil {
+					requests = append(requests, operation.Get(member).Message().Interface())
+				}
+			}
+		}
+	}
+	return requests
+}
+
+// Returns the permissions that are required to call the RPC method.
+func requiredPermissions(methodDesc protoreflect.MethodDescriptor) []string {
+	if !proto.HasExtension(methodDesc.Options(), serverpb.E_RequiredPermissions) {
+		return nil
+	}
+	return proto.GetExtension(methodDesc.Options(), serverpb.E_RequiredPermissions).([]string)
+}
+
+// Returns the permissions that should be checked when the RPC method is called,
+// but that do not prevent the method from being called.
+func additionalPermissions(methodDesc protoreflect.MethodDescriptor) []string {
+	if !proto.HasExtension(methodDesc.Options(), serverpb.E_AdditionalPermissions) {
+		return nil
+	}
+	return proto.GetExtension(methodDesc.Options(), serverpb.E_AdditionalPermissions).([]string)
+}
+
+// Returns the name of the resource that a request message is for.
+func requestResourceName(req proto.Message) (string, error) {
+	msg := req.ProtoReflect()
+
+	// Messages must meet one of the following criteria to be supported by this authorization interceptor:
+	//   * Message MUST define a "parent" field and MAY provide a value
+	//   * Message MUST define a "name" field and MUST provide a value
+	//   * Message MUST define a "resource" field and MUST provide a value. The field
+	//     may either be the name of the resource or the resource itself.
+	if msg.Descriptor().Fields().ByName("name") != nil {
+		return msg.Get(msg.Descriptor().Fields().ByName("name")).String(), nil
+	} else if msg.Descriptor().Fields().ByJSONName("parent") != nil {
+		return msg.Get(msg.Descriptor().Fields().ByName("parent")).String(), nil
+	} else if field := msg.Descriptor().Fields().ByName("resource"); field != nil && field.Kind() == protoreflect.StringKind {
+		// IAM requests reference the resource by name
+		return msg.Get(field).String(), nil
+	} else if msg.Descriptor().Fields().ByJSONName("resource") != nil {
+		resource, err := msg.Get(msg.Descriptor().Fields().ByName("resource")).Message().Interface().(*anypb.Any).UnmarshalNew()
+		if err != nil {
+			return "", err
 		}
 
-		return handler(ctx, req)
+		return resource.ProtoReflect().Get(resource.ProtoReflect().Descriptor().Fields().ByJSONName("name")).String(), nil
 	}
+	return "", nil
 }
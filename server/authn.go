@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The principal that is used for callers when no authenticators
+// have been configured on the server.
+const allUsersPrincipal = "allUsers"
+
+// Returned by an Authenticator when the request does not contain the
+// credentials the authenticator handles. Other authenticators will be
+// tried when this error is returned.
+var errNoCredentials = errors.New("no credentials provided")
+
+// Principal is the identity of a caller that has been authenticated.
+type Principal struct {
+	// The name of the principal in the format used for IAM members.
+	//
+	// Example: user:joe@example.com
+	Name string
+
+	// The time the credentials used to authenticate the principal expire.
+	// A zero value indicates the credentials do not expire.
+	ExpireTime time.Time
+}
+
+// Authenticator determines the principal that is calling the server.
+type Authenticator interface {
+	// Returns the principal for the credentials in the request. An
+	// errNoCredentials error should be returned when the request does
+	// not contain credentials the authenticator supports.
+	Authenticate(ctx context.Context) (*Principal, error)
+}
+
+type principalContextKey struct{}
+
+// Returns the principal that was authenticated for the request.
+func principalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// Authenticates the caller using the provided authenticators and returns a
+// context containing the principal. The first authenticator that succeeds
+// will be used. An Unauthenticated error will be returned when none of the
+// authenticators succeed. All callers are treated as allUsers when no
+// authenticators are provided.
+func authenticate(ctx context.Context, authenticators []Authenticator) (context.Context, error) {
+	if len(authenticators) == 0 {
+		return context.WithValue(ctx, principalContextKey{}, &Principal{Name: allUsersPrincipal}), nil
+	}
+
+	var failures []string
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(ctx)
+		if err == errNoCredentials {
+			continue
+		} else if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		return context.WithValue(ctx, principalContextKey{}, principal), nil
+	}
+
+	if len(failures) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no credentials were provided")
+	}
+	return nil, status.Errorf(codes.Unauthenticated, "invalid credentials: %s", strings.Join(failures, "; "))
+}
+
+// Returns the bearer token from the authorization metadata of the request.
+func bearerToken(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", errNoCredentials
+	}
+
+	for _, value := range md.Get("authorization") {
+		parts := strings.SplitN(value, " ", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", errNoCredentials
+}
+
+// Authenticates callers using a static set of bearer tokens.
+type staticTokenAuthenticator struct {
+	// A mapping of bearer tokens to the principal they belong to
+	tokens map[string]string
+}
+
+// Creates an authenticator for the static bearer tokens in the provided file.
+// The file must be a CSV file where each line is in the format `token,principal`.
+func NewStaticTokenAuthenticator(file string) (Authenticator, error) {
+	mapping, err := readMappingFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+	return &staticTokenAuthenticator{tokens: mapping}, nil
+}
+
+func (a *staticTokenAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for knownToken, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(knownToken), []byte(token)) == 1 {
+			return &Principal{Name: principal}, nil
+		}
+	}
+
+	// The token may be handled by another authenticator, such as a JWT.
+	return nil, errNoCredentials
+}
+
+// Authenticates callers using the verified client certificate of the
+// TLS connection.
+type certificateAuthenticator struct {
+	// A mapping of certificate subjects to the principal they belong to
+	subjects map[string]string
+}
+
+// Creates an authenticator that maps the subject of verified client certificates
+// to a principal. The file must be a CSV file where each line is in the format
+// `subject,principal`, where subject is the quoted distinguished name of the
+// certificate such as `"CN=joe,O=StackPath"`. When no file is provided, the
+// common name of the certificate will be used as a user principal.
+func NewCertificateAuthenticator(file string) (Authenticator, error) {
+	if file == "" {
+		return &certificateAuthenticator{}, nil
+	}
+
+	mapping, err := readMappingFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate subject file: %v", err)
+	}
+	return &certificateAuthenticator{subjects: mapping}, nil
+}
+
+func (a *certificateAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	cert := clientCertificate(ctx)
+	if cert == nil {
+		return nil, errNoCredentials
+	}
+
+	principal := &Principal{ExpireTime: cert.NotAfter}
+	if a.subjects == nil {
+		if cert.Subject.CommonName == "" {
+			return nil, fmt.Errorf("client certificate does not have a common name")
+		}
+		principal.Name = "user:" + cert.Subject.CommonName
+		return principal, nil
+	}
+
+	name, ok := a.subjects[cert.Subject.String()]
+	if !ok {
+		return nil, fmt.Errorf("client certificate subject %q is not mapped to a principal", cert.Subject.String())
+	}
+	principal.Name = name
+	return principal, nil
+}
+
+// Reads a two column CSV file into a map that is keyed by the first column.
+func readMappingFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 2
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	mapping := make(map[string]string)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		mapping[record[0]] = strings.TrimSpace(record[1])
+	}
+	return mapping, nil
+}
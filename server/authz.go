@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The member that matches any principal that has been authenticated.
+const allAuthenticatedUsersMember = "allAuthenticatedUsers"
+
+// The domain used in the ErrorInfo details of authorization errors.
+const errorDomain = "stackpathapis.com"
+
+// The trailer that contains the additional permissions the caller was granted.
+const grantedPermissionsTrailer = "x-granted-permissions"
+
+// Authorizer determines the permissions a principal has been granted on a resource.
+type Authorizer interface {
+	// Returns the subset of the provided permissions that the principal has
+	// been granted on the resource. Permissions granted on any of the resource's
+	// ancestors are also granted on the resource.
+	TestPermissions(ctx context.Context, principal *Principal, resource string, permissions []string) ([]string, error)
+}
+
+// RoleBinding grants the permissions of a role to a set of members
+// on a resource and all of its descendants.
+type RoleBinding struct {
+	// The resource name the binding applies to. An empty resource
+	// name will apply the binding to all resources.
+	Resource string `json:"resource"`
+
+	// The name of the role that is granted.
+	//
+	// Example: roles/resourcemanager.admin
+	Role string `json:"role"`
+
+	// The principals that are granted the role. The special members allUsers
+	// and allAuthenticatedUsers can be used to grant the role to everyone.
+	Members []string `json:"members"`
+}
+
+// Returns the roles that are available on every server, so IAM policies can be
+// set and enforced without loading a policy file. Roles with the same name in a
+// policy file replace the predefined roles.
+func predefinedRoles() map[string][]string {
+	viewer := []string{
+		"resourcemanager.resources.get",
+		"resourcemanager.resources.list",
+		"resourcemanager.resources.watch",
+		"resourcemanager.resources.listDependents",
+		"resourcemanager.resources.getIamPolicy",
+	}
+	editor := append([]string{
+		"resourcemanager.resources.create",
+		"resourcemanager.resources.update",
+		"resourcemanager.resources.delete",
+		"resourcemanager.resources.undelete",
+		"resourcemanager.resources.removeFinalizer",
+	}, viewer...)
+
+	return map[string][]string{
+		"roles/resourcemanager.viewer": viewer,
+		"roles/resourcemanager.editor": editor,
+		"roles/resourcemanager.admin":  {"resourcemanager.*"},
+	}
+}
+
+// Loads the roles and role bindings in a JSON policy file into the API. The role
+// bindings in the file are kept in memory and are applied in addition to any
+// IAM policies that have been set through the API.
+//
+// Example:
+//
+//	{
+//	  "roles": {
+//	    "roles/resourcemanager.viewer": ["resourcemanager.resources.get", "resourcemanager.resources.list"],
+//	    "roles/resourcemanager.admin": ["resourcemanager.resources.*"]
+//	  },
+//	  "bindings": [
+//	    {"resource": "accounts/default", "role": "roles/resourcemanager.viewer", "members": ["user:joe"]}
+//	  ]
+//	}
+func LoadPolicyFile(backend API, file string) error {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	var policy struct {
+		Roles    map[string][]string `json:"roles"`
+		Bindings []RoleBinding       `json:"bindings"`
+	}
+	if err := json.Unmarshal(contents, &policy); err != nil {
+		return fmt.Errorf("failed to parse policy file: %v", err)
+	}
+
+	for role, permissions := range policy.Roles {
+		if err := backend.CreateRole(role, permissions); err != nil {
+			return err
+		}
+	}
+	for _, binding := range policy.Bindings {
+		if err := backend.CreateRoleBinding(binding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registers a role that bundles a set of permissions. Permissions ending in
+// a wildcard, such as `resourcemanager.resources.*`, will grant all of the
+// permissions that start with the prefix before the wildcard.
+func (r *resourceServer) CreateRole(name string, permissions []string) error {
+	if name == "" {
+		return fmt.Errorf("a role name is required")
+	}
+	r.roles[name] = permissions
+	return nil
+}
+
+// Adds a role binding that is kept in memory and applied in addition
+// to the IAM policies that are stored for resources.
+func (r *resourceServer) CreateRoleBinding(binding RoleBinding) error {
+	if _, ok := r.roles[binding.Role]; !ok {
+		return fmt.Errorf("role binding on resource %q references unknown role %q", binding.Resource, binding.Role)
+	}
+	r.bindings[binding.Resource] = append(r.bindings[binding.Resource], binding)
+	return nil
+}
+
+// Returns the permissions the principal has been granted on the resource through
+// the role bindings that were created on the server and the IAM policies that are
+// stored for the resource and its ancestors.
+func (r *resourceServer) TestPermissions(ctx context.Context, principal *Principal, resource string, permissions []string) ([]string, error) {
+	ancestors := resourceAncestors(resource)
+	policies, err := r.getIamPolicies(ctx, r.database, ancestors)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []string
+	for _, name := range ancestors {
+		for _, binding := range r.bindings[name] {
+			if bindingHasMember(binding.Members, principal) {
+				roles = append(roles, binding.Role)
+			}
+		}
+		for _, binding := range policies[name].GetBindings() {
+			if bindingHasMember(binding.Members, principal) {
+				roles = append(roles, binding.Role)
+			}
+		}
+	}
+
+	var allowed []string
+	for _, permission := range permissions {
+		for _, role := range roles {
+			if roleHasPermission(r.roles[role], permission) {
+				allowed = append(allowed, permission)
+				break
+			}
+		}
+	}
+	return allowed, nil
+}
+
+// Checks if the permissions of a role include the provided permission.
+func roleHasPermission(rolePermissions []string, permission string) bool {
+	for _, rolePermission := range rolePermissions {
+		if rolePermission == permission {
+			return true
+		}
+		if strings.HasSuffix(rolePermission, "*") && strings.HasPrefix(permission, strings.TrimSuffix(rolePermission, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the principal is one of the members of a binding.
+func bindingHasMember(members []string, principal *Principal) bool {
+	for _, member := range members {
+		switch member {
+		case principal.Name, allUsersPrincipal:
+			return true
+		case allAuthenticatedUsersMember:
+			if principal.Name != allUsersPrincipal {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the resource name and the names of all of its ancestors, starting
+// with the resource itself. Resource names alternate between a collection and
+// an ID so each ancestor is found by removing the last two segments of the
+// name. Names that end in a collection, such as the parent of a list, are
+// followed by the resource that contains the collection. The last entry is
+// always the empty root resource name.
+//
+// Example: accounts/a/keys/b => [accounts/a/keys/b, accounts/a, ""]
+// Example: accounts/a/keys => [accounts/a/keys, accounts/a, ""]
+func resourceAncestors(resource string) []string {
+	names := []string{}
+	segments := strings.Split(strings.Trim(resource, "/"), "/")
+	if len(segments)%2 == 1 && segments[0] != "" {
+		names = append(names, strings.Join(segments, "/"))
+		segments = segments[:len(segments)-1]
+	}
+	for len(segments) >= 2 {
+		names = append(names, strings.Join(segments, "/"))
+		segments = segments[:len(segments)-2]
+	}
+	return append(names, "")
+}
+
+// Verifies the principal has all of the provided permissions on the resource.
+// A PermissionDenied error containing the missing permissions will be returned
+// when the principal is missing any of the permissions.
+func authorize(ctx context.Context, authorizer Authorizer, resource string, permissions []string) error {
+	if authorizer == nil || len(permissions) == 0 {
+		return nil
+	}
+
+	principal := principalFromContext(ctx)
+	allowed, err := authorizer.TestPermissions(ctx, principal, resource, permissions)
+	if err != nil {
+		return err
+	}
+
+	missing := missingPermissions(permissions, allowed)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	errStatus := status.Newf(
+		codes.PermissionDenied,
+		"permission %q denied on resource %q",
+		missing[0],
+		resource,
+	)
+	errStatus, _ = errStatus.WithDetails(&errdetails.ErrorInfo{
+		Reason: "IAM_PERMISSION_DENIED",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"resource":    resource,
+			"permissions": strings.Join(missing, ","),
+		},
+	})
+	return errStatus.Err()
+}
+
+// Returns the permissions that are not included in the allowed permissions.
+func missingPermissions(permissions, allowed []string) []string {
+	granted := make(map[string]bool, len(allowed))
+	for _, permission := range allowed {
+		granted[permission] = true
+	}
+
+	var missing []string
+	for _, permission := range permissions {
+		if !granted[permission] {
+			missing = append(missing, permission)
+		}
+	}
+	return missing
+}
+
+type authorizerContextKey struct{}
+
+// Returns a context that lets the handlers of RPC methods authorize the caller
+// for resources other than the resource of the request.
+func contextWithAuthorizer(ctx context.Context, authorizer Authorizer) context.Context {
+	if authorizer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, authorizerContextKey{}, authorizer)
+}
+
+// Returns the authorizer of the server the RPC method was called on. Nil will
+// be returned when no authorizer is provided.
+func authorizerFromContext(ctx context.Context) Authorizer {
+	authorizer, _ := ctx.Value(authorizerContextKey{}).(Authorizer)
+	return authorizer
+}
+
+// Returns the subset of the permissions the caller has been granted on a resource
+// that is not the resource of the request, such as the resources that are included
+// in a response. All of the permissions are granted when no authorizer is provided.
+func callerPermissions(ctx context.Context, resource string, permissions []string) ([]string, error) {
+	authorizer := authorizerFromContext(ctx)
+	if authorizer == nil {
+		return permissions, nil
+	}
+	return authorizer.TestPermissions(ctx, principalFromContext(ctx), resource, permissions)
+}
+
+type grantedPermissionsContextKey struct{}
+
+// Evaluates the additional permissions of an RPC method for the calling principal.
+// Unlike required permissions, the caller is not denied access when they are missing
+// any of the permissions. A context containing the granted permissions is returned
+// along with the metadata that should be sent to the caller in the response trailer.
+// All of the permissions are granted when no authorizer is provided.
+func authorizeAdditional(ctx context.Context, authorizer Authorizer, resource string, permissions []string) (context.Context, metadata.MD, error) {
+	if len(permissions) == 0 {
+		return ctx, nil, nil
+	}
+
+	granted := permissions
+	if authorizer != nil {
+		var err error
+		granted, err = authorizer.TestPermissions(ctx, principalFromContext(ctx), resource, permissions)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	grantedSet := make(map[string]bool, len(granted))
+	for _, permission := range granted {
+		grantedSet[permission] = true
+	}
+
+	ctx = context.WithValue(ctx, grantedPermissionsContextKey{}, grantedSet)
+	return ctx, metadata.Pairs(grantedPermissionsTrailer, strings.Join(granted, ",")), nil
+}
+
+// Checks if the caller was granted one of the additional permissions of the RPC
+// method. False will be returned for permissions that are not listed in the
+// additional permissions of the method.
+func hasAdditionalPermission(ctx context.Context, permission string) bool {
+	granted, _ := ctx.Value(grantedPermissionsContextKey{}).(map[string]bool)
+	return granted[permission]
+}
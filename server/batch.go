@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// The max number of requests that can be made in a batch.
+const maxBatchSize = 100
+
+// Makes the request of a batch at the index in the transaction of the batch.
+type batchRequestFunc func(ctx context.Context, tx *writeTx, i int) (*anypb.Any, error)
+
+// The results of the requests of a batch in the order of the requests.
+type batchResults struct {
+	resources []*anypb.Any
+	statuses  []*spb.Status
+}
+
+// Makes the requests of a batch in a single transaction. The transaction is
+// rolled back when any of the requests fail, unless partial success is
+// allowed. Only the writes of the failed request are rolled back in that case
+// and the status of each request is returned. Watchers are notified once the
+// transaction has been committed.
+func (r *resourceServer) runBatch(ctx context.Context, count int, allowPartialSuccess, readOnly bool, request batchRequestFunc) (*batchResults, error) {
+	if err := validateBatchSize("requests", count); err != nil {
+		return nil, err
+	}
+
+	tx, err := r.beginWrite(ctx, &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := &batchResults{resources: make([]*anypb.Any, count)}
+	for i := 0; i < count; i++ {
+		if !allowPartialSuccess {
+			resource, err := request(ctx, tx, i)
+			if err != nil {
+				return nil, batchRequestError("requests", i, err)
+			}
+			results.resources[i] = resource
+			continue
+		}
+
+		// Mark the start of the request so its writes can be rolled back
+		// without rolling back the requests that succeeded.
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_request"); err != nil {
+			return nil, err
+		}
+		savepoint := tx.savepoint()
+		resource, err := request(ctx, tx, i)
+		if err != nil {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_request"); err != nil {
+				return nil, err
+			}
+			tx.rollbackTo(savepoint)
+			// Failed requests are left empty so the resources stay in
+			// the order of the requests.
+			results.resources[i] = &anypb.Any{}
+			results.statuses = append(results.statuses, status.Convert(err).Proto())
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_request"); err != nil {
+			return nil, err
+		}
+		results.resources[i] = resource
+		results.statuses = append(results.statuses, status.New(codes.OK, "").Proto())
+	}
+
+	if err := r.commitWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Returns an InvalidArgument error when the list field of a batch has more
+// than the max number of requests.
+func validateBatchSize(field string, count int) error {
+	if count <= maxBatchSize {
+		return nil
+	}
+	errStatus, _ := status.New(codes.InvalidArgument, "too many requests").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{
+				Field:       field,
+				Description: fmt.Sprintf("A batch can contain at most %d requests", maxBatchSize),
+			},
+		},
+	})
+	return errStatus.Err()
+}
+
+// Returns the error of the failed request of a batch with the index of the
+// request in the list field. The details of the error are kept as they are.
+func batchRequestError(field string, i int, err error) error {
+	errStatus := status.Convert(err).Proto()
+	errStatus.Message = fmt.Sprintf("%s[%d]: %s", field, i, errStatus.Message)
+	return status.ErrorProto(errStatus)
+}
+
+func (r *resourceServer) BatchCreateResources(ctx context.Context, req *serverpb.BatchCreateResourcesRequest) (*serverpb.BatchCreateResourcesResponse, error) {
+	results, err := r.runBatch(ctx, len(req.Requests), req.AllowPartialSuccess, false, func(ctx context.Context, tx *writeTx, i int) (*anypb.Any, error) {
+		return r.createResourceInTx(ctx, tx, req.Requests[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.BatchCreateResourcesResponse{Resources: results.resources, Statuses: results.statuses}, nil
+}
+
+func (r *resourceServer) BatchGetResources(ctx context.Context, req *serverpb.BatchGetResourcesRequest) (*serverpb.BatchGetResourcesResponse, error) {
+	results, err := r.runBatch(ctx, len(req.Requests), req.AllowPartialSuccess, true, func(ctx context.Context, tx *writeTx, i int) (*anypb.Any, error) {
+		return r.getResource(ctx, tx, req.Requests[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.BatchGetResourcesResponse{Resources: results.resources, Statuses: results.statuses}, nil
+}
+
+func (r *resourceServer) BatchUpdateResources(ctx context.Context, req *serverpb.BatchUpdateResourcesRequest) (*serverpb.BatchUpdateResourcesResponse, error) {
+	results, err := r.runBatch(ctx, len(req.Requests), req.AllowPartialSuccess, false, func(ctx context.Context, tx *writeTx, i int) (*anypb.Any, error) {
+		name, err := resourceName(req.Requests[i].Resource)
+		if err != nil {
+			return nil, err
+		}
+		return r.updateResourceInTx(ctx, tx, name, req.Requests[i].Resource.TypeUrl, AdmissionUpdate, updateMaskUpdater(req.Requests[i]), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.BatchUpdateResourcesResponse{Resources: results.resources, Statuses: results.statuses}, nil
+}
+
+func (r *resourceServer) BatchDeleteResources(ctx context.Context, req *serverpb.BatchDeleteResourcesRequest) (*serverpb.BatchDeleteResourcesResponse, error) {
+	results, err := r.runBatch(ctx, len(req.Requests), req.AllowPartialSuccess, false, func(ctx context.Context, tx *writeTx, i int) (*anypb.Any, error) {
+		return r.updateResourceInTx(ctx, tx, req.Requests[i].Name, req.Requests[i].ResourceType, AdmissionDelete, markDeleted, r.deleteHook(req.Requests[i]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.BatchDeleteResourcesResponse{Resources: results.resources, Statuses: results.statuses}, nil
+}
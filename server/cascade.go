@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Sets the deletion timestamp of the resource to soft-delete it.
+func markDeleted(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
+	existing.ProtoReflect().Set(
+		// Assume that the resource has a delete_time field defined.
+		existing.ProtoReflect().Descriptor().Fields().ByName("delete_time"),
+		// Set to the current timestamp.
+		protoreflect.ValueOfMessage(timestamppb.Now().ProtoReflect()),
+	)
+	return existing, nil
+}
+
+// Clears the deletion timestamp of the resource to undelete it.
+func markUndeleted(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
+	existing.ProtoReflect().Clear(existing.ProtoReflect().Descriptor().Fields().ByName("delete_time"))
+	return existing, nil
+}
+
+// Returns the names of the resources of the type with the provided parent.
+func childNames(ctx context.Context, tx *sql.Tx, childType protoreflect.MessageDescriptor, parent string, liveOnly bool) ([]string, error) {
+	query := fmt.Sprintf("SELECT name FROM %s WHERE parent = $1", getResourceTableName(childType))
+	if liveOnly {
+		query += " AND delete_time IS NULL"
+	}
+
+	res, err := tx.QueryContext(ctx, query+" ORDER BY name", parent)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var names []string
+	for res.Next() {
+		var name string
+		if err := res.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, res.Err()
+}
+
+// Soft-deletes the live descendants of the resource in the transaction. The
+// descendants are recorded as deleted by the root resource so only they are
+// restored when the root resource is undeleted. Descendants that were already
+// deleted are left as they are. Progress is reported as each child of the root
+// resource is deleted along with its own descendants.
+func (r *resourceServer) cascadeDelete(ctx context.Context, tx *writeTx, resource protoreflect.MessageDescriptor, name string, root protoreflect.MessageDescriptor, rootName string, depth int) error {
+	type child struct {
+		resourceType protoreflect.MessageDescriptor
+		name         string
+	}
+	var children []child
+	for _, childType := range r.childTypes(resource) {
+		names, err := childNames(ctx, tx.Tx, childType, name, true)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			children = append(children, child{resourceType: childType, name: name})
+		}
+	}
+
+	for i, c := range children {
+		childType, child := c.resourceType, c.name
+		if _, err := r.updateResourceInTx(ctx, tx, child, string(childType.FullName()), AdmissionDelete, markDeleted, func(ctx context.Context, tx *writeTx, parent string, updated protoreflect.ProtoMessage) error {
+			if _, err := tx.ExecContext(
+				ctx,
+				`INSERT INTO resource_cascade (resource_type, name, root_type, root_name, depth) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (resource_type, name) DO UPDATE SET root_type = excluded.root_type, root_name = excluded.root_name, depth = excluded.depth`,
+				string(childType.FullName()),
+				child,
+				string(root.FullName()),
+				rootName,
+				depth,
+			); err != nil {
+				return err
+			}
+			return r.cascadeDelete(ctx, tx, childType, child, root, rootName, depth+1)
+		}); err != nil {
+			return err
+		}
+
+		if depth == 1 {
+			reportProgress(ctx, i+1, len(children))
+		}
+	}
+	return nil
+}
+
+// Restores the descendants that were deleted along with the resource that is
+// being undeleted. Descendants are restored parents first so each of them is
+// undeleted under a live parent.
+func (r *resourceServer) restoreCascade(ctx context.Context, tx *writeTx, parent string, updated protoreflect.ProtoMessage) error {
+	resource := updated.ProtoReflect().Descriptor()
+	name := updated.ProtoReflect().Get(resource.Fields().ByName("name")).String()
+
+	// Resources can only be undeleted while their parent is live.
+	if err := r.verifyParent(ctx, tx.Tx, resource, parent); err != nil {
+		return err
+	}
+
+	res, err := tx.QueryContext(
+		ctx,
+		"SELECT resource_type, name FROM resource_cascade WHERE root_type = $1 AND root_name = $2 ORDER BY depth, name",
+		string(resource.FullName()),
+		name,
+	)
+	if err != nil {
+		return err
+	}
+	var descendants [][2]string
+	for res.Next() {
+		var descendant [2]string
+		if err := res.Scan(&descendant[0], &descendant[1]); err != nil {
+			res.Close()
+			return err
+		}
+		descendants = append(descendants, descendant)
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return err
+	}
+
+	// Neither the resource nor its descendants are deleted by a cascade anymore.
+	if err := deleteCascades(ctx, tx.Tx, resource, name); err != nil {
+		return err
+	}
+
+	for _, descendant := range descendants {
+		if _, err := r.updateResourceInTx(ctx, tx, descendant[1], descendant[0], AdmissionUndelete, markUndeleted, func(ctx context.Context, tx *writeTx, parent string, updated protoreflect.ProtoMessage) error {
+			return r.verifyParent(ctx, tx.Tx, updated.ProtoReflect().Descriptor(), parent)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the record of the resource being deleted by a cascade, and the
+// records of the descendants that were deleted along with the resource.
+func deleteCascades(ctx context.Context, tx *sql.Tx, resource protoreflect.MessageDescriptor, name string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM resource_cascade WHERE (resource_type = $1 AND name = $2) OR (root_type = $1 AND root_name = $2)",
+		string(resource.FullName()),
+		name,
+	)
+	return err
+}
+
+// Purges all of the children of the resource, including the children that
+// have not been deleted, along with their own descendants.
+func (r *resourceServer) purgeChildren(ctx context.Context, tx *writeTx, resource protoreflect.MessageDescriptor, name string) error {
+	for _, childType := range r.childTypes(resource) {
+		children, err := childNames(ctx, tx.Tx, childType, name, false)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := r.purgeResourceInTx(ctx, tx, childType, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
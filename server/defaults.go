@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Defaulter sets the default values of a resource before it is validated
+// and stored. Defaulters can modify the provided resource in place.
+type Defaulter interface {
+	// Sets the defaults on the resource. The existing resource is
+	// nil when the resource is being created.
+	Default(ctx context.Context, existing, resource proto.Message) error
+}
+
+// DefaulterFunc allows a function to be used as a Defaulter.
+type DefaulterFunc func(ctx context.Context, existing, resource proto.Message) error
+
+func (f DefaulterFunc) Default(ctx context.Context, existing, resource proto.Message) error {
+	return f(ctx, existing, resource)
+}
+
+// Registers a defaulter for a resource type. Defaulters are called in the
+// order they were registered, after the defaults declared in the schema of
+// the resource have been applied.
+func (r *resourceServer) CreateDefaulter(resourceType string, defaulter Defaulter) error {
+	if _, err := r.GetResourceDescriptor(resourceType); err != nil {
+		return fmt.Errorf("defaulter registered for unknown resource type %q", resourceType)
+	}
+	r.defaulters[resourceType] = append(r.defaulters[resourceType], defaulter)
+	return nil
+}
+
+// Applies the declared field defaults and the registered defaulters to the
+// resource. The existing resource should be nil when the resource is being
+// created.
+func (r *resourceServer) applyDefaults(ctx context.Context, existing, resource proto.Message) error {
+	var existingReflector protoreflect.Message
+	if existing != nil {
+		existingReflector = existing.ProtoReflect()
+	}
+	if err := applyFieldDefaults(resource.ProtoReflect(), existingReflector); err != nil {
+		return err
+	}
+
+	for _, defaulter := range r.defaulters[string(resource.ProtoReflect().Descriptor().FullName())] {
+		if err := defaulter.Default(ctx, existing, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the default value that is declared on a field. An empty
+// string will be returned when the field does not declare a default.
+func getFieldDefault(field protoreflect.FieldDescriptor) string {
+	if !proto.HasExtension(field.Options(), serverpb.E_DefaultValue) {
+		return ""
+	}
+	return proto.GetExtension(field.Options(), serverpb.E_DefaultValue).(string)
+}
+
+// Sets the declared defaults on the fields that are not populated on either
+// the message or the existing message. The defaults of nested messages are
+// applied when the nested message is populated.
+func applyFieldDefaults(msg, existing protoreflect.Message) error {
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		if value := getFieldDefault(field); value != "" && !msg.Has(field) && (existing == nil || !existing.Has(field)) {
+			if err := setFieldDefault(msg, field, value); err != nil {
+				return fmt.Errorf("invalid default value for field %s: %v", field.FullName(), err)
+			}
+		}
+
+		if field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() || !msg.Has(field) {
+			continue
+		}
+
+		var nestedExisting protoreflect.Message
+		if existing != nil && existing.Has(field) {
+			nestedExisting = existing.Get(field).Message()
+		}
+		if err := applyFieldDefaults(msg.Mutable(field).Message(), nestedExisting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses the JSON default value of the field and sets it on the message.
+func setFieldDefault(msg protoreflect.Message, field protoreflect.FieldDescriptor, value string) error {
+	// Parse the value as part of a message so the JSON format of
+	// every kind of field is supported.
+	holder := msg.New()
+	if err := protojson.Unmarshal([]byte(fmt.Sprintf("{%q: %s}", field.JSONName(), value)), holder.Interface()); err != nil {
+		return err
+	}
+	msg.Set(field, holder.Get(field))
+	return nil
+}
+
+// Verifies the default values declared on the fields of the message, and the
+// fields of any nested messages, can be parsed.
+func validateFieldDefaults(msg protoreflect.Message, visited map[protoreflect.FullName]bool) error {
+	if visited[msg.Descriptor().FullName()] {
+		return nil
+	}
+	visited[msg.Descriptor().FullName()] = true
+
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if value := getFieldDefault(field); value != "" {
+			if err := setFieldDefault(msg.New(), field, value); err != nil {
+				return fmt.Errorf("invalid default value for field %s: %v", field.FullName(), err)
+			}
+		}
+
+		if field.Kind() == protoreflect.MessageKind && !field.IsList() && !field.IsMap() {
+			if err := validateFieldDefaults(msg.NewField(field).Message(), visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Returns the permissions declared on a field. Nil will be returned
+// when the field does not declare any permissions.
+func getFieldPermissions(field protoreflect.FieldDescriptor) *serverpb.FieldPermissions {
+	if !proto.HasExtension(field.Options(), serverpb.E_FieldPermissions) {
+		return nil
+	}
+	return proto.GetExtension(field.Options(), serverpb.E_FieldPermissions).(*serverpb.FieldPermissions)
+}
+
+// Calls the provided function for every populated field in the message, including
+// the fields of any nested messages. The path of the field is provided in the
+// format used by field masks, with the index of the item for repeated fields.
+func rangePopulatedFields(msg protoreflect.Message, prefix string, fn func(path string, parent protoreflect.Message, field protoreflect.FieldDescriptor)) {
+	msg.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		path := prefix + string(field.Name())
+		fn(path, msg, field)
+
+		if field.Kind() != protoreflect.MessageKind || field.IsMap() {
+			return true
+		}
+
+		if field.IsList() {
+			for i := 0; i < value.List().Len(); i++ {
+				rangePopulatedFields(value.List().Get(i).Message(), fmt.Sprintf("%s[%d].", path, i), fn)
+			}
+		} else {
+			rangePopulatedFields(value.Message(), path+".", fn)
+		}
+		return true
+	})
+}
+
+// Clears any fields on the resource that the caller does not have
+// permission to read.
+func redactResource(ctx context.Context, authorizer Authorizer, resource proto.Message) error {
+	// Collect the read permissions of the fields that are populated
+	var permissions []string
+	rangePopulatedFields(resource.ProtoReflect(), "", func(_ string, _ protoreflect.Message, field protoreflect.FieldDescriptor) {
+		if fieldPermissions := getFieldPermissions(field); fieldPermissions.GetRead() != "" {
+			permissions = append(permissions, fieldPermissions.GetRead())
+		}
+	})
+	if len(permissions) == 0 {
+		return nil
+	}
+
+	var resourceName string
+	if nameField := resource.ProtoReflect().Descriptor().Fields().ByName("name"); nameField != nil {
+		resourceName = resource.ProtoReflect().Get(nameField).String()
+	}
+	allowed, err := authorizer.TestPermissions(ctx, principalFromContext(ctx), resourceName, permissions)
+	if err != nil {
+		return err
+	}
+	granted := make(map[string]bool, len(allowed))
+	for _, permission := range allowed {
+		granted[permission] = true
+	}
+
+	// Collect the fields before clearing them so the message
+	// is not modified while it is being ranged over.
+	type redaction struct {
+		parent protoreflect.Message
+		field  protoreflect.FieldDescriptor
+	}
+	var redactions []redaction
+	rangePopulatedFields(resource.ProtoReflect(), "", func(_ string, parent protoreflect.Message, field protoreflect.FieldDescriptor) {
+		if read := getFieldPermissions(field).GetRead(); read != "" && !granted[read] {
+			redactions = append(redactions, redaction{parent: parent, field: field})
+		}
+	})
+	for _, r := range redactions {
+		r.parent.Clear(r.field)
+	}
+	return nil
+}
+
+// Clears the fields the caller is not allowed to read from the resources in a
+// response. Responses can either be a resource or a message containing a list
+// of resources.
+func redactResponse(ctx context.Context, authorizer Authorizer, resp interface{}) error {
+	if authorizer == nil {
+		return nil
+	}
+
+	msg, ok := resp.(proto.Message)
+	if !ok {
+		return nil
+	}
+
+	if resource, ok := msg.(*anypb.Any); ok {
+		return redactAnyResource(ctx, authorizer, resource)
+	}
+	return redactNestedResources(ctx, authorizer, msg.ProtoReflect())
+}
+
+// Redacts the resources that are packed into the Any fields of the message. The
+// fields of nested messages are included, so resources are also redacted when
+// they are wrapped in another message, such as the response of an operation.
+func redactNestedResources(ctx context.Context, authorizer Authorizer, msg protoreflect.Message) error {
+	var err error
+	msg.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if field.Kind() != protoreflect.MessageKind || field.IsMap() {
+			return true
+		}
+
+		var values []protoreflect.Message
+		if field.IsList() {
+			for i := 0; i < value.List().Len(); i++ {
+				values = append(values, value.List().Get(i).Message())
+			}
+		} else {
+			values = append(values, value.Message())
+		}
+
+		for _, value := range values {
+			if field.Message().FullName() == "google.protobuf.Any" {
+				err = redactAnyResource(ctx, authorizer, value.Interface().(*anypb.Any))
+			} else {
+				err = redactNestedResources(ctx, authorizer, value)
+			}
+			if err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// Redacts the resource that is packed into the provided Any, along with any
+// resources that are packed into its fields. Empty values, such as the failed
+// requests of a batch, are left as they are.
+func redactAnyResource(ctx context.Context, authorizer Authorizer, resource *anypb.Any) error {
+	if resource.TypeUrl == "" {
+		return nil
+	}
+
+	unpacked, err := resource.UnmarshalNew()
+	if err != nil {
+		return err
+	}
+
+	if err := redactResource(ctx, authorizer, unpacked); err != nil {
+		return err
+	}
+	if err := redactNestedResources(ctx, authorizer, unpacked.ProtoReflect()); err != nil {
+		return err
+	}
+
+	return resource.MarshalFrom(unpacked)
+}
+
+// Verifies the caller is allowed to write all of the fields that are being set
+// on the resource in the request. When an update mask is provided, only the
+// fields in the mask are considered to be written. Updates without a mask
+// write every field of the resource, whether or not it is populated. A PermissionDenied error
+// listing the fields will be returned when the caller is not allowed to write
+// any of them.
+func authorizeFieldWrites(ctx context.Context, authorizer Authorizer, resourceName string, req proto.Message) error {
+	if authorizer == nil {
+		return nil
+	}
+
+	reqFields := req.ProtoReflect().Descriptor().Fields()
+	resourceField := reqFields.ByName("resource")
+	if resourceField == nil || resourceField.Kind() != protoreflect.MessageKind || resourceField.Message().FullName() != "google.protobuf.Any" {
+		return nil
+	}
+
+	resource, err := req.ProtoReflect().Get(resourceField).Message().Interface().(*anypb.Any).UnmarshalNew()
+	if err != nil {
+		return err
+	}
+
+	// Updates without a mask replace the whole resource, so even the fields
+	// that are not populated are written since their values will be cleared.
+	var mask *fieldmaskpb.FieldMask
+	maskField := reqFields.ByName("update_mask")
+	replace := maskField != nil
+	if maskField != nil && req.ProtoReflect().Has(maskField) {
+		mask, _ = req.ProtoReflect().Get(maskField).Message().Interface().(*fieldmaskpb.FieldMask)
+		replace = len(mask.GetPaths()) == 0
+	}
+
+	// Map the fields being written to the permission that is required to write them
+	fields := writtenFieldPermissions(resource.ProtoReflect(), mask)
+	if replace {
+		for path, permission := range declaredFieldPermissions(resource.ProtoReflect().Descriptor()) {
+			fields[path] = permission
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var permissions []string
+	for _, permission := range fields {
+		permissions = append(permissions, permission)
+	}
+	allowed, err := authorizer.TestPermissions(ctx, principalFromContext(ctx), resourceName, permissions)
+	if err != nil {
+		return err
+	}
+	granted := make(map[string]bool, len(allowed))
+	for _, permission := range allowed {
+		granted[permission] = true
+	}
+
+	// Sort the paths so the violations are reported in a consistent order
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	var denied []string
+	for _, path := range paths {
+		permission := fields[path]
+		if granted[permission] {
+			continue
+		}
+		denied = append(denied, path)
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       path,
+			Description: fmt.Sprintf("Permission %q is required to write the field", permission),
+		})
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	errStatus := status.Newf(codes.PermissionDenied, "not allowed to write the fields: %s", strings.Join(denied, ", "))
+	errStatus, _ = errStatus.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	return errStatus.Err()
+}
+
+// Returns the write permissions of the fields that are being written on the
+// resource mapped by the path of the field. All of the populated fields are
+// considered to be written when no update mask is provided.
+func writtenFieldPermissions(resource protoreflect.Message, mask *fieldmaskpb.FieldMask) map[string]string {
+	fields := make(map[string]string)
+	if len(mask.GetPaths()) == 0 {
+		rangePopulatedFields(resource, "", func(path string, _ protoreflect.Message, field protoreflect.FieldDescriptor) {
+			if write := getFieldPermissions(field).GetWrite(); write != "" {
+				fields[path] = write
+			}
+		})
+		return fields
+	}
+
+	for _, maskPath := range mask.GetPaths() {
+		// Fields in the mask are written even when they are not populated
+		// since the update will clear the existing value.
+		msg := resource
+		var path []string
+		for _, name := range strings.Split(maskPath, ".") {
+			if msg == nil {
+				break
+			}
+			field := msg.Descriptor().Fields().ByName(protoreflect.Name(name))
+			if field == nil {
+				break
+			}
+			path = append(path, name)
+			if write := getFieldPermissions(field).GetWrite(); write != "" {
+				fields[strings.Join(path, ".")] = write
+			}
+
+			// Only singular message fields can be traversed by a field mask
+			if field.Kind() == protoreflect.MessageKind && !field.IsList() && !field.IsMap() {
+				msg = msg.Get(field).Message()
+			} else {
+				msg = nil
+			}
+		}
+
+		// Nested fields of a masked message field are written as well
+		if msg != nil && len(path) > 0 {
+			rangePopulatedFields(msg, strings.Join(path, ".")+".", func(nestedPath string, _ protoreflect.Message, field protoreflect.FieldDescriptor) {
+				if write := getFieldPermissions(field).GetWrite(); write != "" {
+					fields[nestedPath] = write
+				}
+			})
+		}
+	}
+	return fields
+}
+
+// Returns the write permissions of every field the resource type declares them
+// on, including the fields of nested messages, mapped by the path of the field.
+// Repeated and map fields are not traversed since their items have no path
+// until they are populated.
+func declaredFieldPermissions(desc protoreflect.MessageDescriptor) map[string]string {
+	fields := make(map[string]string)
+	var walk func(desc protoreflect.MessageDescriptor, prefix string, seen map[protoreflect.FullName]bool)
+	walk = func(desc protoreflect.MessageDescriptor, prefix string, seen map[protoreflect.FullName]bool) {
+		// Recursive message types would otherwise be walked forever
+		if seen[desc.FullName()] {
+			return
+		}
+		seen[desc.FullName()] = true
+		defer delete(seen, desc.FullName())
+
+		for i := 0; i < desc.Fields().Len(); i++ {
+			field := desc.Fields().Get(i)
+			path := prefix + string(field.Name())
+			if write := getFieldPermissions(field).GetWrite(); write != "" {
+				fields[path] = write
+			}
+			if field.Kind() == protoreflect.MessageKind && !field.IsList() && !field.IsMap() {
+				walk(field.Message(), path+".", seen)
+			}
+		}
+	}
+	walk(desc, "", make(map[protoreflect.FullName]bool))
+	return fields
+}
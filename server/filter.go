@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// A filter that can be evaluated against resources. Filters support a subset
+// of the AIP-160 syntax: comparisons of a field path against a value that are
+// joined together with AND. Comparisons can be negated with NOT or a leading
+// minus sign. Field paths use the proto names of the fields.
+//
+// Example: display_name = "My Account" AND labels.env != "prod" AND NOT uid:*
+type resourceFilter []filterComparison
+
+type filterComparison struct {
+	path     []string
+	operator string
+	value    string
+	negated  bool
+}
+
+// The comparison operators, ordered so that longer operators are matched first.
+var filterOperators = []string{"!=", "<=", ">=", "=", "<", ">", ":"}
+
+// Parses the provided filter. An InvalidArgument error will be returned
+// when the filter is not valid. An empty filter will match all resources.
+func parseFilter(filter string) (resourceFilter, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, invalidFilterError(err)
+	}
+
+	var parsed resourceFilter
+	for len(tokens) > 0 {
+		if len(parsed) > 0 {
+			if tokens[0] != "AND" {
+				return nil, invalidFilterError(fmt.Errorf("expected AND, got %q", tokens[0]))
+			}
+			tokens = tokens[1:]
+		}
+
+		var comparison filterComparison
+		if len(tokens) > 0 && tokens[0] == "NOT" {
+			comparison.negated = true
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 3 {
+			return nil, invalidFilterError(fmt.Errorf("incomplete comparison at the end of the filter"))
+		}
+
+		path := tokens[0]
+		if strings.HasPrefix(path, "-") {
+			comparison.negated = true
+			path = strings.TrimPrefix(path, "-")
+		}
+		comparison.path = strings.Split(path, ".")
+
+		if !isFilterOperator(tokens[1]) {
+			return nil, invalidFilterError(fmt.Errorf("unknown operator %q", tokens[1]))
+		}
+		comparison.operator = tokens[1]
+		comparison.value = unquoteFilterValue(tokens[2])
+
+		parsed = append(parsed, comparison)
+		tokens = tokens[3:]
+	}
+	return parsed, nil
+}
+
+func invalidFilterError(err error) error {
+	errStatus, _ := status.New(codes.InvalidArgument, "invalid filter").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{
+				Field:       "filter",
+				Description: err.Error(),
+			},
+		},
+	})
+	return errStatus.Err()
+}
+
+func isFilterOperator(token string) bool {
+	for _, operator := range filterOperators {
+		if token == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits the filter into field paths, operators, values and keywords.
+// Quoted values are kept together with their quotes.
+func tokenizeFilter(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		c := rune(filter[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(filter) && filter[end] != filter[i] {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			if operator := filterOperatorAt(filter[i:]); operator != "" {
+				tokens = append(tokens, operator)
+				i += len(operator)
+				continue
+			}
+
+			end := i
+			for end < len(filter) && !unicode.IsSpace(rune(filter[end])) && filterOperatorAt(filter[end:]) == "" {
+				end++
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// Returns the operator at the start of the string, if any.
+func filterOperatorAt(s string) string {
+	for _, operator := range filterOperators {
+		if strings.HasPrefix(s, operator) {
+			return operator
+		}
+	}
+	return ""
+}
+
+func unquoteFilterValue(value string) string {
+	if len(value) < 2 {
+		return value
+	}
+	if value[0] == '"' {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
+		}
+	}
+	if value[0] == '"' || value[0] == '\'' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Checks if the resource matches all of the comparisons in the filter.
+func (f resourceFilter) matches(resource proto.Message) (bool, error) {
+	if len(f) == 0 {
+		return true, nil
+	}
+
+	// Convert the resource to a generic map so fields can be found by their path
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(resource)
+	if err != nil {
+		return false, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false, err
+	}
+
+	for _, comparison := range f {
+		if comparison.matches(fields) == comparison.negated {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c filterComparison) matches(fields map[string]interface{}) bool {
+	var value interface{} = fields
+	for _, name := range c.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if value, ok = object[name]; !ok {
+			return false
+		}
+	}
+
+	if c.operator == ":" {
+		return filterHas(value, c.value)
+	}
+	return filterCompare(value, c.operator, c.value)
+}
+
+// Implements the has operator of a filter. Lists match when any element is
+// equal to the value, maps match when they contain the value as a key and a
+// wildcard value matches any field that is present.
+func filterHas(value interface{}, expected string) bool {
+	if expected == "*" {
+		return value != nil
+	}
+
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if filterString(item) == expected {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		_, ok := v[expected]
+		return ok
+	default:
+		return filterString(v) == expected
+	}
+}
+
+// Compares the value to the expected value. Values are compared as numbers
+// when both values are numbers, otherwise they are compared as strings.
+func filterCompare(value interface{}, operator, expected string) bool {
+	actual := filterString(value)
+
+	var cmp int
+	actualNumber, actualErr := strconv.ParseFloat(actual, 64)
+	expectedNumber, expectedErr := strconv.ParseFloat(expected, 64)
+	if actualErr == nil && expectedErr == nil {
+		switch {
+		case actualNumber < expectedNumber:
+			cmp = -1
+		case actualNumber > expectedNumber:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(actual, expected)
+	}
+
+	switch operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func filterString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
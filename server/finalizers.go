@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Returns the finalizers of the resource. Nil will be returned when the
+// resource does not have a finalizers field.
+func resourceFinalizers(resource proto.Message) []string {
+	field := resource.ProtoReflect().Descriptor().Fields().ByName("finalizers")
+	if field == nil || !field.IsList() || field.Kind() != protoreflect.StringKind {
+		return nil
+	}
+
+	list := resource.ProtoReflect().Get(field).List()
+	finalizers := make([]string, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		finalizers[i] = list.Get(i).String()
+	}
+	return finalizers
+}
+
+type finalizerRemovalContextKey struct{}
+
+// Returns a FailedPrecondition error when finalizers are being added to or
+// removed from a resource that has been deleted. Finalizers can not be added
+// once the resource has been deleted, and they can only be removed through
+// RemoveFinalizer by the controllers that are allowed to remove them, so the
+// resource is not purged before the cleanup they track has finished.
+func verifyFinalizers(ctx context.Context, existing, updated proto.Message) error {
+	deleteTime := existing.ProtoReflect().Descriptor().Fields().ByName("delete_time")
+	if !existing.ProtoReflect().Has(deleteTime) {
+		return nil
+	}
+
+	existingFinalizers := resourceFinalizers(existing)
+	updatedFinalizers := resourceFinalizers(updated)
+	for _, finalizer := range updatedFinalizers {
+		if !containsString(existingFinalizers, finalizer) {
+			return status.Errorf(codes.FailedPrecondition, "finalizer %q can not be added to a deleted resource", finalizer)
+		}
+	}
+
+	removing, _ := ctx.Value(finalizerRemovalContextKey{}).(string)
+	for _, finalizer := range existingFinalizers {
+		if !containsString(updatedFinalizers, finalizer) && finalizer != removing {
+			return status.Errorf(codes.FailedPrecondition, "finalizer %q can only be removed from a deleted resource with RemoveFinalizer", finalizer)
+		}
+	}
+	return nil
+}
+
+// Returns a FailedPrecondition error when the resource still has finalizers.
+func verifyFinalized(resource proto.Message) error {
+	if finalizers := resourceFinalizers(resource); len(finalizers) > 0 {
+		name := resource.ProtoReflect().Get(resource.ProtoReflect().Descriptor().Fields().ByName("name")).String()
+		return status.Errorf(codes.FailedPrecondition, "%q can not be purged until its finalizers are removed: %v", name, finalizers)
+	}
+	return nil
+}
+
+func (r *resourceServer) RemoveFinalizer(ctx context.Context, req *serverpb.RemoveFinalizerRequest) (*anypb.Any, error) {
+	resourceDescriptor, err := r.GetResourceDescriptor(req.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	if field := resourceDescriptor.Fields().ByName("finalizers"); field == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s resources do not support finalizers", resourceDescriptor.FullName())
+	}
+
+	// Avoid writing the resource when the finalizer was already removed so
+	// controllers can safely retry.
+	existing, err := r.GetResource(ctx, &serverpb.GetResourceRequest{Name: req.Name, ResourceType: req.ResourceType})
+	if err != nil {
+		return nil, err
+	}
+	unpacked, err := existing.UnmarshalNew()
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(resourceFinalizers(unpacked), req.Finalizer) {
+		return existing, nil
+	}
+
+	// Let the update remove the finalizer from a deleted resource.
+	ctx = context.WithValue(ctx, finalizerRemovalContextKey{}, req.Finalizer)
+	return r.atomicUpdateResource(ctx, req.Name, req.ResourceType, AdmissionUpdate, func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
+		field := existing.ProtoReflect().Descriptor().Fields().ByName("finalizers")
+		remaining := existing.ProtoReflect().NewField(field).List()
+		for _, finalizer := range resourceFinalizers(existing) {
+			if finalizer != req.Finalizer {
+				remaining.Append(protoreflect.ValueOfString(finalizer))
+			}
+		}
+		if remaining.Len() == 0 {
+			existing.ProtoReflect().Clear(field)
+		} else {
+			existing.ProtoReflect().Set(field, protoreflect.ValueOfList(remaining))
+		}
+		return existing, nil
+	}, nil)
+}
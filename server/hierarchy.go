@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Returns the name patterns that are declared on the resource.
+func resourcePatterns(resource protoreflect.MessageDescriptor) []string {
+	return proto.GetExtension(resource.Options(), annotations.E_Resource).(*annotations.ResourceDescriptor).Pattern
+}
+
+// Returns the patterns of the parents of the resource. The parent pattern
+// is the pattern of the resource without its last collection and ID, such
+// as `accounts/{account}` for `accounts/{account}/users/{user}`.
+func parentPatterns(resource protoreflect.MessageDescriptor) []string {
+	var parents []string
+	for _, pattern := range resourcePatterns(resource) {
+		segments := strings.Split(pattern, "/")
+		if len(segments) >= 4 {
+			parents = append(parents, strings.Join(segments[:len(segments)-2], "/"))
+		}
+	}
+	return parents
+}
+
+// Checks if the resource can be created without a parent resource because
+// it declares a top-level pattern, or does not declare any patterns.
+func isTopLevelResource(resource protoreflect.MessageDescriptor) bool {
+	patterns := resourcePatterns(resource)
+	for _, pattern := range patterns {
+		if len(strings.Split(pattern, "/")) < 4 {
+			return true
+		}
+	}
+	return len(patterns) == 0
+}
+
+// Checks if the name matches the pattern. Variable segments such as
+// `{account}` match any segment that is not empty.
+func matchesPattern(name, pattern string) bool {
+	nameSegments := strings.Split(name, "/")
+	patternSegments := strings.Split(pattern, "/")
+	if len(nameSegments) != len(patternSegments) {
+		return false
+	}
+
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if nameSegments[i] == "" {
+				return false
+			}
+		} else if nameSegments[i] != segment {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the registered resource type the parent of a resource belongs to.
+// Nil will be returned when the parent is not a resource that is managed by
+// the server, such as the parent of a top-level resource. An InvalidArgument
+// error will be returned when the parent does not match any of the parent
+// patterns of a resource that can not be created at the top level.
+func (r *resourceServer) resolveParentType(resource protoreflect.MessageDescriptor, parent string) (protoreflect.MessageDescriptor, error) {
+	patterns := parentPatterns(resource)
+	for _, pattern := range patterns {
+		if !matchesPattern(parent, pattern) {
+			continue
+		}
+		for _, parentType := range r.ListResourceDescriptors() {
+			if containsString(resourcePatterns(parentType), pattern) {
+				return parentType, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if isTopLevelResource(resource) {
+		return nil, nil
+	}
+	errStatus, _ := status.New(codes.InvalidArgument, "invalid parent").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{
+				Field:       "parent",
+				Description: fmt.Sprintf("The parent must match one of the patterns: %s", strings.Join(patterns, ", ")),
+			},
+		},
+	})
+	return nil, errStatus.Err()
+}
+
+// Verifies the parent of a resource exists and has not been deleted. This
+// must be called in the transaction of the write so the parent can not be
+// deleted before the write is committed.
+func (r *resourceServer) verifyParent(ctx context.Context, tx *sql.Tx, resource protoreflect.MessageDescriptor, parent string) error {
+	parentType, err := r.resolveParentType(resource, parent)
+	if err != nil || parentType == nil {
+		return err
+	}
+
+	var live bool
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT delete_time IS NULL FROM %s WHERE name = $1",
+		getResourceTableName(parentType),
+	), parent).Scan(&live)
+	if err == sql.ErrNoRows {
+		return status.Errorf(codes.NotFound, "parent %s %q does not exist", parentType.FullName(), parent)
+	} else if err != nil {
+		return err
+	}
+	if !live {
+		return status.Errorf(codes.FailedPrecondition, "parent %s %q has been deleted", parentType.FullName(), parent)
+	}
+	return nil
+}
+
+// Returns the registered resource types that can be created under the
+// provided resource type.
+func (r *resourceServer) childTypes(resource protoreflect.MessageDescriptor) []protoreflect.MessageDescriptor {
+	var children []protoreflect.MessageDescriptor
+	for _, childType := range r.ListResourceDescriptors() {
+		for _, pattern := range parentPatterns(childType) {
+			if containsString(resourcePatterns(resource), pattern) {
+				children = append(children, childType)
+				break
+			}
+		}
+	}
+	return children
+}
+
+// Returns a FailedPrecondition error when the resource with the provided name
+// still has children that have not been deleted.
+func (r *resourceServer) verifyNoLiveChildren(ctx context.Context, tx *sql.Tx, resource protoreflect.MessageDescriptor, name string) error {
+	for _, childType := range r.childTypes(resource) {
+		var children int
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT count(*) FROM %s WHERE parent = $1 AND delete_time IS NULL",
+			getResourceTableName(childType),
+		), name).Scan(&children); err != nil {
+			return err
+		}
+		if children > 0 {
+			return status.Errorf(
+				codes.FailedPrecondition,
+				"%q still has %d %s children, delete them first or set force to delete it anyway",
+				name,
+				children,
+				childType.FullName(),
+			)
+		}
+	}
+	return nil
+}
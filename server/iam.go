@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/iam/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Gets the IAM policy that has been set on the resource name. An empty
+// policy will be returned when no policy has been set.
+func (r *resourceServer) getIamPolicy(ctx context.Context, db database, resource string) (*iam.Policy, error) {
+	statement, err := db.PrepareContext(ctx, "SELECT etag, data FROM iam_policy WHERE resource = $1")
+	if err != nil {
+		return nil, err
+	}
+	defer statement.Close()
+
+	res, err := statement.QueryContext(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return &iam.Policy{}, res.Err()
+	}
+
+	var etag, data string
+	if err := res.Scan(&etag, &data); err != nil {
+		return nil, err
+	}
+
+	policy := &iam.Policy{}
+	if err := protojson.Unmarshal([]byte(data), policy); err != nil {
+		return nil, err
+	}
+	policy.Etag = []byte(etag)
+	return policy, nil
+}
+
+// Gets the IAM policies that have been set on any of the resource names in a
+// single query, mapped by the resource name. Resources that do not have a
+// policy are left out of the map.
+func (r *resourceServer) getIamPolicies(ctx context.Context, db database, resources []string) (map[string]*iam.Policy, error) {
+	args := make([]interface{}, len(resources))
+	placeholders := make([]string, len(resources))
+	for i, resource := range resources {
+		args[i] = resource
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	statement, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT resource, etag, data FROM iam_policy WHERE resource IN (%s)", strings.Join(placeholders, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	defer statement.Close()
+
+	res, err := statement.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	policies := make(map[string]*iam.Policy, len(resources))
+	for res.Next() {
+		var resource, etag, data string
+		if err := res.Scan(&resource, &etag, &data); err != nil {
+			return nil, err
+		}
+
+		policy := &iam.Policy{}
+		if err := protojson.Unmarshal([]byte(data), policy); err != nil {
+			return nil, err
+		}
+		policy.Etag = []byte(etag)
+		policies[resource] = policy
+	}
+	return policies, res.Err()
+}
+
+// Checks if an IAM policy has been set on any resource.
+func (r *resourceServer) HasIamPolicies(ctx context.Context) (bool, error) {
+	var exists bool
+	if err := r.database.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM iam_policy)").Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (r *resourceServer) GetIamPolicy(ctx context.Context, req *serverpb.GetIamPolicyRequest) (*iam.Policy, error) {
+	return r.getIamPolicy(ctx, r.database, req.Resource)
+}
+
+func (r *resourceServer) SetIamPolicy(ctx context.Context, req *serverpb.SetIamPolicyRequest) (*iam.Policy, error) {
+	if req.Policy == nil {
+		return nil, status.Error(codes.InvalidArgument, "a policy is required")
+	}
+
+	// Verify the bindings only reference roles that are known to the server.
+	var violations []*errdetails.BadRequest_FieldViolation
+	for i, binding := range req.Policy.Bindings {
+		if _, ok := r.roles[binding.Role]; !ok {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("policy.bindings[%d].role", i),
+				Description: fmt.Sprintf("Unknown role %q", binding.Role),
+			})
+		}
+	}
+	if len(violations) > 0 {
+		errStatus, _ := status.New(codes.InvalidArgument, "the policy contains invalid bindings").WithDetails(&errdetails.BadRequest{
+			FieldViolations: violations,
+		})
+		return nil, errStatus.Err()
+	}
+
+	// Start a database transaction so the etag can be compared atomically.
+	tx, err := r.database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	existing, err := r.getIamPolicy(ctx, tx, req.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	// Policies are set unconditionally when an etag is not provided.
+	if len(req.Policy.Etag) > 0 && string(req.Policy.Etag) != string(existing.Etag) {
+		return nil, status.Errorf(codes.Aborted, "the policy for resource %q has been modified. please apply your changes to the latest version and try again", req.Resource)
+	}
+
+	policy := &iam.Policy{
+		Version:  req.Policy.Version,
+		Bindings: req.Policy.Bindings,
+	}
+	data, err := protojson.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	policy.Etag = []byte(uuid.New().String())
+
+	statement, err := tx.PrepareContext(ctx, `
+		INSERT INTO iam_policy (resource, etag, data, update_time) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (resource) DO UPDATE SET etag = excluded.etag, data = excluded.data, update_time = excluded.update_time
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := statement.ExecContext(
+		ctx,
+		req.Resource,
+		string(policy.Etag),
+		data,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (r *resourceServer) TestIamPermissions(ctx context.Context, req *serverpb.TestIamPermissionsRequest) (*serverpb.TestIamPermissionsResponse, error) {
+	permissions, err := r.TestPermissions(ctx, principalFromContext(ctx), req.Resource, req.Permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverpb.TestIamPermissionsResponse{
+		Permissions: permissions,
+	}, nil
+}
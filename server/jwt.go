@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Authenticates callers using JSON Web Tokens that are signed by one of
+// the keys in a JSON Web Key Set.
+type jwtAuthenticator struct {
+	// The keys in the key set mapped by their key ID
+	keys     map[string]interface{}
+	issuer   string
+	audience string
+}
+
+// The subset of the JSON Web Key fields that are supported when verifying tokens.
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	// RSA public key parameters
+	N string `json:"n"`
+	E string `json:"e"`
+	// Elliptic curve public key parameters
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+// Creates an authenticator that verifies bearer tokens are JSON Web Tokens signed
+// by a key in the provided JWKS file. The issuer and audience of the token will be
+// verified when they are provided. The subject of the token will be used as a user
+// principal.
+func NewJWTAuthenticator(jwksFile, issuer, audience string) (Authenticator, error) {
+	contents, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(contents, &keySet); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(keySet.Keys))
+	for _, key := range keySet.Keys {
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS file: %v", key.KeyID, err)
+		}
+		keys[key.KeyID] = publicKey
+	}
+
+	return &jwtAuthenticator{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+	}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// The bearer token is not a JWT
+		return nil, errNoCredentials
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %v", err)
+	}
+
+	key, ok := a.keys[header.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("JWT signed by unknown key %q", header.KeyID)
+	}
+	if err := verifyJWTSignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %v", err)
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, fmt.Errorf("JWT has expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("JWT is not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("JWT issuer %q is not trusted", claims.Issuer)
+	}
+	if a.audience != "" && !claims.hasAudience(a.audience) {
+		return nil, fmt.Errorf("JWT is not intended for audience %q", a.audience)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("JWT does not contain a subject")
+	}
+
+	principal := &Principal{Name: "user:" + claims.Subject}
+	if claims.ExpiresAt != 0 {
+		principal.ExpireTime = time.Unix(claims.ExpiresAt, 0)
+	}
+	return principal, nil
+}
+
+// Checks if the audience claim contains the provided audience. The audience
+// claim can either be a single string or a list of strings.
+func (c jwtClaims) hasAudience(audience string) bool {
+	var audiences []string
+	if err := json.Unmarshal(c.Audience, &audiences); err != nil {
+		var single string
+		if err := json.Unmarshal(c.Audience, &single); err != nil {
+			return false
+		}
+		audiences = []string{single}
+	}
+
+	for _, aud := range audiences {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+// Verifies the signature of the signed JWT content using the provided public key.
+func verifyJWTSignature(algorithm string, key interface{}, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWT signing algorithm %q", algorithm)
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") {
+			return fmt.Errorf("JWT algorithm %q does not match the RSA signing key", algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signature); err != nil {
+			return fmt.Errorf("invalid JWT signature: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") {
+			return fmt.Errorf("JWT algorithm %q does not match the EC signing key", algorithm)
+		}
+		// ECDSA signatures are the concatenated R and S values of the signature.
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid JWT signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	default:
+		return fmt.Errorf("unsupported JWT signing key")
+	}
+	return nil
+}
+
+// Converts the JSON Web Key into a public key that can be used to verify signatures.
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// A label selector that can be evaluated against resources or pushed down to
+// the database. Selectors use the Kubernetes syntax: requirements that are
+// joined together with commas, all of which must match.
+//
+// Example: env=prod,tier in (web,api),!canary
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// The operators of the requirements in a label selector.
+const (
+	labelExists    = "exists"
+	labelNotExists = "!"
+	labelEquals    = "="
+	labelNotEquals = "!="
+	labelIn        = "in"
+	labelNotIn     = "notin"
+)
+
+// Parses the label selector that was provided in the named request field. An
+// InvalidArgument error will be returned when the selector is not valid. An
+// empty selector will match all resources.
+func parseLabelSelector(field, selector string) (labelSelector, error) {
+	var parsed labelSelector
+	remaining := strings.TrimSpace(selector)
+	for remaining != "" {
+		requirement, rest, err := parseLabelRequirement(remaining)
+		if err != nil {
+			return nil, invalidLabelSelectorError(field, err)
+		}
+		parsed = append(parsed, requirement)
+
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, invalidLabelSelectorError(field, fmt.Errorf("expected a comma, got %q", rest))
+		}
+		if remaining = strings.TrimSpace(rest[1:]); remaining == "" {
+			return nil, invalidLabelSelectorError(field, fmt.Errorf("incomplete requirement at the end of the selector"))
+		}
+	}
+	return parsed, nil
+}
+
+// Parses the requirement at the start of the selector and returns the rest
+// of the selector after the requirement.
+func parseLabelRequirement(selector string) (labelRequirement, string, error) {
+	if strings.HasPrefix(selector, "!") {
+		key, rest := splitLabelKey(strings.TrimSpace(selector[1:]))
+		if key == "" {
+			return labelRequirement{}, "", fmt.Errorf("expected a label key after !")
+		}
+		return labelRequirement{key: key, operator: labelNotExists}, rest, nil
+	}
+
+	key, rest := splitLabelKey(selector)
+	if key == "" {
+		return labelRequirement{}, "", fmt.Errorf("expected a label key, got %q", selector)
+	}
+	rest = strings.TrimSpace(rest)
+
+	switch {
+	case rest == "" || rest[0] == ',':
+		return labelRequirement{key: key, operator: labelExists}, rest, nil
+	case strings.HasPrefix(rest, "!="):
+		value, rest := splitLabelValue(rest[2:])
+		return labelRequirement{key: key, operator: labelNotEquals, values: []string{value}}, rest, nil
+	case strings.HasPrefix(rest, "=="):
+		value, rest := splitLabelValue(rest[2:])
+		return labelRequirement{key: key, operator: labelEquals, values: []string{value}}, rest, nil
+	case strings.HasPrefix(rest, "="):
+		value, rest := splitLabelValue(rest[1:])
+		return labelRequirement{key: key, operator: labelEquals, values: []string{value}}, rest, nil
+	case strings.HasPrefix(rest, labelNotIn+" ") || strings.HasPrefix(rest, labelNotIn+"("):
+		values, rest, err := parseLabelValueSet(rest[len(labelNotIn):])
+		return labelRequirement{key: key, operator: labelNotIn, values: values}, rest, err
+	case strings.HasPrefix(rest, labelIn+" ") || strings.HasPrefix(rest, labelIn+"("):
+		values, rest, err := parseLabelValueSet(rest[len(labelIn):])
+		return labelRequirement{key: key, operator: labelIn, values: values}, rest, err
+	}
+	return labelRequirement{}, "", fmt.Errorf("unknown operator for label %q: %q", key, rest)
+}
+
+// Splits the label key at the start of the selector from the rest of it.
+func splitLabelKey(selector string) (string, string) {
+	end := strings.IndexAny(selector, " ,=!(")
+	if end < 0 {
+		return selector, ""
+	}
+	return selector[:end], selector[end:]
+}
+
+// Splits the label value at the start of the selector from the rest of it.
+func splitLabelValue(selector string) (string, string) {
+	selector = strings.TrimSpace(selector)
+	end := strings.IndexAny(selector, " ,")
+	if end < 0 {
+		return selector, ""
+	}
+	return selector[:end], selector[end:]
+}
+
+// Parses a set of values in the format `(a,b,c)` and returns the
+// rest of the selector after the set.
+func parseLabelValueSet(selector string) ([]string, string, error) {
+	selector = strings.TrimSpace(selector)
+	if !strings.HasPrefix(selector, "(") {
+		return nil, "", fmt.Errorf("expected a set of values in parentheses")
+	}
+	end := strings.Index(selector, ")")
+	if end < 0 {
+		return nil, "", fmt.Errorf("unterminated set of values")
+	}
+
+	var values []string
+	for _, value := range strings.Split(selector[1:end], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return nil, "", fmt.Errorf("expected at least one value in the set")
+	}
+	return values, selector[end+1:], nil
+}
+
+func invalidLabelSelectorError(field string, err error) error {
+	errStatus, _ := status.New(codes.InvalidArgument, "invalid label selector").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{
+				Field:       field,
+				Description: err.Error(),
+			},
+		},
+	})
+	return errStatus.Err()
+}
+
+// Checks if the labels of the resource match all of the requirements in
+// the selector. Resources without labels only match requirements on
+// labels that must not exist.
+func (s labelSelector) matches(resource proto.Message) bool {
+	labels := resourceLabels(resource)
+	for _, requirement := range s {
+		value, ok := labels[requirement.key]
+		var matched bool
+		switch requirement.operator {
+		case labelExists:
+			matched = ok
+		case labelNotExists:
+			matched = !ok
+		case labelEquals, labelIn:
+			matched = ok && containsString(requirement.values, value)
+		case labelNotEquals, labelNotIn:
+			matched = !ok || !containsString(requirement.values, value)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the SQL conditions for the selector on the resource table with the
+// provided alias. The conditions use the indexed label table and their
+// placeholders start after the provided number of arguments.
+func (s labelSelector) sqlConditions(resourceType, alias string, args []interface{}) ([]string, []interface{}) {
+	var conditions []string
+	for _, requirement := range s {
+		args = append(args, resourceType, requirement.key)
+		subquery := fmt.Sprintf(
+			"SELECT 1 FROM resource_label l WHERE l.resource_type = $%d AND l.name = %s.name AND l.key = $%d",
+			len(args)-1,
+			alias,
+			len(args),
+		)
+
+		if len(requirement.values) > 0 {
+			placeholders := make([]string, len(requirement.values))
+			for i, value := range requirement.values {
+				args = append(args, value)
+				placeholders[i] = fmt.Sprintf("$%d", len(args))
+			}
+			subquery += fmt.Sprintf(" AND l.value IN (%s)", strings.Join(placeholders, ", "))
+		}
+
+		switch requirement.operator {
+		case labelExists, labelEquals, labelIn:
+			conditions = append(conditions, fmt.Sprintf("EXISTS (%s)", subquery))
+		default:
+			conditions = append(conditions, fmt.Sprintf("NOT EXISTS (%s)", subquery))
+		}
+	}
+	return conditions, args
+}
+
+// Returns the labels of the resource. Nil will be returned when the
+// resource does not have labels.
+func resourceLabels(resource proto.Message) map[string]string {
+	field := stringMapField(resource.ProtoReflect(), "labels")
+	if field == nil {
+		return nil
+	}
+	_, labels := sortedStringMap(resource.ProtoReflect(), field)
+	return labels
+}
+
+// Replaces the indexed labels of the resource with its current labels. This
+// must be called in the same transaction as the write to the resource.
+func storeLabels(ctx context.Context, tx *sql.Tx, resource proto.Message) error {
+	name := resource.ProtoReflect().Get(resource.ProtoReflect().Descriptor().Fields().ByName("name")).String()
+	if err := deleteLabels(ctx, tx, resource.ProtoReflect().Descriptor(), name); err != nil {
+		return err
+	}
+
+	for key, value := range resourceLabels(resource) {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO resource_label (resource_type, name, key, value) VALUES ($1, $2, $3, $4)",
+			string(resource.ProtoReflect().Descriptor().FullName()),
+			name,
+			key,
+			value,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the indexed labels of the resource with the provided name.
+func deleteLabels(ctx context.Context, tx *sql.Tx, resourceDescriptor protoreflect.MessageDescriptor, name string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM resource_label WHERE resource_type = $1 AND name = $2",
+		string(resourceDescriptor.FullName()),
+		name,
+	)
+	return err
+}
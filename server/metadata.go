@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The limits that are used for any limit a resource does not override.
+var defaultMetadataLimits = &serverpb.MetadataLimits{
+	MaxLabels:           64,
+	MaxLabelValueLength: 64,
+	MaxAnnotations:      64,
+	MaxAnnotationsSize:  256 * 1024,
+}
+
+var (
+	// Label keys must start with a lowercase letter and can only contain
+	// lowercase letters, numbers, underscores and dashes.
+	labelKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	// Label values can only contain letters, numbers, dashes, underscores
+	// and spaces, and must not start or end in spaces.
+	labelValuePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]([a-zA-Z0-9 _-]*[a-zA-Z0-9_-])?$`)
+	// The name of an annotation key must start and end with a letter or number.
+	annotationNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?$`)
+	// The optional prefix of an annotation key must be a DNS subdomain.
+	annotationPrefixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+)
+
+// Returns the metadata limits of a resource type, using the default
+// limit for any limit the resource does not override.
+func getMetadataLimits(resource protoreflect.MessageDescriptor) *serverpb.MetadataLimits {
+	limits := proto.Clone(defaultMetadataLimits).(*serverpb.MetadataLimits)
+	if !proto.HasExtension(resource.Options(), serverpb.E_MetadataLimits) {
+		return limits
+	}
+
+	overrides := proto.GetExtension(resource.Options(), serverpb.E_MetadataLimits).(*serverpb.MetadataLimits)
+	if overrides.MaxLabels > 0 {
+		limits.MaxLabels = overrides.MaxLabels
+	}
+	if overrides.MaxLabelValueLength > 0 {
+		limits.MaxLabelValueLength = overrides.MaxLabelValueLength
+	}
+	if overrides.MaxAnnotations > 0 {
+		limits.MaxAnnotations = overrides.MaxAnnotations
+	}
+	if overrides.MaxAnnotationsSize > 0 {
+		limits.MaxAnnotationsSize = overrides.MaxAnnotationsSize
+	}
+	return limits
+}
+
+// Returns the string map field with the name on the resource. Nil will be
+// returned when the resource does not have a string map with the name.
+func stringMapField(resource protoreflect.Message, name protoreflect.Name) protoreflect.FieldDescriptor {
+	field := resource.Descriptor().Fields().ByName(name)
+	if field == nil || !field.IsMap() || field.MapKey().Kind() != protoreflect.StringKind || field.MapValue().Kind() != protoreflect.StringKind {
+		return nil
+	}
+	return field
+}
+
+// Returns the entries of a string map field sorted by key so violations
+// are reported in a consistent order.
+func sortedStringMap(resource protoreflect.Message, field protoreflect.FieldDescriptor) ([]string, map[string]string) {
+	entries := make(map[string]string)
+	resource.Get(field).Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+		entries[key.String()] = value.String()
+		return true
+	})
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, entries
+}
+
+// Validates the labels and annotations of the resource against the metadata
+// limits of its type. The violations of all of the entries are returned.
+func validateMetadata(resource proto.Message) []*errdetails.BadRequest_FieldViolation {
+	reflector := resource.ProtoReflect()
+	limits := getMetadataLimits(reflector.Descriptor())
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	violate := func(field, description string, args ...interface{}) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf(description, args...),
+		})
+	}
+
+	if field := stringMapField(reflector, "labels"); field != nil {
+		keys, labels := sortedStringMap(reflector, field)
+		if len(keys) > int(limits.MaxLabels) {
+			violate("labels", "A resource can have at most %d labels", limits.MaxLabels)
+		}
+
+		for _, key := range keys {
+			path := fmt.Sprintf("labels[%q]", key)
+			if !labelKeyPattern.MatchString(key) {
+				violate(path, "Label keys must start with a lowercase letter, be at most 63 characters and only contain lowercase letters, numbers, underscores and dashes")
+			}
+
+			value := labels[key]
+			if len([]rune(value)) > int(limits.MaxLabelValueLength) {
+				violate(path, "Label values must be at most %d characters", limits.MaxLabelValueLength)
+			} else if !labelValuePattern.MatchString(value) {
+				violate(path, "Label values must not be empty, must only contain letters, numbers, dashes, underscores or spaces and must not start or end in spaces")
+			}
+		}
+	}
+
+	if field := stringMapField(reflector, "annotations"); field != nil {
+		keys, annotations := sortedStringMap(reflector, field)
+		if len(keys) > int(limits.MaxAnnotations) {
+			violate("annotations", "A resource can have at most %d annotations", limits.MaxAnnotations)
+		}
+
+		size := 0
+		for _, key := range keys {
+			size += len(key) + len(annotations[key])
+			if !validAnnotationKey(key) {
+				violate(fmt.Sprintf("annotations[%q]", key), "Annotation keys must be an optional DNS subdomain prefix and a slash followed by a name of at most 63 characters that starts and ends with a letter or number")
+			}
+		}
+		if size > int(limits.MaxAnnotationsSize) {
+			violate("annotations", "The annotations of a resource must be at most %d bytes in total", limits.MaxAnnotationsSize)
+		}
+	}
+
+	return violations
+}
+
+// Checks if the annotation key is a name with an optional DNS subdomain
+// prefix, such as `example-integration.com/config`.
+func validAnnotationKey(key string) bool {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		if len(prefix) == 0 || len(prefix) > 253 || !annotationPrefixPattern.MatchString(prefix) {
+			return false
+		}
+		name = key[i+1:]
+	}
+	return annotationNamePattern.MatchString(name)
+}
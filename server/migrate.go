@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+)
+
+// The statements that create the system tables of the server. Statements
+// must be safe to run multiple times since they are run every time the
+// server is started.
+var systemTables = []string{
+	// Stores the IAM policy that has been set on a resource name
+	`CREATE TABLE IF NOT EXISTS iam_policy (
+		resource             STRING NOT NULL,
+		etag                 STRING NOT NULL,
+		data                 TEXT NOT NULL,
+		update_time          TIMESTAMP,
+		CONSTRAINT "primary" PRIMARY KEY (resource ASC)
+	)`,
+	// Holds the latest revision of the resources in the system. Transactions
+	// take the revisions of their writes right before they commit, which
+	// serializes the commits so that revisions are assigned in commit order.
+	// The compacted revision is the latest revision whose events have been
+	// removed.
+	`CREATE TABLE IF NOT EXISTS resource_revision (
+		id                   INT NOT NULL,
+		revision             INT NOT NULL,
+		compacted_revision   INT NOT NULL DEFAULT 0,
+		CONSTRAINT "primary" PRIMARY KEY (id ASC)
+	)`,
+	`INSERT INTO resource_revision (id, revision, compacted_revision) VALUES (1, 0, 0) ON CONFLICT (id) DO NOTHING`,
+	// Stores the changes made to resources so they can be streamed to watchers
+	`CREATE TABLE IF NOT EXISTS resource_event (
+		revision             INT NOT NULL,
+		resource_type        STRING NOT NULL,
+		name                 STRING NOT NULL,
+		parent               STRING NOT NULL,
+		event_type           STRING NOT NULL,
+		data                 TEXT NOT NULL,
+		create_time          TIMESTAMP,
+		CONSTRAINT "primary" PRIMARY KEY (revision ASC),
+		INDEX resource_event_type_parent (resource_type, parent, revision)
+	)`,
+	// The state of the resource before the change, so watchers can tell when
+	// a resource stopped or started matching their selectors.
+	`ALTER TABLE resource_event ADD COLUMN IF NOT EXISTS previous_data TEXT`,
+	// Stores the changes made to resources until they are dispatched to sinks
+	`CREATE TABLE IF NOT EXISTS resource_outbox (
+		revision             INT NOT NULL,
+		resource_type        STRING NOT NULL,
+		name                 STRING NOT NULL,
+		parent               STRING NOT NULL,
+		change_type          STRING NOT NULL,
+		before_data          TEXT,
+		after_data           TEXT,
+		principal            STRING NOT NULL,
+		create_time          TIMESTAMP,
+		CONSTRAINT "primary" PRIMARY KEY (revision ASC)
+	)`,
+	// Tracks the last revision in the outbox that was delivered to each sink,
+	// and the dispatcher that holds the lease to deliver changes to the sink.
+	`CREATE TABLE IF NOT EXISTS resource_outbox_cursor (
+		sink                 STRING NOT NULL,
+		revision             INT NOT NULL,
+		lease_holder         STRING,
+		lease_expire_time    TIMESTAMP,
+		CONSTRAINT "primary" PRIMARY KEY (sink ASC)
+	)`,
+	`ALTER TABLE resource_outbox_cursor ADD COLUMN IF NOT EXISTS lease_holder STRING`,
+	`ALTER TABLE resource_outbox_cursor ADD COLUMN IF NOT EXISTS lease_expire_time TIMESTAMP`,
+	// Indexes the labels of the resources so label selectors can be
+	// evaluated in the database. Kept in sync with the resource tables by
+	// the writes to the resources.
+	`CREATE TABLE IF NOT EXISTS resource_label (
+		resource_type        STRING NOT NULL,
+		name                 STRING NOT NULL,
+		key                  STRING NOT NULL,
+		value                STRING NOT NULL,
+		CONSTRAINT "primary" PRIMARY KEY (resource_type ASC, name ASC, key ASC),
+		INDEX resource_label_key_value (resource_type, key, value)
+	)`,
+	// Holds the values of the unique fields of the resources. The scope is
+	// the parent of the resource for fields that are unique within a parent.
+	`CREATE TABLE IF NOT EXISTS resource_unique (
+		resource_type        STRING NOT NULL,
+		field                STRING NOT NULL,
+		scope                STRING NOT NULL,
+		value                STRING NOT NULL,
+		name                 STRING NOT NULL,
+		CONSTRAINT "primary" PRIMARY KEY (resource_type ASC, field ASC, scope ASC, value ASC),
+		INDEX resource_unique_name (resource_type, name)
+	)`,
+	// Tracks the resources that were deleted along with one of their ancestors
+	// so they can be restored when the ancestor is undeleted. The depth is the
+	// number of generations between the resource and the ancestor.
+	`CREATE TABLE IF NOT EXISTS resource_cascade (
+		resource_type        STRING NOT NULL,
+		name                 STRING NOT NULL,
+		root_type            STRING NOT NULL,
+		root_name            STRING NOT NULL,
+		depth                INT NOT NULL,
+		CONSTRAINT "primary" PRIMARY KEY (resource_type ASC, name ASC),
+		INDEX resource_cascade_root (root_type, root_name, depth)
+	)`,
+	// Indexes the owner references of the resources so the dependents of an
+	// owner can be found. Rows are kept after the owner is purged so that the
+	// garbage collector can find the dependents that were left behind.
+	`CREATE TABLE IF NOT EXISTS resource_owner (
+		dependent_type       STRING NOT NULL,
+		dependent_name       STRING NOT NULL,
+		owner_type           STRING NOT NULL,
+		owner_name           STRING NOT NULL,
+		CONSTRAINT "primary" PRIMARY KEY (dependent_type ASC, dependent_name ASC, owner_type ASC, owner_name ASC),
+		INDEX resource_owner_owner (owner_type, owner_name)
+	)`,
+	// Stores the long-running operations that were started by the mutations
+	// of resources. The data is the JSON representation of the operation.
+	`CREATE TABLE IF NOT EXISTS resource_operation (
+		name                 STRING NOT NULL,
+		done                 BOOL NOT NULL,
+		data                 TEXT NOT NULL,
+		create_time          TIMESTAMP,
+		update_time          TIMESTAMP,
+		CONSTRAINT "primary" PRIMARY KEY (name ASC),
+		INDEX resource_operation_done (done, update_time)
+	)`,
+	// Stores the webhooks that have been queued for each webhook subscription
+	`CREATE TABLE IF NOT EXISTS webhook_delivery (
+		subscription         STRING NOT NULL,
+		revision             INT NOT NULL,
+		resource_name        STRING NOT NULL,
+		event_type           STRING NOT NULL,
+		payload              TEXT NOT NULL,
+		state                STRING NOT NULL,
+		attempts             INT NOT NULL DEFAULT 0,
+		last_error           STRING NOT NULL DEFAULT '',
+		next_attempt_time    TIMESTAMP,
+		create_time          TIMESTAMP,
+		update_time          TIMESTAMP,
+		CONSTRAINT "primary" PRIMARY KEY (subscription ASC, revision ASC),
+		INDEX webhook_delivery_state (state, next_attempt_time)
+	)`,
+}
+
+// Creates the system tables that are used by the server.
+func (r *resourceServer) Migrate(ctx context.Context) error {
+	for _, statement := range systemTables {
+		if _, err := r.database.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
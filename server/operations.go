@@ -0,0 +1,567 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _ longrunning.OperationsServer = &resourceServer{}
+
+// How often WaitOperation checks if the operation has finished.
+const operationPollInterval = 100 * time.Millisecond
+
+// How often the server running an operation records that the operation is
+// still running.
+const operationHeartbeatInterval = 30 * time.Second
+
+// How long an operation can go without a heartbeat before it is considered
+// to be orphaned by a server that stopped running it.
+const orphanedOperationTimeout = 2 * time.Minute
+
+// Makes a mutation to a resource and returns the mutated resource.
+type mutationFunc func(ctx context.Context) (*anypb.Any, error)
+
+// Checks if the mutation is run as a long-running operation for the
+// resource type.
+func isLongRunning(resource protoreflect.MessageDescriptor, operation AdmissionOperation) bool {
+	if !proto.HasExtension(resource.Options(), serverpb.E_LongRunning) {
+		return false
+	}
+
+	longRunning := proto.GetExtension(resource.Options(), serverpb.E_LongRunning).(*serverpb.LongRunning)
+	switch operation {
+	case AdmissionCreate:
+		return longRunning.Create
+	case AdmissionUpdate:
+		return longRunning.Update
+	case AdmissionDelete:
+		return longRunning.Delete
+	}
+	return false
+}
+
+// Makes the mutation to the resource. An operation packed in an Any will be
+// returned instead of the resource when the resource type runs the mutation
+// as a long-running operation. The mutation then runs in the background and
+// its result is stored on the operation.
+func (r *resourceServer) mutateResource(ctx context.Context, resourceType, resourceName string, operation AdmissionOperation, mutate mutationFunc) (*anypb.Any, error) {
+	// Verify the requested resource type was registered.
+	resourceDescriptor, err := r.GetResourceDescriptor(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	if !isLongRunning(resourceDescriptor, operation) {
+		return mutate(ctx)
+	}
+
+	op, err := r.startOperation(ctx, resourceDescriptor, resourceName, operation, mutate)
+	if err != nil {
+		return nil, err
+	}
+	return anypb.New(op)
+}
+
+// A context that carries the values of the request that started an
+// operation, such as the calling principal, but is cancelled along with the
+// operation instead of the request.
+type operationContext struct {
+	context.Context
+	request context.Context
+}
+
+func (c operationContext) Value(key interface{}) interface{} {
+	return c.request.Value(key)
+}
+
+type progressContextKey struct{}
+
+// Reports the progress of the operation a mutation is running in as the number
+// of steps that have been completed out of the total. Nothing is reported when
+// the mutation is not running in an operation. Operations only reach 100% once
+// the mutation has returned.
+func reportProgress(ctx context.Context, completed, total int) {
+	report, _ := ctx.Value(progressContextKey{}).(func(percent int32))
+	if report == nil || total <= 0 {
+		return
+	}
+
+	percent := int32(completed * 100 / total)
+	if percent > 99 {
+		percent = 99
+	}
+	report(percent)
+}
+
+// Stores a new operation for the mutation and runs the mutation in the
+// background. The operation is finished once the mutation returns.
+func (r *resourceServer) startOperation(ctx context.Context, resource protoreflect.MessageDescriptor, resourceName string, operation AdmissionOperation, mutate mutationFunc) (*longrunning.Operation, error) {
+	r.operationsMu.Lock()
+	draining := r.draining
+	r.operationsMu.Unlock()
+	if draining {
+		return nil, status.Error(codes.Unavailable, "the server is shutting down and is not starting new operations")
+	}
+
+	var principal string
+	if p := principalFromContext(ctx); p != nil {
+		principal = p.Name
+	}
+	metadata, err := anypb.New(&serverpb.OperationMetadata{
+		ResourceType: string(resource.FullName()),
+		ResourceName: resourceName,
+		Verb:         string(operation),
+		CreateTime:   timestamppb.Now(),
+		Principal:    principal,
+	})
+	if err != nil {
+		return nil, err
+	}
+	op := &longrunning.Operation{
+		Name:     "operations/" + uuid.New().String(),
+		Metadata: metadata,
+	}
+
+	data, err := protojson.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := r.database.ExecContext(
+		ctx,
+		"INSERT INTO resource_operation (name, done, data, create_time, update_time) VALUES ($1, false, $2, $3, $3)",
+		op.Name,
+		data,
+		now,
+	); err != nil {
+		return nil, err
+	}
+
+	// The operation is cancelled when it is cancelled by the caller or
+	// when it does not finish before the server is shutdown.
+	opCtx, cancel := context.WithCancel(r.operationsCtx)
+	r.operationsMu.Lock()
+	r.operations[op.Name] = cancel
+	r.operationsMu.Unlock()
+
+	// Progress is only stored when it has increased so the operation is
+	// updated at most once per percent.
+	var reported int32
+	progress := func(percent int32) {
+		if percent <= reported {
+			return
+		}
+		reported = percent
+		if err := r.updateOperation(context.Background(), op.Name, func(op *longrunning.Operation, metadata *serverpb.OperationMetadata) {
+			if !op.Done && percent > metadata.ProgressPercent {
+				metadata.ProgressPercent = percent
+			}
+		}); err != nil {
+			log.Printf("failed to report the progress of operation %q: %v", op.Name, err)
+		}
+	}
+
+	r.goBackground(op.Name, func(context.Context) {
+		defer func() {
+			r.operationsMu.Lock()
+			delete(r.operations, op.Name)
+			r.operationsMu.Unlock()
+			cancel()
+		}()
+
+		heartbeat := make(chan struct{})
+		defer close(heartbeat)
+		go r.heartbeatOperation(op.Name, heartbeat)
+
+		result, err := mutate(context.WithValue(operationContext{Context: opCtx, request: ctx}, progressContextKey{}, progress))
+		if err != nil && opCtx.Err() != nil {
+			err = status.Error(codes.Canceled, "the operation was cancelled before it completed")
+		}
+		if err := r.finishOperation(op.Name, result, err); err != nil {
+			log.Printf("failed to finish operation %q: %v", op.Name, err)
+		}
+	})
+
+	return op, nil
+}
+
+// Records that the operation is still running on every interval until the
+// heartbeat is stopped. Operations that stop receiving heartbeats are failed
+// as orphaned operations.
+func (r *resourceServer) heartbeatOperation(name string, stop <-chan struct{}) {
+	ticker := time.NewTicker(operationHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := r.database.ExecContext(
+				context.Background(),
+				"UPDATE resource_operation SET update_time = $2 WHERE name = $1 AND NOT done",
+				name,
+				time.Now().UTC().Format(time.RFC3339Nano),
+			); err != nil {
+				log.Printf("failed to record the heartbeat of operation %q: %v", name, err)
+			}
+		}
+	}
+}
+
+// Stores the result of the mutation on the operation and marks it as done.
+// Operations that were already failed as orphaned operations are left as
+// they are.
+func (r *resourceServer) finishOperation(name string, result *anypb.Any, mutateErr error) error {
+	// The operation context has finished by now, but the result still has
+	// to be stored for callers that are waiting on the operation.
+	ctx := context.Background()
+
+	return r.updateOperation(ctx, name, func(op *longrunning.Operation, metadata *serverpb.OperationMetadata) {
+		if op.Done {
+			return
+		}
+
+		metadata.EndTime = timestamppb.Now()
+		metadata.ProgressPercent = 100
+
+		op.Done = true
+		if mutateErr != nil {
+			op.Result = &longrunning.Operation_Error{Error: status.Convert(mutateErr).Proto()}
+		} else {
+			op.Result = &longrunning.Operation_Response{Response: result}
+		}
+	})
+}
+
+// Atomically updates the stored operation with the provided function.
+func (r *resourceServer) updateOperation(ctx context.Context, name string, update func(op *longrunning.Operation, metadata *serverpb.OperationMetadata)) error {
+	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	op, err := getOperation(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	metadata := &serverpb.OperationMetadata{}
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		return err
+	}
+
+	update(op, metadata)
+	if op.Metadata, err = anypb.New(metadata); err != nil {
+		return err
+	}
+
+	data, err := protojson.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE resource_operation SET done = $2, data = $3, update_time = $4 WHERE name = $1",
+		name,
+		op.Done,
+		data,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Fails the operations that are no longer being run by any server, such as the
+// operations of a server that was stopped before they finished. Operations are
+// considered orphaned when they have not received a heartbeat within the
+// timeout. The operations finish with an Aborted error.
+func (r *resourceServer) failOrphanedOperations(ctx context.Context) error {
+	orphanedBefore := time.Now().Add(-orphanedOperationTimeout).UTC().Format(time.RFC3339Nano)
+	res, err := r.database.QueryContext(ctx, "SELECT data FROM resource_operation WHERE NOT done AND update_time < $1", orphanedBefore)
+	if err != nil {
+		return err
+	}
+
+	var operations []*longrunning.Operation
+	for res.Next() {
+		var data string
+		if err := res.Scan(&data); err != nil {
+			res.Close()
+			return err
+		}
+		op := &longrunning.Operation{}
+		if err := protojson.Unmarshal([]byte(data), op); err != nil {
+			res.Close()
+			return err
+		}
+		operations = append(operations, op)
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return err
+	}
+
+	for _, op := range operations {
+		metadata := &serverpb.OperationMetadata{}
+		if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+			return err
+		}
+		metadata.EndTime = timestamppb.Now()
+		if op.Metadata, err = anypb.New(metadata); err != nil {
+			return err
+		}
+		op.Done = true
+		op.Result = &longrunning.Operation_Error{
+			Error: status.New(codes.Aborted, "the server running the operation stopped before it completed").Proto(),
+		}
+
+		data, err := protojson.Marshal(op)
+		if err != nil {
+			return err
+		}
+		// The operation is only failed when it has not received a
+		// heartbeat since it was read.
+		if _, err := r.database.ExecContext(
+			ctx,
+			"UPDATE resource_operation SET done = true, data = $2, update_time = $3 WHERE name = $1 AND NOT done AND update_time < $4",
+			op.Name,
+			data,
+			time.Now().UTC().Format(time.RFC3339Nano),
+			orphanedBefore,
+		); err != nil {
+			return err
+		}
+	}
+	if len(operations) > 0 {
+		log.Printf("Failed %d orphaned operations", len(operations))
+	}
+	return nil
+}
+
+// Retrieves the stored operation. A NotFound error will be returned when
+// the operation does not exist.
+func getOperation(ctx context.Context, db database, name string) (*longrunning.Operation, error) {
+	statement, err := db.PrepareContext(ctx, "SELECT data FROM resource_operation WHERE name = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	var data string
+	if err := statement.QueryRowContext(ctx, name).Scan(&data); err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "operation %q not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	op := &longrunning.Operation{}
+	if err := protojson.Unmarshal([]byte(data), op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// Returns the permission that is required to make the mutation of the operation.
+func operationPermission(metadata *serverpb.OperationMetadata) string {
+	return "resourcemanager.resources." + strings.ToLower(metadata.Verb)
+}
+
+// Verifies the caller has been granted the permission on the resource the
+// operation is mutating. Operations are not resources, so access to them is
+// granted through the resource. The permission of the mutation is used when
+// no permission is provided.
+func authorizeOperation(ctx context.Context, op *longrunning.Operation, permission string) error {
+	metadata := &serverpb.OperationMetadata{}
+	if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+		return err
+	}
+	if permission == "" {
+		permission = operationPermission(metadata)
+	}
+	return authorize(ctx, authorizerFromContext(ctx), metadata.ResourceName, []string{permission})
+}
+
+func (r *resourceServer) GetOperation(ctx context.Context, req *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+	op, err := getOperation(ctx, r.database, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOperation(ctx, op, "resourcemanager.resources.get"); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// Returns the operations in the order of their names. The filter is evaluated
+// against the JSON representation of the operations, such as `done = false`
+// or `metadata.resource_type = "features.Account"`. Only the operations of the
+// resources the caller is allowed to get are listed.
+func (r *resourceServer) ListOperations(ctx context.Context, req *longrunning.ListOperationsRequest) (*longrunning.ListOperationsResponse, error) {
+	// Set the default page size when not provided.
+	if req.PageSize == 0 {
+		req.PageSize = 50
+	}
+
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	pageStart, err := parsePageToken(req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.database.QueryContext(ctx, "SELECT data FROM resource_operation WHERE name > $1 ORDER BY name", pageStart)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	// One extra operation is read to find out if there is another page.
+	var operations []*longrunning.Operation
+	for len(operations) <= int(req.PageSize) && res.Next() {
+		var data string
+		if err := res.Scan(&data); err != nil {
+			return nil, err
+		}
+		op := &longrunning.Operation{}
+		if err := protojson.Unmarshal([]byte(data), op); err != nil {
+			return nil, err
+		}
+
+		if matches, err := filter.matches(op); err != nil {
+			return nil, err
+		} else if !matches {
+			continue
+		}
+
+		metadata := &serverpb.OperationMetadata{}
+		if err := op.Metadata.UnmarshalTo(metadata); err != nil {
+			return nil, err
+		}
+		if allowed, err := callerPermissions(ctx, metadata.ResourceName, []string{"resourcemanager.resources.get"}); err != nil {
+			return nil, err
+		} else if len(allowed) > 0 {
+			operations = append(operations, op)
+		}
+	}
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+
+	resp := &longrunning.ListOperationsResponse{Operations: operations}
+	if len(operations) > int(req.PageSize) {
+		resp.Operations = operations[:req.PageSize]
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(resp.Operations[len(resp.Operations)-1].Name))
+	}
+	return resp, nil
+}
+
+// Removes the operation. The operation is not cancelled, the caller is only
+// stating that they are no longer interested in its result.
+func (r *resourceServer) DeleteOperation(ctx context.Context, req *longrunning.DeleteOperationRequest) (*emptypb.Empty, error) {
+	op, err := getOperation(ctx, r.database, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOperation(ctx, op, ""); err != nil {
+		return nil, err
+	}
+
+	res, err := r.database.ExecContext(ctx, "DELETE FROM resource_operation WHERE name = $1", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if deleted, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if deleted == 0 {
+		return nil, status.Errorf(codes.NotFound, "operation %q not found", req.Name)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Requests the operation to be cancelled. Cancellation is best effort, the
+// mutation is rolled back when it has not been committed yet. Operations that
+// are cancelled finish with a Canceled error.
+func (r *resourceServer) CancelOperation(ctx context.Context, req *longrunning.CancelOperationRequest) (*emptypb.Empty, error) {
+	op, err := getOperation(ctx, r.database, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOperation(ctx, op, ""); err != nil {
+		return nil, err
+	}
+
+	if err := r.updateOperation(ctx, req.Name, func(op *longrunning.Operation, metadata *serverpb.OperationMetadata) {
+		if !op.Done {
+			metadata.CancelRequested = true
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	// Operations can only be cancelled by the server that is running them.
+	r.operationsMu.Lock()
+	cancel := r.operations[req.Name]
+	r.operationsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// Waits until the operation is done or the timeout has passed, and returns
+// the latest state of the operation. The operation is waited on until the
+// deadline of the request when no timeout is provided.
+func (r *resourceServer) WaitOperation(ctx context.Context, req *longrunning.WaitOperationRequest) (*longrunning.Operation, error) {
+	op, err := getOperation(ctx, r.database, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeOperation(ctx, op, "resourcemanager.resources.get"); err != nil {
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if req.Timeout != nil {
+		timer := time.NewTimer(req.Timeout.AsDuration())
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ticker := time.NewTicker(operationPollInterval)
+	defer ticker.Stop()
+
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-timeout:
+			return op, nil
+		case <-ticker.C:
+		}
+
+		if op, err = getOperation(ctx, r.database, req.Name); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// The principal recorded for changes that are made by the server itself,
+// such as resources that are removed by the purger.
+const systemPrincipal = "system"
+
+// The max number of outbox entries that are read from the database at once.
+const outboxBatchSize = 100
+
+// How long a dispatcher holds the lease on a sink after it last made progress.
+// Only the dispatcher holding the lease delivers changes to the sink, so servers
+// running a dispatcher with the same name do not deliver changes concurrently.
+const outboxLeaseDuration = 2 * time.Minute
+
+// The delays between attempts to deliver a change that a sink failed to accept.
+const (
+	minDeliveryBackoff = time.Second
+	maxDeliveryBackoff = time.Minute
+)
+
+// Change is a change that was made to a resource. Changes are written to the
+// outbox in the same transaction as the change itself so they are never lost.
+type Change struct {
+	// The revision of the write that made the change. Revisions increase
+	// in the order the changes were committed.
+	Revision int64
+
+	// The type of change that was made to the resource.
+	Type serverpb.WatchResourcesResponse_EventType
+
+	// The type, name and parent of the resource that changed.
+	ResourceType string
+	Name         string
+	Parent       string
+
+	// The state of the resource before and after the change. Before is
+	// nil for resources that were added and After is nil for resources
+	// that were purged.
+	Before *anypb.Any
+	After  *anypb.Any
+
+	// The principal that made the change.
+	Principal string
+
+	// The time the change was committed.
+	CreateTime time.Time
+}
+
+// OutboxSink receives the changes that are dispatched from the outbox. Changes
+// are delivered at least once, one at a time, in the order they were committed.
+// A change will be retried until Deliver returns nil, so sinks must be able to
+// handle receiving the same change more than once.
+type OutboxSink interface {
+	Deliver(ctx context.Context, change *Change) error
+}
+
+// Records a change to a resource in the outbox and in the events that are
+// streamed to watchers. This must be called in the same transaction as the
+// change so the change is only recorded when it is committed.
+func (r *resourceServer) recordChange(ctx context.Context, tx *sql.Tx, revision int64, eventType serverpb.WatchResourcesResponse_EventType, parent string, before, after *anypb.Any) error {
+	// Events describe the latest state of the resource, which is the
+	// state before the change for resources that were purged.
+	resource, previous := after, before
+	if resource == nil {
+		resource, previous = before, nil
+	}
+	if err := r.recordEvent(ctx, tx, revision, eventType, parent, resource, previous); err != nil {
+		return err
+	}
+
+	name, err := resourceName(resource)
+	if err != nil {
+		return err
+	}
+
+	beforeJSON, err := marshalNullableResource(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := marshalNullableResource(after)
+	if err != nil {
+		return err
+	}
+
+	principal := systemPrincipal
+	if p := principalFromContext(ctx); p != nil {
+		principal = p.Name
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO resource_outbox (revision, resource_type, name, parent, change_type, before_data, after_data, principal, create_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		revision,
+		string(resource.MessageName()),
+		name,
+		parent,
+		eventType.String(),
+		beforeJSON,
+		afterJSON,
+		principal,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	return err
+}
+
+func marshalNullableResource(resource *anypb.Any) (sql.NullString, error) {
+	if resource == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := protojson.Marshal(resource)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalNullableResource(data sql.NullString) (*anypb.Any, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	resource := &anypb.Any{}
+	if err := protojson.Unmarshal([]byte(data.String), resource); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// Starts a background worker that delivers the changes in the outbox to the
+// sink. The name identifies the sink and is used to track which changes have
+// been delivered to it, so the sink will resume with the first undelivered
+// change after a restart. When several servers start a dispatcher with the
+// same name, only the one holding the lease on the sink delivers changes.
+func (r *resourceServer) StartDispatcher(name string, sink OutboxSink) {
+	holder := uuid.New().String()
+	r.goBackground(fmt.Sprintf("dispatcher %s", name), func(ctx context.Context) {
+		notifications, unsubscribe := r.events.subscribe()
+		defer unsubscribe()
+		defer r.releaseSinkLease(name, holder)
+
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+
+		for {
+			delivered, err := r.dispatchChanges(ctx, name, holder, sink)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("failed to dispatch changes to %s: %v", name, err)
+			}
+
+			// Keep dispatching when there are more changes waiting
+			if err == nil && delivered == outboxBatchSize {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-notifications:
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// Takes or renews the lease on the sink for the holder and returns the last
+// revision that was delivered to the sink. False is returned when another
+// dispatcher holds an unexpired lease on the sink.
+func (r *resourceServer) acquireSinkLease(ctx context.Context, name, holder string) (int64, bool, error) {
+	now := time.Now().UTC()
+	var position int64
+	err := r.database.QueryRowContext(
+		ctx,
+		`INSERT INTO resource_outbox_cursor (sink, revision, lease_holder, lease_expire_time) VALUES ($1, 0, $2, $3)
+		ON CONFLICT (sink) DO UPDATE SET lease_holder = excluded.lease_holder, lease_expire_time = excluded.lease_expire_time
+		WHERE resource_outbox_cursor.lease_holder IS NULL OR resource_outbox_cursor.lease_holder = excluded.lease_holder OR resource_outbox_cursor.lease_expire_time < $4
+		RETURNING revision`,
+		name,
+		holder,
+		now.Add(outboxLeaseDuration).Format(time.RFC3339Nano),
+		now.Format(time.RFC3339Nano),
+	).Scan(&position)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return position, err == nil, err
+}
+
+// Gives up the lease on the sink so another server can take over delivering
+// changes to it without waiting for the lease to expire.
+func (r *resourceServer) releaseSinkLease(name, holder string) {
+	if _, err := r.database.Exec(
+		"UPDATE resource_outbox_cursor SET lease_holder = NULL, lease_expire_time = NULL WHERE sink = $1 AND lease_holder = $2",
+		name,
+		holder,
+	); err != nil {
+		log.Printf("failed to release the lease on sink %s: %v", name, err)
+	}
+}
+
+// Delivers the next batch of undelivered changes to the sink and returns the
+// number of changes that were delivered. The position of the sink is saved
+// after every change so a change is only delivered again when the server stops
+// before its delivery was recorded. Nothing is delivered while another
+// dispatcher holds the lease on the sink.
+func (r *resourceServer) dispatchChanges(ctx context.Context, name, holder string, sink OutboxSink) (int, error) {
+	position, leased, err := r.acquireSinkLease(ctx, name, holder)
+	if err != nil || !leased {
+		return 0, err
+	}
+
+	changes, err := r.listChanges(ctx, position)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, change := range changes {
+		renew := func() error {
+			_, leased, err := r.acquireSinkLease(ctx, name, holder)
+			if err == nil && !leased {
+				err = fmt.Errorf("the lease on sink %s was taken by another dispatcher", name)
+			}
+			return err
+		}
+		if err := deliverChange(ctx, name, sink, change, renew); err != nil {
+			return i, err
+		}
+
+		// The cursor only moves forward and only while the lease is held,
+		// so a dispatcher that lost its lease can not rewind the sink.
+		res, err := r.database.ExecContext(
+			ctx,
+			`UPDATE resource_outbox_cursor SET revision = $1, lease_expire_time = $2
+			WHERE sink = $3 AND lease_holder = $4 AND revision < $1`,
+			change.Revision,
+			time.Now().UTC().Add(outboxLeaseDuration).Format(time.RFC3339Nano),
+			name,
+			holder,
+		)
+		if err != nil {
+			return i, err
+		}
+		if updated, err := res.RowsAffected(); err != nil {
+			return i, err
+		} else if updated == 0 {
+			return i + 1, fmt.Errorf("the lease on sink %s was taken by another dispatcher", name)
+		}
+	}
+	return len(changes), nil
+}
+
+// Delivers a change to the sink, retrying with an exponential backoff until
+// the sink accepts the change or the context is done. Later changes are held
+// back while a change is being retried so they are delivered in order. The
+// lease on the sink is renewed between attempts so it does not expire while
+// a change is being retried.
+func deliverChange(ctx context.Context, name string, sink OutboxSink, change *Change, renew func() error) error {
+	backoff := minDeliveryBackoff
+	for {
+		err := sink.Deliver(ctx, change)
+		if err == nil {
+			return nil
+		}
+		log.Printf("failed to deliver change %d to %s, retrying in %v: %v", change.Revision, name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if err := renew(); err != nil {
+			return err
+		}
+
+		if backoff *= 2; backoff > maxDeliveryBackoff {
+			backoff = maxDeliveryBackoff
+		}
+	}
+}
+
+// Removes the changes from the outbox that have been delivered to every sink.
+// Changes that were recorded before the provided time are removed while
+// there are no sinks, so the first sink to start only delivers the changes
+// within the retention period. Sinks that are no longer dispatched to have to
+// be removed from the cursors, otherwise the changes they have not received
+// are kept forever.
+func (r *resourceServer) pruneOutbox(ctx context.Context, before time.Time) error {
+	_, err := r.database.ExecContext(
+		ctx,
+		`DELETE FROM resource_outbox WHERE revision <= (SELECT min(revision) FROM resource_outbox_cursor)
+		OR (NOT EXISTS (SELECT 1 FROM resource_outbox_cursor) AND create_time < $1)`,
+		before.UTC().Format(time.RFC3339Nano),
+	)
+	return err
+}
+
+// Returns the next batch of changes in the outbox that were recorded after
+// the provided revision.
+func (r *resourceServer) listChanges(ctx context.Context, after int64) ([]*Change, error) {
+	res, err := r.database.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			"SELECT revision, resource_type, name, parent, change_type, before_data, after_data, principal, create_time FROM resource_outbox WHERE revision > $1 ORDER BY revision LIMIT %d",
+			outboxBatchSize,
+		),
+		after,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var changes []*Change
+	for res.Next() {
+		change := &Change{}
+		var changeType, createTime string
+		var before, after sql.NullString
+		if err := res.Scan(
+			&change.Revision,
+			&change.ResourceType,
+			&change.Name,
+			&change.Parent,
+			&changeType,
+			&before,
+			&after,
+			&change.Principal,
+			&createTime,
+		); err != nil {
+			return nil, err
+		}
+
+		if change.CreateTime, err = time.Parse(time.RFC3339Nano, createTime); err != nil {
+			return nil, err
+		}
+
+		change.Type = serverpb.WatchResourcesResponse_EventType(serverpb.WatchResourcesResponse_EventType_value[changeType])
+		if change.Before, err = unmarshalNullableResource(before); err != nil {
+			return nil, err
+		}
+		if change.After, err = unmarshalNullableResource(after); err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, change)
+	}
+	return changes, res.Err()
+}
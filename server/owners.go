@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Returns the owner_references field of the resource type. Nil will be returned
+// when the resource type does not have a list of owner references.
+func ownerReferencesField(resourceDescriptor protoreflect.MessageDescriptor) protoreflect.FieldDescriptor {
+	field := resourceDescriptor.Fields().ByName("owner_references")
+	if field == nil || !field.IsList() || field.Message() == nil ||
+		field.Message().FullName() != (&serverpb.OwnerReference{}).ProtoReflect().Descriptor().FullName() {
+		return nil
+	}
+	return field
+}
+
+// Returns the owner references of the resource. Nil will be returned when
+// the resource does not have an owner_references field.
+func ownerReferences(resource proto.Message) []*serverpb.OwnerReference {
+	field := ownerReferencesField(resource.ProtoReflect().Descriptor())
+	if field == nil {
+		return nil
+	}
+
+	list := resource.ProtoReflect().Get(field).List()
+	owners := make([]*serverpb.OwnerReference, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		owners[i] = list.Get(i).Message().Interface().(*serverpb.OwnerReference)
+	}
+	return owners
+}
+
+// Validates that the owner references of the resource are for registered
+// resource types and provide the name of the owner.
+func (r *resourceServer) validateOwnerReferences(resource proto.Message) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	for i, owner := range ownerReferences(resource) {
+		if r.resources[owner.ResourceType] == nil {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("owner_references[%d].resource_type", i),
+				Description: fmt.Sprintf("Unknown resource type %q", owner.ResourceType),
+			})
+		}
+		if owner.Name == "" {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("owner_references[%d].name", i),
+				Description: "The name of the owner is required",
+			})
+		}
+	}
+	return violations
+}
+
+// Replaces the indexed owners of the resource with its current owner
+// references. This must be called in the same transaction as the write
+// to the resource.
+func storeOwners(ctx context.Context, tx *sql.Tx, resource proto.Message) error {
+	descriptor := resource.ProtoReflect().Descriptor()
+	name := resource.ProtoReflect().Get(descriptor.Fields().ByName("name")).String()
+	if err := deleteOwners(ctx, tx, descriptor, name); err != nil {
+		return err
+	}
+
+	for _, owner := range ownerReferences(resource) {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO resource_owner (dependent_type, dependent_name, owner_type, owner_name) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			string(descriptor.FullName()),
+			name,
+			owner.ResourceType,
+			owner.Name,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the indexed owners of the resource with the provided name.
+func deleteOwners(ctx context.Context, tx *sql.Tx, resourceDescriptor protoreflect.MessageDescriptor, name string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM resource_owner WHERE dependent_type = $1 AND dependent_name = $2",
+		string(resourceDescriptor.FullName()),
+		name,
+	)
+	return err
+}
+
+// A resource that is referenced by the owner index.
+type resourceRef struct {
+	resourceType string
+	name         string
+}
+
+// Returns the resources that match the query on the owner index. The query
+// must select a resource type and a name.
+func queryResourceRefs(ctx context.Context, db database, query string, args ...interface{}) ([]resourceRef, error) {
+	res, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var refs []resourceRef
+	for res.Next() {
+		var ref resourceRef
+		if err := res.Scan(&ref.resourceType, &ref.name); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, res.Err()
+}
+
+func (r *resourceServer) ListDependents(ctx context.Context, req *serverpb.ListDependentsRequest) (*serverpb.ListDependentsResponse, error) {
+	if _, err := r.GetResourceDescriptor(req.ResourceType); err != nil {
+		return nil, err
+	}
+
+	dependents, err := queryResourceRefs(
+		ctx,
+		r.database,
+		"SELECT dependent_type, dependent_name FROM resource_owner WHERE owner_type = $1 AND owner_name = $2 ORDER BY dependent_type, dependent_name",
+		req.ResourceType,
+		req.Name,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &serverpb.ListDependentsResponse{}
+	for _, dependent := range dependents {
+		// Dependents can be anywhere in the hierarchy, so the caller is only
+		// shown the dependents they are allowed to get.
+		allowed, err := callerPermissions(ctx, dependent.name, []string{"resourcemanager.resources.get"})
+		if err != nil {
+			return nil, err
+		} else if len(allowed) == 0 {
+			continue
+		}
+
+		resource, err := r.GetResource(ctx, &serverpb.GetResourceRequest{Name: dependent.name, ResourceType: dependent.resourceType})
+		if status.Code(err) == codes.NotFound || status.Code(err) == codes.Unimplemented {
+			// The dependent was purged, or its type is no longer registered.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		resp.Resources = append(resp.Resources, resource)
+	}
+	return resp, nil
+}
+
+// Starts a background worker that deletes the resources whose owners have
+// all been deleted or purged. The garbage collector will look for such
+// resources on every interval until the server is shutdown. The garbage
+// collector is disabled when the interval is not positive.
+func (r *resourceServer) StartGarbageCollector(interval time.Duration) {
+	if interval <= 0 {
+		log.Print("The garbage collector interval is not positive, the garbage collector is disabled")
+		return
+	}
+
+	r.goBackground("garbage-collector", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.collectGarbage(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("failed to collect garbage: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// Deletes the live resources whose owners have all been deleted or purged.
+// The descendants of the resources are deleted along with them.
+func (r *resourceServer) collectGarbage(ctx context.Context) error {
+	// Find the dependents that have at least one owner that is gone.
+	candidates := make(map[resourceRef]bool)
+	for _, ownerType := range r.ListResourceDescriptors() {
+		dependents, err := queryResourceRefs(ctx, r.database, fmt.Sprintf(
+			`SELECT ro.dependent_type, ro.dependent_name FROM resource_owner ro
+			LEFT JOIN %s o ON o.name = ro.owner_name
+			WHERE ro.owner_type = $1 AND (o.name IS NULL OR o.delete_time IS NOT NULL)`,
+			getResourceTableName(ownerType),
+		), string(ownerType.FullName()))
+		if err != nil {
+			return err
+		}
+		for _, dependent := range dependents {
+			candidates[dependent] = true
+		}
+	}
+
+	// Dependents that can not be collected are logged so they do not stop
+	// the rest of the dependents from being collected.
+	var collected int
+	for dependent := range candidates {
+		orphaned, err := r.isOrphaned(ctx, r.database, dependent)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("failed to check if %s %q is orphaned: %v", dependent.resourceType, dependent.name, err)
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+
+		err = r.deleteOrphan(ctx, dependent)
+		switch {
+		case err == nil:
+			collected++
+		case err == errNotOrphaned || status.Code(err) == codes.NotFound:
+			// The dependent was deleted, purged or adopted since it was found.
+		case ctx.Err() != nil:
+			return err
+		default:
+			log.Printf("failed to garbage collect %s %q: %v", dependent.resourceType, dependent.name, err)
+		}
+	}
+	if collected > 0 {
+		log.Printf("Garbage collected %d resources", collected)
+	}
+	return nil
+}
+
+var errNotOrphaned = errors.New("the resource is no longer orphaned")
+
+// Deletes the orphaned dependent along with its descendants. The dependent
+// and its owners are checked again in the delete transaction so a dependent
+// is not deleted when it was deleted or one of its owners was restored after
+// it was found. errNotOrphaned is returned in that case.
+func (r *resourceServer) deleteOrphan(ctx context.Context, dependent resourceRef) error {
+	req := &serverpb.DeleteResourceRequest{
+		Name:         dependent.name,
+		ResourceType: dependent.resourceType,
+		Force:        true,
+	}
+	deleteHook := r.deleteHook(req)
+
+	// Delete the resource directly so the result is known even when
+	// its deletes are run as long-running operations.
+	_, err := r.atomicUpdateResource(ctx, req.Name, req.ResourceType, AdmissionDelete, func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
+		if existing.ProtoReflect().Has(existing.ProtoReflect().Descriptor().Fields().ByName("delete_time")) {
+			return nil, errNotOrphaned
+		}
+		return markDeleted(existing)
+	}, func(ctx context.Context, tx *writeTx, parent string, updated protoreflect.ProtoMessage) error {
+		if gone, err := r.ownersAreGone(ctx, tx, dependent); err != nil {
+			return err
+		} else if !gone {
+			return errNotOrphaned
+		}
+		return deleteHook(ctx, tx, parent, updated)
+	})
+	return err
+}
+
+// Checks if the dependent is live and all of its owners have been deleted or
+// purged.
+func (r *resourceServer) isOrphaned(ctx context.Context, db database, dependent resourceRef) (bool, error) {
+	if live, err := r.isLive(ctx, db, dependent); err != nil || !live {
+		return false, err
+	}
+	return r.ownersAreGone(ctx, db, dependent)
+}
+
+// Checks if all of the owners of the dependent have been deleted or purged.
+// Owners of resource types that are not registered are assumed to be live
+// since their state is not known.
+func (r *resourceServer) ownersAreGone(ctx context.Context, db database, dependent resourceRef) (bool, error) {
+	owners, err := queryResourceRefs(
+		ctx,
+		db,
+		"SELECT owner_type, owner_name FROM resource_owner WHERE dependent_type = $1 AND dependent_name = $2",
+		dependent.resourceType,
+		dependent.name,
+	)
+	if err != nil {
+		return false, err
+	}
+	for _, owner := range owners {
+		if r.resources[owner.resourceType] == nil {
+			return false, nil
+		}
+		if live, err := r.isLive(ctx, db, owner); err != nil || live {
+			return false, err
+		}
+	}
+	return len(owners) > 0, nil
+}
+
+// Checks if the resource exists and has not been deleted. Resources of types
+// that are not registered are reported as not live.
+func (r *resourceServer) isLive(ctx context.Context, db database, ref resourceRef) (bool, error) {
+	resourceDescriptor := r.resources[ref.resourceType]
+	if resourceDescriptor == nil {
+		return false, nil
+	}
+
+	var live bool
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT delete_time IS NULL FROM %s WHERE name = $1",
+		getResourceTableName(resourceDescriptor),
+	), ref.name).Scan(&live)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return live, err
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Starts a background worker that will permanently remove any resources
+// that have been soft-deleted for longer than the retention period. The
+// purger will check for expired resources on every interval until the
+// server is shutdown. The purger is disabled when the interval is not
+// positive.
+func (r *resourceServer) StartPurger(interval, retention time.Duration) {
+	if interval <= 0 {
+		log.Print("The purger interval is not positive, the purger is disabled")
+		return
+	}
+
+	r.goBackground("purger", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.purgeExpiredResources(ctx, time.Now().Add(-retention)); err != nil && ctx.Err() == nil {
+					log.Printf("failed to purge expired resources: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// Removes any resources from the registered resource tables that were
+// deleted before the provided time. Resources are purged one at a time so
+// watchers are notified of each resource that is removed. Events that were
+// recorded and operations that finished before the provided time are
+// removed as well, along with the webhooks that were sent before the provided
+// time and the changes every outbox sink has received, or that were recorded
+// before the provided time when there are no sinks. Operations that were
+// orphaned by a server that stopped running them are failed.
+func (r *resourceServer) purgeExpiredResources(ctx context.Context, before time.Time) error {
+	for _, resourceDescriptor := range r.ListResourceDescriptors() {
+		res, err := r.database.QueryContext(ctx, fmt.Sprintf(
+			"SELECT name FROM %s WHERE delete_time IS NOT NULL AND delete_time < $1",
+			getResourceTableName(resourceDescriptor),
+		), before.UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		for res.Next() {
+			var name string
+			if err := res.Scan(&name); err != nil {
+				res.Close()
+				return err
+			}
+			names = append(names, name)
+		}
+		res.Close()
+		if err := res.Err(); err != nil {
+			return err
+		}
+
+		var purged int
+		for _, name := range names {
+			_, err := r.PurgeResource(ctx, &serverpb.PurgeResourceRequest{
+				Name:         name,
+				ResourceType: string(resourceDescriptor.FullName()),
+			})
+			switch status.Code(err) {
+			case codes.OK:
+				purged++
+			case codes.NotFound, codes.FailedPrecondition:
+				// Resources that still have finalizers are purged by a
+				// later run once their finalizers have been removed.
+			default:
+				return err
+			}
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired %s resources", purged, resourceDescriptor.FullName())
+		}
+	}
+
+	if err := r.failOrphanedOperations(ctx); err != nil {
+		return err
+	}
+	if _, err := r.database.ExecContext(
+		ctx,
+		"DELETE FROM resource_operation WHERE done AND update_time < $1",
+		before.UTC().Format(time.RFC3339Nano),
+	); err != nil {
+		return err
+	}
+
+	// Webhooks are kept while they are pending so they can still be sent.
+	if _, err := r.database.ExecContext(
+		ctx,
+		"DELETE FROM webhook_delivery WHERE state != $1 AND update_time < $2",
+		serverpb.WebhookDelivery_PENDING.String(),
+		before.UTC().Format(time.RFC3339Nano),
+	); err != nil {
+		return err
+	}
+
+	if err := r.pruneOutbox(ctx, before); err != nil {
+		return err
+	}
+
+	return r.compactEvents(ctx, before)
+}
+
+// Removes the events that were recorded before the provided time. Watches
+// that try to resume from a compacted revision will need to start over.
+func (r *resourceServer) compactEvents(ctx context.Context, before time.Time) error {
+	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var compacted sql.NullInt64
+	if err := tx.QueryRowContext(
+		ctx,
+		"SELECT max(revision) FROM resource_event WHERE create_time < $1",
+		before.UTC().Format(time.RFC3339Nano),
+	).Scan(&compacted); err != nil {
+		return err
+	}
+	if !compacted.Valid {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM resource_event WHERE revision <= $1", compacted.Int64); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE resource_revision SET compacted_revision = $1 WHERE id = 1 AND compacted_revision < $1",
+		compacted.Int64,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
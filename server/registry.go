@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/stackpath/control-plane/server/serverpb"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
@@ -26,8 +27,24 @@ func (r *resourceServer) CreateResourceDescriptor(message proto.Message) error {
 		)
 	}
 
+	// Verify the declared field defaults can be applied to the resource.
+	if err := validateFieldDefaults(message.ProtoReflect(), map[protoreflect.FullName]bool{}); err != nil {
+		return err
+	}
+
+	// Verify the unique constraints are declared on fields that can be unique.
+	if err := validateUniqueFields(resource); err != nil {
+		return err
+	}
+
+	// Compile the validation rules up front so invalid rules are found at startup.
+	validator, err := compileValidationRules(message)
+	if err != nil {
+		return err
+	}
+
 	// Create the table in the database for the resource
-	_, err := r.database.ExecContext(context.TODO(), fmt.Sprintf(`
+	_, err = r.database.ExecContext(context.TODO(), fmt.Sprintf(`
 	CREATE TABLE IF NOT EXISTS %s (
 		uid                  UUID NOT NULL,
 		name                 STRING NOT NULL,
@@ -36,18 +53,81 @@ func (r *resourceServer) CreateResourceDescriptor(message proto.Message) error {
 		create_time          TIMESTAMP,
 		update_time          TIMESTAMP,
 		delete_time          TIMESTAMP,
+		revision             INT NOT NULL DEFAULT 0,
+		generation           INT NOT NULL DEFAULT 0,
 		CONSTRAINT "primary" PRIMARY KEY (uid ASC),
 		CONSTRAINT resource_name_unique UNIQUE (name),
-        FAMILY "primary" (uid, name, parent, create_time, update_time),
+        FAMILY "primary" (uid, name, parent, create_time, update_time, revision, generation),
 		FAMILY "data" (data)
 	)`, getResourceTableName(resource)))
 	if err != nil {
 		return err
 	}
 
+	// Add the version columns to tables that were created before they existed.
+	for _, column := range []string{"revision", "generation"} {
+		if _, err := r.database.ExecContext(context.TODO(), fmt.Sprintf(
+			`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s INT NOT NULL DEFAULT 0 FAMILY "primary"`,
+			getResourceTableName(resource),
+			column,
+		)); err != nil {
+			return err
+		}
+	}
+
+	// Index the labels of resources that were stored before labels were
+	// indexed. Labels that are already indexed are left as they are.
+	if stringMapField(message.ProtoReflect(), "labels") != nil {
+		if _, err := r.database.ExecContext(context.TODO(), fmt.Sprintf(
+			`INSERT INTO resource_label (resource_type, name, key, value)
+			SELECT $1, r.name, l.key, l.value FROM %s AS r, jsonb_each_text(r.data::JSONB -> 'labels') AS l
+			ON CONFLICT DO NOTHING`,
+			getResourceTableName(resource),
+		), string(resource.FullName())); err != nil {
+			return err
+		}
+	}
+
+	// Index the owners of resources that were stored before owners were
+	// indexed. Owners that are already indexed are left as they are.
+	if field := ownerReferencesField(resource); field != nil {
+		if _, err := r.database.ExecContext(context.TODO(), fmt.Sprintf(
+			`INSERT INTO resource_owner (dependent_type, dependent_name, owner_type, owner_name)
+			SELECT $1, r.name, o.value ->> 'resourceType', o.value ->> 'name' FROM %s AS r, jsonb_array_elements(r.data::JSONB -> $2) AS o
+			WHERE COALESCE(o.value ->> 'resourceType', '') != '' AND COALESCE(o.value ->> 'name', '') != ''
+			ON CONFLICT DO NOTHING`,
+			getResourceTableName(resource),
+		), string(resource.FullName()), field.JSONName()); err != nil {
+			return err
+		}
+	}
+
+	// Claim the unique values of resources that were stored before the fields
+	// were unique. Resources that already share a value keep it, the constraint
+	// is enforced once they are updated.
+	for _, field := range uniqueFields(resource) {
+		if _, err := r.database.ExecContext(context.TODO(), fmt.Sprintf(
+			`INSERT INTO resource_unique (resource_type, field, scope, value, name)
+			SELECT $1, $2, CASE WHEN $3 THEN r.parent ELSE '' END, r.data::JSONB ->> $4, r.name FROM %s AS r
+			WHERE COALESCE(r.data::JSONB ->> $4, '') != ''
+			ON CONFLICT DO NOTHING`,
+			getResourceTableName(resource),
+		),
+			string(resource.FullName()),
+			string(field.Name()),
+			getUniqueScope(field) == serverpb.UniqueScope_PARENT,
+			field.JSONName(),
+		); err != nil {
+			return err
+		}
+	}
+
 	// Add the resource message descriptor to our mapping of types that exist.
 	// TODO: Add support for multiple versions
 	r.resources[string(resource.FullName())] = resource
+	if validator != nil {
+		r.validators[string(resource.FullName())] = validator
+	}
 
 	return nil
 }
@@ -3,7 +3,10 @@ package server
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gogo/protobuf/protoc-gen-gogo/generator"
@@ -11,6 +14,7 @@ import (
 	fieldmask_utils "github.com/mennanov/fieldmask-utils"
 	"github.com/stackpath/control-plane/server/serverpb"
 	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -41,7 +45,8 @@ func scanResource(
 ) (*anypb.Any, error) {
 	var uid, name, parent, createTime, updateTime, data string
 	var deleteTime sql.NullString
-	if err := scanner.Scan(&uid, &name, &parent, &createTime, &updateTime, &deleteTime, &data); err != nil {
+	var revision, generation int64
+	if err := scanner.Scan(&uid, &name, &parent, &createTime, &updateTime, &deleteTime, &revision, &generation, &data); err != nil {
 		return nil, err
 	}
 
@@ -81,6 +86,7 @@ func scanResource(
 
 	resourceReflector.Set(resourceFields.ByName("create_time"), protoreflect.ValueOfMessage(timestamppb.New(createTimeParsed).ProtoReflect()))
 	resourceReflector.Set(resourceFields.ByName("update_time"), protoreflect.ValueOfMessage(timestamppb.New(updateTimeParsed).ProtoReflect()))
+	setResourceVersion(resource, revision, generation)
 
 	return anypb.New(resource)
 }
@@ -93,26 +99,48 @@ func scanResource(
 // TODO: Add feature for IMMUTABLE check
 type updaterFunc func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error)
 
+// Runs in the transaction of an atomic update after the resource has been
+// written. Returning an error rolls back the update, so hooks can check the
+// related resources, or write to them, atomically with the update.
+type txHookFunc func(ctx context.Context, tx *writeTx, parent string, updated protoreflect.ProtoMessage) error
+
 // This function will retrieve a resource from the database for updating using the
 // provided function. This function can gurantee that no other updates can be made
 // to the resource while this update is running. An Aborted error will be returned
 // during conflicts. The existing resource will be unmarshalled into its base type.
-func (r *resourceServer) atomicUpdateResource(ctx context.Context, resourceName, resourceType string, updater updaterFunc) (*anypb.Any, error) {
-	// Verify the requested resource type was registered.
-	resourceDescriptor, err := r.GetResourceDescriptor(resourceType)
+// The optional hook is run in the transaction before it is committed.
+func (r *resourceServer) atomicUpdateResource(ctx context.Context, resourceName, resourceType string, operation AdmissionOperation, updater updaterFunc, hook txHookFunc) (*anypb.Any, error) {
+	// Start a database transaction so we can atomically update the resource.
+	tx, err := r.beginWrite(ctx, &sql.TxOptions{})
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	// Grab the reflection of the resource for reference to later
-	resourceFields := resourceDescriptor.Fields()
+	result, err := r.updateResourceInTx(ctx, tx, resourceName, resourceType, operation, updater, hook)
+	if err != nil {
+		return nil, err
+	}
 
-	// Start a database transaction so we can atomically update the resource.
-	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{})
+	if err := r.commitWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Updates the resource in the provided transaction. The resource version of
+// the returned resource is set once the transaction is committed.
+func (r *resourceServer) updateResourceInTx(ctx context.Context, tx *writeTx, resourceName, resourceType string, operation AdmissionOperation, updater updaterFunc, hook txHookFunc) (*anypb.Any, error) {
+	// Verify the requested resource type was registered.
+	resourceDescriptor, err := r.GetResourceDescriptor(resourceType)
 	if err != nil {
 		return nil, err
 	}
 
+	// Grab the reflection of the resource for reference to later
+	resourceFields := resourceDescriptor.Fields()
+
 	// Grab the existing resource from the database. This is run
 	// in the transaction and will hold a lock.
 	existingResource, err := r.getResource(ctx, tx, &serverpb.GetResourceRequest{
@@ -129,8 +157,9 @@ func (r *resourceServer) atomicUpdateResource(ctx context.Context, resourceName,
 		return nil, err
 	}
 
-	// Pass the existing resource so the caller can modify if needed.
-	updatedResource, err := updater(unpacked)
+	// Pass a copy of the existing resource so the caller can modify it
+	// while the original is kept to compare against.
+	updatedResource, err := updater(proto.Clone(unpacked))
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +172,31 @@ func (r *resourceServer) atomicUpdateResource(ctx context.Context, resourceName,
 		return nil, status.Error(codes.Aborted, "resource %q has been modified. please apply your changes to the latest version and try again")
 	}
 
+	// Verify the finalizers of a resource that is being deleted are only
+	// removed by RemoveFinalizer.
+	if err := verifyFinalizers(ctx, unpacked, updatedResource); err != nil {
+		return nil, err
+	}
+
+	// Set the defaults of any fields that have not been populated yet.
+	if err := r.applyDefaults(ctx, unpacked, updatedResource); err != nil {
+		return nil, err
+	}
+
+	// Verify the updated resource satisfies the validation rules of its type.
+	if err := r.validateResource(unpacked, updatedResource); err != nil {
+		return nil, err
+	}
+
+	// Let the admission hooks veto the update before it is stored.
+	parent, err := resourceParent(ctx, tx.Tx, resourceDescriptor, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.admit(ctx, operation, parent, unpacked, updatedResource); err != nil {
+		return nil, err
+	}
+
 	// Set the update timestamp of the resource if the field exists on the message.
 	if updatedField := resourceFields.ByName("update_time"); updatedField != nil {
 		// Set the unique ID of the resource message before it's stored in the database.
@@ -162,9 +216,16 @@ func (r *resourceServer) atomicUpdateResource(ctx context.Context, resourceName,
 		return nil, err
 	}
 
-	// Prepare the database query to insert the resource into the database.
+	// The generation is only incremented when the desired state of the resource changed.
+	var generationIncrement int64
+	if specChanged(unpacked, updatedResource) {
+		generationIncrement = 1
+	}
+
+	// Prepare the database query to insert the resource into the database. The
+	// revision of the resource is set once the transaction is committed.
 	statement, err := tx.PrepareContext(ctx, fmt.Sprintf(
-		"UPDATE %s SET update_time = $1, %s, data = $2 WHERE name = $3",
+		"UPDATE %s SET update_time = $1, %s, data = $2, generation = generation + $4 WHERE name = $3 RETURNING generation",
 		getResourceTableName(updatedResource.ProtoReflect().Descriptor()),
 		getResourceDeletion(updatedResource),
 	))
@@ -172,26 +233,61 @@ func (r *resourceServer) atomicUpdateResource(ctx context.Context, resourceName,
 		return nil, err
 	}
 
-	// Insert the resource into the database
-	updateRes, err := statement.ExecContext(
+	// Update the resource in the database and grab its generation
+	var generation int64
+	if err := statement.QueryRowContext(
 		ctx,
 		updatedResource.ProtoReflect().Get(resourceFields.ByName("update_time")).Message().Interface().(*timestamppb.Timestamp).AsTime().Format(time.RFC3339Nano),
 		reqJson,
 		updatedResource.ProtoReflect().Get(resourceFields.ByName("name")).String(),
-	)
-	if err != nil {
+		generationIncrement,
+	).Scan(&generation); err != nil {
 		return nil, err
 	}
+	setResourceVersion(updatedResource, 0, generation)
 
-	if _, err := updateRes.RowsAffected(); err != nil {
+	// Replace the indexed labels with the labels of the updated resource.
+	if err := storeLabels(ctx, tx.Tx, updatedResource); err != nil {
+		return nil, err
+	}
+	if err := storeUniqueValues(ctx, tx.Tx, parent, updatedResource); err != nil {
+		return nil, err
+	}
+	if err := storeOwners(ctx, tx.Tx, updatedResource); err != nil {
 		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
+	result, err := anypb.New(updatedResource)
+	if err != nil {
 		return nil, err
 	}
 
-	return anypb.New(updatedResource)
+	// Resources that were just soft-deleted are reported as deleted, any
+	// other change including an undelete is reported as a modification.
+	eventType := serverpb.WatchResourcesResponse_MODIFIED
+	deleteTimeField := resourceFields.ByName("delete_time")
+	if !unpacked.ProtoReflect().Has(deleteTimeField) && updatedResource.ProtoReflect().Has(deleteTimeField) {
+		eventType = serverpb.WatchResourcesResponse_DELETED
+	}
+	tx.recordWrite(resourceDescriptor, resourceName, eventType, parent, existingResource, result)
+
+	if hook != nil {
+		if err := hook(ctx, tx, parent, updatedResource); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Returns the parent of the stored resource with the provided name.
+func resourceParent(ctx context.Context, tx *sql.Tx, resourceDescriptor protoreflect.MessageDescriptor, name string) (string, error) {
+	var parent string
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT parent FROM %s WHERE name = $1",
+		getResourceTableName(resourceDescriptor),
+	), name).Scan(&parent)
+	return parent, err
 }
 
 // Provies the correct deletion update query for a provided resouce.
@@ -228,11 +324,9 @@ func updatesConflict(existing, updated protoreflect.ProtoMessage) bool {
 }
 
 func (r *resourceServer) UndeleteResource(ctx context.Context, req *serverpb.UndeleteResourceRequest) (*anypb.Any, error) {
-	return r.atomicUpdateResource(ctx, req.Name, req.ResourceType, func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
-		// Clear the delete_time field to undelete the resource
-		existing.ProtoReflect().Clear(existing.ProtoReflect().Descriptor().Fields().ByName("delete_time"))
-		return existing, nil
-	})
+	// Atomically clear the deletion timestamp of the resource and restore
+	// the descendants that were deleted along with it.
+	return r.atomicUpdateResource(ctx, req.Name, req.ResourceType, AdmissionUndelete, markUndeleted, r.restoreCascade)
 }
 
 func (r *resourceServer) PurgeResource(ctx context.Context, req *serverpb.PurgeResourceRequest) (*serverpb.PurgeResourceResponse, error) {
@@ -242,39 +336,79 @@ func (r *resourceServer) PurgeResource(ctx context.Context, req *serverpb.PurgeR
 		return nil, err
 	}
 
-	// Start a database transactions to ensure that the resource can be created atomically.
-	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{})
+	// Start a database transactions to ensure that the resource can be purged atomically.
+	tx, err := r.beginWrite(ctx, &sql.TxOptions{})
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	// Prepare the database query to insert the resource into the database.
+	if err := r.purgeResourceInTx(ctx, tx, resourceDescriptor, req.Name); err != nil {
+		return nil, err
+	}
+
+	if err := r.commitWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return &serverpb.PurgeResourceResponse{}, nil
+}
+
+// Removes the resource and all of its descendants in the provided transaction.
+// Descendants are purged before their parents.
+func (r *resourceServer) purgeResourceInTx(ctx context.Context, tx *writeTx, resourceDescriptor protoreflect.MessageDescriptor, name string) error {
+	// Grab the last state of the resource so it can be sent to watchers.
+	existing, err := r.getResource(ctx, tx, &serverpb.GetResourceRequest{
+		Name:         name,
+		ResourceType: string(resourceDescriptor.FullName()),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Resources are only purged once the external state tracked by
+	// their finalizers has been cleaned up.
+	unpacked, err := existing.UnmarshalNew()
+	if err != nil {
+		return err
+	}
+	if err := verifyFinalized(unpacked); err != nil {
+		return err
+	}
+
+	if err := r.purgeChildren(ctx, tx, resourceDescriptor, name); err != nil {
+		return err
+	}
+
+	// Prepare the database query to remove the resource from the database.
 	statement, err := tx.PrepareContext(ctx, fmt.Sprintf(
-		"DELETE FROM %s WHERE name = $1",
+		"DELETE FROM %s WHERE name = $1 RETURNING parent",
 		getResourceTableName(resourceDescriptor),
 	))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Delete the resource in the database
-	deleteRes, err := statement.ExecContext(
-		ctx,
-		req.Name,
-	)
-	if err != nil {
-		return nil, err
+	var parent string
+	if err := statement.QueryRowContext(ctx, name).Scan(&parent); err != nil {
+		return err
 	}
-
-	if _, err := deleteRes.RowsAffected(); err != nil {
-		return nil, err
+	if err := deleteLabels(ctx, tx.Tx, resourceDescriptor, name); err != nil {
+		return err
 	}
-
-	if err := tx.Commit(); err != nil {
-		return nil, err
+	if err := deleteUniqueValues(ctx, tx.Tx, resourceDescriptor, name); err != nil {
+		return err
+	}
+	if err := deleteCascades(ctx, tx.Tx, resourceDescriptor, name); err != nil {
+		return err
+	}
+	if err := deleteOwners(ctx, tx.Tx, resourceDescriptor, name); err != nil {
+		return err
 	}
 
-	return &serverpb.PurgeResourceResponse{}, nil
+	tx.recordWrite(resourceDescriptor, name, serverpb.WatchResourcesResponse_PURGED, parent, existing, nil)
+	return nil
 }
 
 // Returns a list of resources that exists with the provided parent
@@ -290,22 +424,72 @@ func (r *resourceServer) ListResources(ctx context.Context, req *serverpb.ListRe
 		req.PageSize = 50
 	}
 
-	// Pull the resources from the database.
-	statement, err := r.database.PrepareContext(
+	// Soft-deleted resources are only returned to callers that are allowed to see them.
+	showDeleted := req.ShowDeleted && hasAdditionalPermission(ctx, "resourcemanager.resources.listDeleted")
+
+	// Only return the resources that changed after the provided resource version.
+	sinceRevision, err := parseResourceVersion("since_resource_version", req.SinceResourceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := parseLabelSelector("label_selector", req.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resources are listed in the order of their names so the page token
+	// can resume after the last resource of the previous page.
+	pageStart, err := parsePageToken(req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the revision and the resources in the same transaction so the
+	// resources are consistent with the returned resource version.
+	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	revision, err := currentRevision(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"r.parent = $1", "(r.delete_time IS NULL OR $2)", "r.name > $3"}
+	args := []interface{}{req.Parent, showDeleted, pageStart}
+
+	// Resources written before revisions were tracked have a zero revision,
+	// so they are only left out when a resource version was requested.
+	if req.SinceResourceVersion != "" {
+		args = append(args, sinceRevision)
+		conditions = append(conditions, fmt.Sprintf("r.revision > $%d", len(args)))
+	}
+	selectorConditions, args := selector.sqlConditions(string(resourceDescriptor.FullName()), "r", args)
+	conditions = append(conditions, selectorConditions...)
+
+	// Pull the resources from the database. One extra resource is read to
+	// find out if there is another page of resources.
+	statement, err := tx.PrepareContext(
 		ctx,
 		fmt.Sprintf(
-			"SELECT uid, name, parent, create_time, update_time, data FROM %s WHERE parent = $1 LIMIT %d",
+			"SELECT %s FROM %s AS r WHERE %s ORDER BY r.name LIMIT %d",
+			resourceColumns,
 			getResourceTableName(resourceDescriptor),
-			req.PageSize,
+			strings.Join(conditions, " AND "),
+			req.PageSize+1,
 		),
 	)
 	if err != nil {
 		return nil, err
 	}
-	res, err := statement.QueryContext(ctx, req.Parent)
+	res, err := statement.QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Close()
 
 	var resources []*anypb.Any
 	// Verify we actually got a result from the database
@@ -317,14 +501,57 @@ func (r *resourceServer) ListResources(ctx context.Context, req *serverpb.ListRe
 
 		resources = append(resources, resource)
 	}
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	var nextPageToken string
+	if len(resources) > int(req.PageSize) {
+		resources = resources[:req.PageSize]
+		lastName, err := resourceName(resources[len(resources)-1])
+		if err != nil {
+			return nil, err
+		}
+		nextPageToken = base64.RawURLEncoding.EncodeToString([]byte(lastName))
+	}
 
 	return &serverpb.ListResourcesResponse{
-		Resources: resources,
+		Resources:       resources,
+		NextPageToken:   nextPageToken,
+		ResourceVersion: strconv.FormatInt(revision, 10),
 	}, nil
 }
 
+// Returns the name of the last resource of the previous page from the page
+// token. An empty name will be returned for the first page.
+func parsePageToken(token string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", invalidPageTokenError()
+	}
+	return string(name), nil
+}
+
+func invalidPageTokenError() error {
+	errStatus, _ := status.New(codes.InvalidArgument, "invalid page token").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{
+				Field:       "page_token",
+				Description: "The page token must be the next_page_token of a previous list response",
+			},
+		},
+	})
+	return errStatus.Err()
+}
+
 type database interface {
 	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
 }
 
 func (r *resourceServer) getResource(ctx context.Context, db database, req *serverpb.GetResourceRequest) (*anypb.Any, error) {
@@ -337,7 +564,8 @@ func (r *resourceServer) getResource(ctx context.Context, db database, req *serv
 	statement, err := db.PrepareContext(
 		ctx,
 		fmt.Sprintf(
-			"SELECT uid, name, parent, create_time, update_time, delete_time, data FROM %s WHERE name = $1",
+			"SELECT %s FROM %s WHERE name = $1",
+			resourceColumns,
 			getResourceTableName(resourceDescriptor),
 		),
 	)
@@ -367,6 +595,45 @@ func (r *resourceServer) CreateResource(ctx context.Context, req *serverpb.Creat
 		return nil, err
 	}
 
+	name, err := resourceName(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.mutateResource(ctx, req.Resource.TypeUrl, name, AdmissionCreate, func(ctx context.Context) (*anypb.Any, error) {
+		return r.createResource(ctx, req)
+	})
+}
+
+// Creates the resource of a registered resource type.
+func (r *resourceServer) createResource(ctx context.Context, req *serverpb.CreateResourceRequest) (*anypb.Any, error) {
+	// Start a database transactions to ensure that the resource can be created atomically.
+	tx, err := r.beginWrite(ctx, &sql.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := r.createResourceInTx(ctx, tx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.commitWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Creates the resource in the provided transaction. The resource version of
+// the returned resource is set once the transaction is committed.
+func (r *resourceServer) createResourceInTx(ctx context.Context, tx *writeTx, req *serverpb.CreateResourceRequest) (*anypb.Any, error) {
+	// Verify that the provided resource was registered with the server.
+	if err := r.assertRegisteredAnyResource(req.Resource); err != nil {
+		return nil, err
+	}
+
 	resource, err := anypb.UnmarshalNew(req.Resource, proto.UnmarshalOptions{})
 	if err != nil {
 		return nil, err
@@ -387,6 +654,21 @@ func (r *resourceServer) CreateResource(ctx context.Context, req *serverpb.Creat
 		resourceReflector.Set(updatedField, protoreflect.ValueOfMessage(timestamppb.Now().ProtoReflect()))
 	}
 
+	// Set the defaults of the fields the caller did not provide.
+	if err := r.applyDefaults(ctx, nil, resource); err != nil {
+		return nil, err
+	}
+
+	// Verify the resource satisfies the validation rules of its type.
+	if err := r.validateResource(nil, resource); err != nil {
+		return nil, err
+	}
+
+	// Let the admission hooks veto the resource before it is stored.
+	if err := r.admit(ctx, AdmissionCreate, req.Parent, nil, resource); err != nil {
+		return nil, err
+	}
+
 	// Convert the resource into an Any type so we can store
 	// it in the database with it's type information
 	anyResource, err := anypb.New(clearOutputOnlyFields(resource))
@@ -400,9 +682,9 @@ func (r *resourceServer) CreateResource(ctx context.Context, req *serverpb.Creat
 		return nil, err
 	}
 
-	// Start a database transactions to ensure that the resource can be created atomically.
-	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{})
-	if err != nil {
+	// Verify the parent of the resource exists in the same transaction
+	// so it can not be deleted before the resource is created.
+	if err := r.verifyParent(ctx, tx.Tx, resourceReflector.Descriptor(), req.Parent); err != nil {
 		return nil, err
 	}
 
@@ -417,9 +699,13 @@ func (r *resourceServer) CreateResource(ctx context.Context, req *serverpb.Creat
 		return nil, status.Error(codes.AlreadyExists, "Resource already exists")
 	}
 
+	// New resources always start out at the first generation. The revision
+	// of the resource is set once the transaction is committed.
+	setResourceVersion(resource, 0, 1)
+
 	// Prepare the database query to insert the resource into the database.
 	statement, err := tx.PrepareContext(ctx, fmt.Sprintf(
-		"INSERT INTO %s (uid, name, parent, create_time, update_time, data) VALUES ($1, $2, $3, $4, $5, $6)",
+		"INSERT INTO %s (uid, name, parent, create_time, update_time, revision, generation, data) VALUES ($1, $2, $3, $4, $5, 0, 1, $6)",
 		getResourceTableName(resource.ProtoReflect().Descriptor()),
 	))
 	if err != nil {
@@ -444,11 +730,25 @@ func (r *resourceServer) CreateResource(ctx context.Context, req *serverpb.Creat
 		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
+	// Index the labels of the resource for label selectors.
+	if err := storeLabels(ctx, tx.Tx, resource); err != nil {
+		return nil, err
+	}
+	if err := storeUniqueValues(ctx, tx.Tx, req.Parent, resource); err != nil {
+		return nil, err
+	}
+	if err := storeOwners(ctx, tx.Tx, resource); err != nil {
 		return nil, err
 	}
 
-	return anypb.New(resource)
+	result, err := anypb.New(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.recordWrite(resourceReflector.Descriptor(), resourceReflector.Get(resourceFields.ByName("name")).String(), serverpb.WatchResourcesResponse_ADDED, req.Parent, nil, result)
+
+	return result, nil
 }
 
 // Get the value of the name field from the resource. Name field
@@ -468,48 +768,71 @@ func (r *resourceServer) UpdateResource(ctx context.Context, req *serverpb.Updat
 		return nil, err
 	}
 
+	return r.mutateResource(ctx, req.Resource.TypeUrl, name, AdmissionUpdate, func(ctx context.Context) (*anypb.Any, error) {
+		return r.updateResource(ctx, name, req)
+	})
+}
+
+// Updates the existing resource with the fields in the update mask.
+func (r *resourceServer) updateResource(ctx context.Context, name string, req *serverpb.UpdateResourceRequest) (*anypb.Any, error) {
 	// Atomically update a resource and return an error on conflict.
-	return r.atomicUpdateResource(ctx, name, req.Resource.TypeUrl, func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
-		// Generate a field mask from the update mask that was provided
-		mask, err := fieldmask_utils.MaskFromProtoFieldMask(req.UpdateMask, generator.CamelCase)
-		if err != nil {
-			return nil, err
-		}
+	return r.atomicUpdateResource(ctx, name, req.Resource.TypeUrl, AdmissionUpdate, updateMaskUpdater(req), nil)
+}
 
-		updatedResource, err := req.Resource.UnmarshalNew()
+// Returns an updater that merges the fields in the update mask of the
+// request into the existing resource. The fields of the request that are not
+// in the mask are ignored, so only the fields that were authorized as written
+// are changed. Requests without a mask replace the whole resource.
+func updateMaskUpdater(req *serverpb.UpdateResourceRequest) updaterFunc {
+	return func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
+		requested, err := req.Resource.UnmarshalNew()
 		if err != nil {
 			return nil, err
 		}
+		if len(req.GetUpdateMask().GetPaths()) == 0 {
+			return requested, nil
+		}
 
-		existingResource, err := req.Resource.UnmarshalNew()
+		// Generate a field mask from the update mask that was provided
+		mask, err := fieldmask_utils.MaskFromProtoFieldMask(req.UpdateMask, generator.CamelCase)
 		if err != nil {
 			return nil, err
 		}
 
-		// Merge the requested resource and the existing resource together.
-		if err := fieldmask_utils.StructToStruct(mask, updatedResource, existingResource); err != nil {
+		// Copy the masked fields of the requested resource into the existing resource.
+		if err := fieldmask_utils.StructToStruct(mask, requested, existing); err != nil {
 			return nil, err
 		}
 
-		return updatedResource, nil
-	})
+		return existing, nil
+	}
 }
 
 func (r *resourceServer) DeleteResource(ctx context.Context, req *serverpb.DeleteResourceRequest) (*anypb.Any, error) {
-	// Atomically set the deletion timestamp of the resource.
-	return r.atomicUpdateResource(ctx, req.Name, req.ResourceType, func(existing protoreflect.ProtoMessage) (protoreflect.ProtoMessage, error) {
-		fmt.Printf("%+#v\n", existing)
-		// Set the deletion timestamp on the resource
-		existing.ProtoReflect().Set(
-			// Assume that the resource has a delete_time field defined.
-			existing.ProtoReflect().Descriptor().Fields().ByName("delete_time"),
-			// Set to the current timestamp.
-			protoreflect.ValueOfMessage(timestamppb.Now().ProtoReflect()),
-		)
-		return existing, nil
+	return r.mutateResource(ctx, req.ResourceType, req.Name, AdmissionDelete, func(ctx context.Context) (*anypb.Any, error) {
+		return r.deleteResource(ctx, req)
 	})
 }
 
+// Soft-deletes the resource, along with its descendants when forced.
+func (r *resourceServer) deleteResource(ctx context.Context, req *serverpb.DeleteResourceRequest) (*anypb.Any, error) {
+	// Atomically set the deletion timestamp of the resource.
+	return r.atomicUpdateResource(ctx, req.Name, req.ResourceType, AdmissionDelete, markDeleted, r.deleteHook(req))
+}
+
+// Returns the hook that checks the children of the resource that is being
+// deleted, or deletes them along with the resource when forced.
+func (r *resourceServer) deleteHook(req *serverpb.DeleteResourceRequest) txHookFunc {
+	return func(ctx context.Context, tx *writeTx, parent string, updated protoreflect.ProtoMessage) error {
+		// Parents can only be deleted once their children have been deleted,
+		// unless the caller forces the children to be deleted along with it.
+		if !req.Force {
+			return r.verifyNoLiveChildren(ctx, tx.Tx, updated.ProtoReflect().Descriptor(), req.Name)
+		}
+		return r.cascadeDelete(ctx, tx, updated.ProtoReflect().Descriptor(), req.Name, updated.ProtoReflect().Descriptor(), req.Name, 1)
+	}
+}
+
 // This function will return a cloned proto message that has any fields
 // with an OUTPUT_ONLY behavior cleared.
 func clearOutputOnlyFields(resource proto.Message) proto.Message {
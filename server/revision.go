@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// The columns that are selected when reading resources, in the order
+// that scanResource expects them.
+const resourceColumns = "uid, name, parent, create_time, update_time, delete_time, revision, generation, data"
+
+// Fields that describe a resource rather than its desired state. Changes
+// to these fields do not increment the generation of a resource.
+var metadataFields = []protoreflect.Name{
+	"name",
+	"uid",
+	"etag",
+	"labels",
+	"annotations",
+	"finalizers",
+	"owner_references",
+	"create_time",
+	"update_time",
+	"delete_time",
+	"generation",
+	"resource_version",
+}
+
+// A transaction that writes resources. The writes are only assigned their
+// revisions when the transaction is committed, so the lock on the revision
+// row is not held while the admission hooks, cascades and other checks of
+// the writes run.
+type writeTx struct {
+	*sql.Tx
+
+	// The writes that are waiting for their revisions, in the order
+	// they were made.
+	writes []pendingWrite
+}
+
+// A write to a resource that is assigned a revision once the transaction
+// it was made in is committed.
+type pendingWrite struct {
+	resource  protoreflect.MessageDescriptor
+	name      string
+	eventType serverpb.WatchResourcesResponse_EventType
+	parent    string
+	// The state of the resource before and after the write. The state after
+	// the write is stamped with the revision of the write, so callers that
+	// return it to clients will see the resource version of the write. The
+	// state after is nil for resources that were purged.
+	before, after *anypb.Any
+}
+
+// Starts a transaction that writes resources. The transaction must be
+// committed with commitWrite.
+func (r *resourceServer) beginWrite(ctx context.Context, opts *sql.TxOptions) (*writeTx, error) {
+	tx, err := r.database.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &writeTx{Tx: tx}, nil
+}
+
+// Queues the change of a write to a resource until the transaction is committed.
+func (tx *writeTx) recordWrite(resource protoreflect.MessageDescriptor, name string, eventType serverpb.WatchResourcesResponse_EventType, parent string, before, after *anypb.Any) {
+	tx.writes = append(tx.writes, pendingWrite{
+		resource:  resource,
+		name:      name,
+		eventType: eventType,
+		parent:    parent,
+		before:    before,
+		after:     after,
+	})
+}
+
+// Returns a savepoint that the writes can be rolled back to when the
+// statements made since the savepoint are rolled back.
+func (tx *writeTx) savepoint() int {
+	return len(tx.writes)
+}
+
+// Drops the writes that were made after the savepoint.
+func (tx *writeTx) rollbackTo(savepoint int) {
+	tx.writes = tx.writes[:savepoint]
+}
+
+// Assigns the revisions of the writes in the order they were made, records
+// their changes and commits the transaction. Watchers are notified once the
+// transaction has been committed.
+//
+// The revisions are taken from a single row that stays locked until the
+// transaction is done, so revisions are assigned in the order the transactions
+// commit. Only the statements that stamp the writes with their revisions run
+// while the lock is held, which keeps the time other writers wait on the lock
+// short regardless of how long the rest of the transaction took.
+func (r *resourceServer) commitWrite(ctx context.Context, tx *writeTx) error {
+	if len(tx.writes) > 0 {
+		var last int64
+		if err := tx.QueryRowContext(
+			ctx,
+			"UPDATE resource_revision SET revision = revision + $1 WHERE id = 1 RETURNING revision",
+			len(tx.writes),
+		).Scan(&last); err != nil {
+			return err
+		}
+
+		// Resources that are written more than once in the transaction
+		// were read with the revision they had before the transaction.
+		revisions := map[string]int64{}
+		for i, write := range tx.writes {
+			revision := last - int64(len(tx.writes)-1-i)
+			key := string(write.resource.FullName()) + "/" + write.name
+
+			if previous, ok := revisions[key]; ok && write.before != nil {
+				if err := stampRevision(write.before, previous); err != nil {
+					return err
+				}
+			}
+			if write.after != nil {
+				if err := stampRevision(write.after, revision); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+					"UPDATE %s SET revision = $1 WHERE name = $2",
+					getResourceTableName(write.resource),
+				), revision, write.name); err != nil {
+					return err
+				}
+			}
+			revisions[key] = revision
+
+			if err := r.recordChange(ctx, tx.Tx, revision, write.eventType, write.parent, write.before, write.after); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(tx.writes) > 0 {
+		r.events.notify()
+	}
+	return nil
+}
+
+// Sets the resource version of the packed resource to the revision.
+func stampRevision(resource *anypb.Any, revision int64) error {
+	unpacked, err := resource.UnmarshalNew()
+	if err != nil {
+		return err
+	}
+	if field := unpacked.ProtoReflect().Descriptor().Fields().ByName("resource_version"); field != nil && field.Kind() == protoreflect.StringKind {
+		unpacked.ProtoReflect().Set(field, protoreflect.ValueOfString(strconv.FormatInt(revision, 10)))
+	}
+	return resource.MarshalFrom(unpacked)
+}
+
+// Returns the latest revision of the resources.
+func currentRevision(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var revision int64
+	err := tx.QueryRowContext(ctx, "SELECT revision FROM resource_revision WHERE id = 1").Scan(&revision)
+	return revision, err
+}
+
+// Parses a resource version that was provided in the named request field. An
+// empty resource version is parsed as the zero revision, and an InvalidArgument
+// error will be returned when the resource version is not valid.
+func parseResourceVersion(field, resourceVersion string) (int64, error) {
+	if resourceVersion == "" {
+		return 0, nil
+	}
+
+	revision, err := strconv.ParseInt(resourceVersion, 10, 64)
+	if err != nil || revision < 0 {
+		errStatus, _ := status.New(codes.InvalidArgument, "invalid resource version").WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{
+					Field:       field,
+					Description: fmt.Sprintf("Resource version %q is not valid", resourceVersion),
+				},
+			},
+		})
+		return 0, errStatus.Err()
+	}
+	return revision, nil
+}
+
+// Sets the optional generation and resource_version fields on the resource
+// when the resource defines them. The resource version is the revision of
+// the last write to the resource formatted as a string.
+func setResourceVersion(resource proto.Message, revision, generation int64) {
+	reflector := resource.ProtoReflect()
+	fields := reflector.Descriptor().Fields()
+
+	if field := fields.ByName("generation"); field != nil && field.Kind() == protoreflect.Int64Kind {
+		reflector.Set(field, protoreflect.ValueOfInt64(generation))
+	}
+	if field := fields.ByName("resource_version"); field != nil && field.Kind() == protoreflect.StringKind {
+		reflector.Set(field, protoreflect.ValueOfString(strconv.FormatInt(revision, 10)))
+	}
+}
+
+// Checks if an update changed the desired state of a resource. Output only
+// fields and metadata fields are ignored when comparing the resources.
+func specChanged(existing, updated proto.Message) bool {
+	existing = clearOutputOnlyFields(existing)
+	updated = clearOutputOnlyFields(updated)
+
+	for _, name := range metadataFields {
+		if field := existing.ProtoReflect().Descriptor().Fields().ByName(name); field != nil {
+			existing.ProtoReflect().Clear(field)
+			updated.ProtoReflect().Clear(field)
+		}
+	}
+	return !proto.Equal(existing, updated)
+}
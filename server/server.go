@@ -1,9 +1,15 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -16,6 +22,10 @@ type API interface {
 	// for any registered resource descriptors.
 	serverpb.ResourcesServer
 
+	// Manages the long-running operations that are started by the
+	// mutations of resource types that run them in the background.
+	longrunning.OperationsServer
+
 	// Registers a new resource descriptor on the server
 	CreateResourceDescriptor(message proto.Message) error
 
@@ -23,23 +33,162 @@ type API interface {
 	GetResourceDescriptor(resourceType string) (protoreflect.MessageDescriptor, error)
 
 	ListResourceDescriptors() []protoreflect.MessageDescriptor
+
+	// Evaluates the permissions principals have been granted
+	// through role bindings and IAM policies.
+	Authorizer
+
+	// Registers a role that bundles a set of permissions
+	CreateRole(name string, permissions []string) error
+
+	// Checks if an IAM policy has been set on any resource.
+	HasIamPolicies(ctx context.Context) (bool, error)
+
+	// Adds a role binding that is applied in addition to
+	// the IAM policies set through the API.
+	CreateRoleBinding(binding RoleBinding) error
+
+	// Registers an admission hook that can deny writes to
+	// resources before they are committed.
+	CreateAdmissionHook(config AdmissionHookConfig) error
+
+	// Registers a defaulter that sets the default values of a
+	// resource type before the resource is validated and stored.
+	CreateDefaulter(resourceType string, defaulter Defaulter) error
+
+	// Creates the tables the server uses to store data that is not
+	// specific to a registered resource, such as IAM policies.
+	Migrate(ctx context.Context) error
+
+	// Starts the background purger that will permanently remove soft-deleted
+	// resources once they have been deleted for longer than the retention period.
+	// The purger is disabled when the interval is not positive.
+	StartPurger(interval, retention time.Duration)
+
+	// Starts the background garbage collector that will delete resources
+	// once all of the owners in their owner references have been deleted.
+	// The garbage collector is disabled when the interval is not positive.
+	StartGarbageCollector(interval time.Duration)
+
+	// Starts a background worker that delivers the changes made to resources
+	// to the sink. Changes are delivered at least once and in the order they
+	// were committed. The name identifies the sink across restarts.
+	StartDispatcher(name string, sink OutboxSink)
+
+	// Registers the WebhookSubscription resource and starts sending webhooks
+	// to the subscriptions when the resources they subscribe to change.
+	StartWebhooks(config WebhookConfig) error
+
+	// Stops any open watches and signals the background workers to stop so
+	// the gRPC server can be gracefully stopped. Watchers receive an
+	// Unavailable error and can resume watching on another server. Running
+	// operations are left to finish, but no new operations are started.
+	Drain()
+
+	// Stops any background workers that were started by the server, waits for
+	// them and any running operations to finish and closes the database
+	// connection pool. The provided context can be used to set a deadline on
+	// how long to wait for the workers to drain. Operations that are still
+	// running once the context is done are cancelled.
+	Shutdown(ctx context.Context) error
 }
 
 // Creates a new API with no registered resources
 func New(db *sql.DB) API {
+	ctx, cancel := context.WithCancel(context.Background())
+	operationsCtx, cancelOperations := context.WithCancel(context.Background())
 	return &resourceServer{
-		database:  db,
-		resources: make(map[string]protoreflect.MessageDescriptor),
+		database:   db,
+		resources:  make(map[string]protoreflect.MessageDescriptor),
+		roles:      predefinedRoles(),
+		bindings:   make(map[string][]RoleBinding),
+		defaulters: make(map[string][]Defaulter),
+		validators: make(map[string]*resourceValidator),
+		operations: make(map[string]context.CancelFunc),
+		ctx:        ctx,
+		cancel:     cancel,
+
+		operationsCtx:    operationsCtx,
+		cancelOperations: cancelOperations,
+	}
+}
+
+// Configures the gRPC server that is created by GRPCAPI.
+type GRPCOption func(*grpcConfig)
+
+type grpcConfig struct {
+	serverOptions  []grpc.ServerOption
+	authenticators []Authenticator
+	authorizer     Authorizer
+	// How often the permissions of long-lived streams are re-checked.
+	streamAuthorizationInterval time.Duration
+}
+
+// Applies the provided server options, such as the transport credentials
+// created by NewTLSCredentials, to the gRPC server.
+func WithServerOptions(opts ...grpc.ServerOption) GRPCOption {
+	return func(c *grpcConfig) {
+		c.serverOptions = append(c.serverOptions, opts...)
 	}
 }
 
-func GRPCAPI(backend API) (*grpc.Server, error) {
-	grpcServer := grpc.NewServer(
+// Sets the authenticators that are used to determine the calling principal.
+// The authenticators are tried in order until one succeeds. All callers are
+// treated as allUsers when no authenticators are provided.
+func WithAuthenticators(authenticators ...Authenticator) GRPCOption {
+	return func(c *grpcConfig) {
+		c.authenticators = append(c.authenticators, authenticators...)
+	}
+}
+
+// Sets the authorizer that is used to verify the calling principal has the
+// permissions required by the RPC methods. Authorization checks are skipped
+// when no authorizer is provided.
+func WithAuthorizer(authorizer Authorizer) GRPCOption {
+	return func(c *grpcConfig) {
+		c.authorizer = authorizer
+	}
+}
+
+// Sets how often the permissions of the caller are re-checked on long-lived
+// streams so that streams are terminated when access has been revoked.
+// Streams are re-checked every minute by default.
+func WithStreamAuthorizationInterval(interval time.Duration) GRPCOption {
+	return func(c *grpcConfig) {
+		c.streamAuthorizationInterval = interval
+	}
+}
+
+// Creates a new gRPC server for the provided API. An error is returned when
+// IAM policies have been set on resources but no authorizer is provided, since
+// the policies would silently not be enforced.
+func GRPCAPI(backend API, opts ...GRPCOption) (*grpc.Server, error) {
+	config := &grpcConfig{
+		streamAuthorizationInterval: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	if config.authorizer == nil {
+		hasPolicies, err := backend.HasIamPolicies(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for IAM policies: %v", err)
+		}
+		if hasPolicies {
+			return nil, errors.New("IAM policies have been set on resources, but no authorizer was provided to enforce them")
+		}
+	}
+
+	grpcServer := grpc.NewServer(append(
+		config.serverOptions,
 		// Add the interceptors that are necessary for the server
-		grpc.ChainUnaryInterceptor(authUnaryInterceptor()),
-	)
+		grpc.ChainUnaryInterceptor(authUnaryInterceptor(config.authenticators, config.authorizer)),
+		grpc.ChainStreamInterceptor(authStreamInterceptor(config.authenticators, config.authorizer, config.streamAuthorizationInterval)),
+	)...)
 
 	serverpb.RegisterResourcesServer(grpcServer, backend)
+	longrunning.RegisterOperationsServer(grpcServer, backend)
 
 	return grpcServer, nil
 }
@@ -50,4 +199,43 @@ type resourceServer struct {
 	// of the annotation that was specified on the resource.
 	resources map[string]protoreflect.MessageDescriptor
 	database  *sql.DB
+
+	// The roles that have been registered with the server mapped by
+	// the role name, and the role bindings that have been created on
+	// the server mapped by the resource name they apply to.
+	roles    map[string][]string
+	bindings map[string][]RoleBinding
+
+	// The admission hooks that are called before writes are
+	// committed, in the order they were registered.
+	admissionHooks []AdmissionHookConfig
+
+	// The defaulters that have been registered mapped by resource type.
+	defaulters map[string][]Defaulter
+
+	// The compiled validation rules of the resource types
+	// that declare them, mapped by resource type.
+	validators map[string]*resourceValidator
+
+	// Cancels the long-running operations that are running on the
+	// server, mapped by the name of the operation.
+	operations   map[string]context.CancelFunc
+	operationsMu sync.Mutex
+	// Set once the server is drained so that no new operations are started.
+	draining bool
+	// The context that operations run with. The context is only cancelled
+	// when the operations do not finish before the server is shutdown.
+	operationsCtx    context.Context
+	cancelOperations context.CancelFunc
+
+	// Notifies open watches when changes to resources have been committed.
+	events eventBroadcaster
+
+	// The context that background workers and watches run with. The
+	// context is cancelled when the server is drained or shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Tracks the background workers that are running so the server
+	// can wait for them to drain during a shutdown.
+	workers sync.WaitGroup
 }
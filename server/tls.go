@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// TLSConfig contains the files that should be used to terminate TLS
+// connections on the gRPC listener.
+type TLSConfig struct {
+	// The PEM encoded certificate and private key that should be
+	// presented to clients.
+	CertFile string
+	KeyFile  string
+
+	// An optional PEM encoded bundle of certificate authorities that client
+	// certificates should be verified against. Client certificates will not be
+	// requested when no bundle is provided.
+	ClientCAFile string
+
+	// Rejects any connections that do not present a client certificate signed
+	// by one of the authorities in the ClientCAFile.
+	RequireClientCert bool
+}
+
+// The application protocol gRPC connections negotiate with ALPN.
+const alpnProtocol = "h2"
+
+// Creates new transport credentials for a gRPC server using the provided TLS
+// configuration. The certificate files are checked for changes as new
+// connections are made so that rotated certificates are used without a
+// restart of the server.
+func NewTLSCredentials(cfg TLSConfig) (credentials.TransportCredentials, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("a certificate and key file are required for TLS")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("a client CA file is required to verify client certificates")
+	}
+
+	reloader := &certificateReloader{config: cfg}
+	// Load the certificates up front so misconfigurations are found at startup.
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.tlsConfig()
+		},
+	}), nil
+}
+
+// Keeps track of the certificates loaded from disk and reloads
+// them when the files have been modified.
+type certificateReloader struct {
+	config TLSConfig
+
+	mu          sync.Mutex
+	modTimes    map[string]time.Time
+	certificate tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// Returns the TLS configuration to use for a new connection, reloading
+// the certificates from disk when they have changed. The last successfully
+// loaded certificates are used when the reload fails, which can happen when
+// the files are read in the middle of a rotation.
+func (c *certificateReloader) tlsConfig() (*tls.Config, error) {
+	if err := c.reload(); err != nil {
+		c.mu.Lock()
+		loaded := c.modTimes != nil
+		c.mu.Unlock()
+		if !loaded {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The config replaces the one created by credentials.NewTLS for the
+	// connection, so HTTP/2 has to be offered again for ALPN to negotiate it.
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{c.certificate},
+		NextProtos:   []string{alpnProtocol},
+	}
+	if c.clientCAs != nil {
+		config.ClientCAs = c.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.config.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// Loads the certificates from disk when any of the files have been
+// modified since they were last loaded.
+func (c *certificateReloader) reload() error {
+	files := []string{c.config.CertFile, c.config.KeyFile}
+	if c.config.ClientCAFile != "" {
+		files = append(files, c.config.ClientCAFile)
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !filesModified(c.modTimes, modTimes) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		bundle, err := ioutil.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("no certificates found in client CA file %q", c.config.ClientCAFile)
+		}
+	}
+
+	c.certificate = certificate
+	c.clientCAs = clientCAs
+	c.modTimes = modTimes
+	return nil
+}
+
+// Checks if any of the files have a different modification time
+// than when they were last loaded.
+func filesModified(previous, current map[string]time.Time) bool {
+	if previous == nil {
+		return true
+	}
+	for file, modTime := range current {
+		if !previous[file].Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the verified certificate the client presented when connecting to
+// the server. Nil will be returned when the client did not present a
+// certificate or the connection is not using TLS.
+func clientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+
+	// Only trust certificates that were verified against the client CA
+	// bundle. The first certificate in the chain is the client's leaf.
+	for _, chain := range tlsInfo.State.VerifiedChains {
+		if len(chain) > 0 {
+			return chain[0]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func (r *resourceServer) Transact(ctx context.Context, req *serverpb.TransactRequest) (*serverpb.TransactResponse, error) {
+	if err := validateBatchSize("operations", len(req.Operations)); err != nil {
+		return nil, err
+	}
+
+	// Start a database transaction so all of the operations are committed
+	// together, or not at all.
+	tx, err := r.beginWrite(ctx, &sql.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	resp := &serverpb.TransactResponse{}
+	for i, operation := range req.Operations {
+		resource, err := r.transactOperation(ctx, tx, operation)
+		if err != nil {
+			return nil, batchRequestError("operations", i, err)
+		}
+		resp.Resources = append(resp.Resources, resource)
+	}
+
+	if err := r.commitWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Makes the operation of a transaction in the provided transaction.
+func (r *resourceServer) transactOperation(ctx context.Context, tx *writeTx, operation *serverpb.TransactOperation) (*anypb.Any, error) {
+	switch op := operation.Operation.(type) {
+	case *serverpb.TransactOperation_Create:
+		return r.createResourceInTx(ctx, tx, op.Create)
+	case *serverpb.TransactOperation_Update:
+		name, err := resourceName(op.Update.Resource)
+		if err != nil {
+			return nil, err
+		}
+		return r.updateResourceInTx(ctx, tx, name, op.Update.Resource.TypeUrl, AdmissionUpdate, updateMaskUpdater(op.Update), nil)
+	case *serverpb.TransactOperation_Delete:
+		return r.updateResourceInTx(ctx, tx, op.Delete.Name, op.Delete.ResourceType, AdmissionDelete, markDeleted, r.deleteHook(op.Delete))
+	case *serverpb.TransactOperation_AssertEtag:
+		return r.assertEtag(ctx, tx, op.AssertEtag, operation.Etag)
+	}
+	return nil, status.Error(codes.InvalidArgument, "one of create, update, delete or assert_etag must be provided")
+}
+
+// Verifies the resource has the provided etag and returns the resource. The
+// etag is compared against the resource version of the resource, which the
+// server changes on every write, rather than an `etag` field that clients can
+// set to any value. An Aborted error will be returned when the resource has a
+// different resource version.
+func (r *resourceServer) assertEtag(ctx context.Context, tx *writeTx, req *serverpb.GetResourceRequest, etag string) (*anypb.Any, error) {
+	existing, err := r.getResource(ctx, tx, req)
+	if err != nil {
+		return nil, err
+	}
+	unpacked, err := existing.UnmarshalNew()
+	if err != nil {
+		return nil, err
+	}
+
+	field := unpacked.ProtoReflect().Descriptor().Fields().ByName("resource_version")
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s resources do not have a resource version", unpacked.ProtoReflect().Descriptor().FullName())
+	}
+	if unpacked.ProtoReflect().Get(field).String() != etag {
+		return nil, status.Errorf(codes.Aborted, "resource %q has been modified, its resource version is no longer %q", req.Name, etag)
+	}
+	return existing, nil
+}
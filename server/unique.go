@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Returns the scope of the unique constraint that is declared on a field.
+// UNIQUE_SCOPE_UNSPECIFIED will be returned when the field is not unique.
+func getUniqueScope(field protoreflect.FieldDescriptor) serverpb.UniqueScope {
+	if !proto.HasExtension(field.Options(), serverpb.E_Unique) {
+		return serverpb.UniqueScope_UNIQUE_SCOPE_UNSPECIFIED
+	}
+	return proto.GetExtension(field.Options(), serverpb.E_Unique).(serverpb.UniqueScope)
+}
+
+// Returns the fields of the resource that are declared unique.
+func uniqueFields(resource protoreflect.MessageDescriptor) []protoreflect.FieldDescriptor {
+	var unique []protoreflect.FieldDescriptor
+	fields := resource.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if getUniqueScope(fields.Get(i)) != serverpb.UniqueScope_UNIQUE_SCOPE_UNSPECIFIED {
+			unique = append(unique, fields.Get(i))
+		}
+	}
+	return unique
+}
+
+// Verifies the unique constraints declared on the resource are on fields
+// that can be unique.
+func validateUniqueFields(resource protoreflect.MessageDescriptor) error {
+	for _, field := range uniqueFields(resource) {
+		if field.Kind() != protoreflect.StringKind || field.IsList() || field.IsMap() {
+			return fmt.Errorf("unique constraint on field %s: only singular string fields can be unique", field.FullName())
+		}
+	}
+	return nil
+}
+
+// Claims the values of the unique fields of the resource for it and releases
+// any values it no longer has. This must be called in the same transaction
+// as the write to the resource. An AlreadyExists error with the name of the
+// conflicting resource will be returned when a value is already claimed.
+func storeUniqueValues(ctx context.Context, tx *sql.Tx, parent string, resource proto.Message) error {
+	reflector := resource.ProtoReflect()
+	descriptor := reflector.Descriptor()
+	name := reflector.Get(descriptor.Fields().ByName("name")).String()
+
+	if err := deleteUniqueValues(ctx, tx, descriptor, name); err != nil {
+		return err
+	}
+
+	for _, field := range uniqueFields(descriptor) {
+		value := reflector.Get(field).String()
+		if value == "" {
+			continue
+		}
+
+		// Values that are unique within a parent are scoped to the parent,
+		// values that are globally unique share the same empty scope.
+		scope := ""
+		if getUniqueScope(field) == serverpb.UniqueScope_PARENT {
+			scope = parent
+		}
+
+		// Conflicts are detected without failing the statement so the
+		// transaction can still be used to look up the conflicting resource.
+		res, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO resource_unique (resource_type, field, scope, value, name) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING",
+			string(descriptor.FullName()),
+			string(field.Name()),
+			scope,
+			value,
+			name,
+		)
+		if err != nil {
+			return err
+		}
+		if inserted, err := res.RowsAffected(); err != nil {
+			return err
+		} else if inserted > 0 {
+			continue
+		}
+
+		var conflict string
+		if err := tx.QueryRowContext(
+			ctx,
+			"SELECT name FROM resource_unique WHERE resource_type = $1 AND field = $2 AND scope = $3 AND value = $4",
+			string(descriptor.FullName()),
+			string(field.Name()),
+			scope,
+			value,
+		).Scan(&conflict); err != nil {
+			return err
+		}
+		return uniqueConflictError(descriptor, field, value, conflict)
+	}
+	return nil
+}
+
+// Releases the values of the unique fields of the resource with the provided name.
+func deleteUniqueValues(ctx context.Context, tx *sql.Tx, resourceDescriptor protoreflect.MessageDescriptor, name string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM resource_unique WHERE resource_type = $1 AND name = $2",
+		string(resourceDescriptor.FullName()),
+		name,
+	)
+	return err
+}
+
+func uniqueConflictError(resourceDescriptor protoreflect.MessageDescriptor, field protoreflect.FieldDescriptor, value, conflict string) error {
+	errStatus, _ := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("%s %q is already used by %s", field.Name(), value, conflict),
+	).WithDetails(&errdetails.ResourceInfo{
+		ResourceType: string(resourceDescriptor.FullName()),
+		ResourceName: conflict,
+		Description:  fmt.Sprintf("The resource already uses the %s %q", field.Name(), value),
+	})
+	return errStatus.Err()
+}
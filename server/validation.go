@@ -0,0 +1,279 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/stackpath/control-plane/server/serverpb"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The variables the resource, or the value of a field, is bound to in
+// validation rules.
+const (
+	celSelfVariable    = "self"
+	celOldSelfVariable = "oldSelf"
+)
+
+// A validation rule that has been compiled into a CEL program.
+type compiledRule struct {
+	*serverpb.ValidationRule
+	program cel.Program
+	// Whether the rule references the existing resource and should
+	// only be evaluated on updates.
+	transition bool
+}
+
+// The compiled validation rules of a field.
+type fieldRules struct {
+	field protoreflect.FieldDescriptor
+	// Selects the value of the field from the resource so the value
+	// is converted to CEL the same way as in the message rules.
+	selector cel.Program
+	rules    []*compiledRule
+}
+
+// The compiled validation rules of a resource type.
+type resourceValidator struct {
+	messageRules []*compiledRule
+	fieldRules   []*fieldRules
+}
+
+// Compiles the validation rules that are declared on the resource message and
+// its fields. An error will be returned when any of the rules do not compile
+// or do not return a bool. Nil will be returned when no rules are declared.
+func compileValidationRules(message proto.Message) (*resourceValidator, error) {
+	descriptor := message.ProtoReflect().Descriptor()
+	validator := &resourceValidator{}
+
+	if rules := getValidationRules(descriptor.Options(), serverpb.E_ValidationRules); len(rules) > 0 {
+		objectType := decls.NewObjectType(string(descriptor.FullName()))
+		env, err := newValidationEnv(message, objectType)
+		if err != nil {
+			return nil, err
+		}
+		if validator.messageRules, err = compileRules(env, rules); err != nil {
+			return nil, fmt.Errorf("invalid validation rule on %s: %v", descriptor.FullName(), err)
+		}
+	}
+
+	fields := descriptor.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		rules := getValidationRules(field.Options(), serverpb.E_FieldValidationRules)
+		if len(rules) == 0 {
+			continue
+		}
+
+		env, err := newValidationEnv(message, celFieldType(field))
+		if err != nil {
+			return nil, err
+		}
+		compiled, err := compileRules(env, rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validation rule on %s: %v", field.FullName(), err)
+		}
+
+		// The selector is compiled against the resource so it can
+		// pull the value of the field out of the resource.
+		resourceEnv, err := newValidationEnv(message, decls.NewObjectType(string(descriptor.FullName())))
+		if err != nil {
+			return nil, err
+		}
+		selectorAst, issues := resourceEnv.Compile(fmt.Sprintf("%s.%s", celSelfVariable, field.Name()))
+		if issues != nil && issues.Err() != nil {
+			return nil, issues.Err()
+		}
+		selector, err := resourceEnv.Program(selectorAst)
+		if err != nil {
+			return nil, err
+		}
+
+		validator.fieldRules = append(validator.fieldRules, &fieldRules{
+			field:    field,
+			selector: selector,
+			rules:    compiled,
+		})
+	}
+
+	if len(validator.messageRules) == 0 && len(validator.fieldRules) == 0 {
+		return nil, nil
+	}
+	return validator, nil
+}
+
+// Returns the validation rules that are declared in the options.
+func getValidationRules(options proto.Message, extension protoreflect.ExtensionType) []*serverpb.ValidationRule {
+	if !proto.HasExtension(options, extension) {
+		return nil
+	}
+	return proto.GetExtension(options, extension).([]*serverpb.ValidationRule)
+}
+
+// Creates a CEL environment that declares self and oldSelf with the provided type.
+func newValidationEnv(message proto.Message, selfType *exprpb.Type) (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Types(message),
+		cel.Declarations(
+			decls.NewVar(celSelfVariable, selfType),
+			decls.NewVar(celOldSelfVariable, selfType),
+		),
+	)
+}
+
+func compileRules(env *cel.Env, rules []*serverpb.ValidationRule) ([]*compiledRule, error) {
+	var compiled []*compiledRule
+	for _, rule := range rules {
+		ast, issues := env.Compile(rule.Rule)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Rule, issues.Err())
+		}
+		if !proto.Equal(ast.ResultType(), decls.Bool) && !proto.Equal(ast.ResultType(), decls.Dyn) {
+			return nil, fmt.Errorf("rule %q must return a bool", rule.Rule)
+		}
+
+		checked, err := cel.AstToCheckedExpr(ast)
+		if err != nil {
+			return nil, err
+		}
+		transition := false
+		for _, reference := range checked.ReferenceMap {
+			if reference.Name == celOldSelfVariable {
+				transition = true
+			}
+		}
+
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Rule, err)
+		}
+		compiled = append(compiled, &compiledRule{
+			ValidationRule: rule,
+			program:        program,
+			transition:     transition,
+		})
+	}
+	return compiled, nil
+}
+
+// Returns the CEL type of the values of a field.
+func celFieldType(field protoreflect.FieldDescriptor) *exprpb.Type {
+	if field.IsMap() {
+		return decls.NewMapType(celKindType(field.MapKey()), celKindType(field.MapValue()))
+	}
+	if field.IsList() {
+		return decls.NewListType(celKindType(field))
+	}
+	return celKindType(field)
+}
+
+// Returns the CEL type of a single value of a field.
+func celKindType(field protoreflect.FieldDescriptor) *exprpb.Type {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return decls.Bool
+	case protoreflect.EnumKind, protoreflect.Int32Kind, protoreflect.Int64Kind,
+		protoreflect.Sint32Kind, protoreflect.Sint64Kind, protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		return decls.Int
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		return decls.Uint
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return decls.Double
+	case protoreflect.StringKind:
+		return decls.String
+	case protoreflect.BytesKind:
+		return decls.Bytes
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return decls.NewObjectType(string(field.Message().FullName()))
+	}
+	return decls.Dyn
+}
+
+// Validates the labels, annotations and owners of the resource and evaluates the
+// validation rules of the resource type on it. The existing resource should
+// be nil when the resource is being created, in which case transition rules
+// are skipped. An InvalidArgument error with the violations of all of the
+// checks that did not pass will be returned.
+func (r *resourceServer) validateResource(existing, resource proto.Message) error {
+	violations := validateMetadata(resource)
+	violations = append(violations, r.validateOwnerReferences(resource)...)
+
+	validator := r.validators[string(resource.ProtoReflect().Descriptor().FullName())]
+	if validator == nil {
+		validator = &resourceValidator{}
+	}
+
+	var oldResource interface{}
+	if existing != nil {
+		oldResource = existing
+	}
+	for _, rule := range validator.messageRules {
+		if violation := evaluateRule(rule, rule.Field, resource, oldResource); violation != nil {
+			violations = append(violations, violation)
+		}
+	}
+
+	for _, field := range validator.fieldRules {
+		self, _, err := field.selector.Eval(map[string]interface{}{celSelfVariable: resource})
+		if err != nil {
+			return err
+		}
+		var oldSelf interface{}
+		if existing != nil {
+			if oldSelf, _, err = field.selector.Eval(map[string]interface{}{celSelfVariable: existing}); err != nil {
+				return err
+			}
+		}
+
+		for _, rule := range field.rules {
+			if violation := evaluateRule(rule, string(field.field.Name()), self, oldSelf); violation != nil {
+				violations = append(violations, violation)
+			}
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	errStatus, _ := status.New(codes.InvalidArgument, "the resource is not valid").WithDetails(&errdetails.BadRequest{
+		FieldViolations: violations,
+	})
+	return errStatus.Err()
+}
+
+// Evaluates a rule and returns a violation for the field when the rule does
+// not hold. Transition rules are skipped when there is no old value.
+func evaluateRule(rule *compiledRule, field string, self, oldSelf interface{}) *errdetails.BadRequest_FieldViolation {
+	activation := map[string]interface{}{celSelfVariable: self}
+	if oldSelf != nil {
+		activation[celOldSelfVariable] = oldSelf
+	} else if rule.transition {
+		return nil
+	}
+
+	result, _, err := rule.program.Eval(activation)
+	if err != nil {
+		return &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf("Failed to evaluate rule %q: %v", rule.Rule, err),
+		}
+	}
+	if valid, ok := result.Value().(bool); ok && valid {
+		return nil
+	}
+
+	description := rule.Message
+	if description == "" {
+		description = fmt.Sprintf("Failed rule: %s", rule.Rule)
+	}
+	return &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	}
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// How often watchers check for changes that were made by other servers.
+// Changes made through this server are sent to watchers immediately.
+const watchPollInterval = time.Second
+
+// The max number of events that are read from the database at once.
+const watchBatchSize = 100
+
+// Notifies the watchers of the server when changes have been committed.
+type eventBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+// Returns a channel that receives a value when changes have been committed
+// and a function that must be called to stop receiving notifications.
+func (b *eventBroadcaster) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan struct{}]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
+
+// Lets all of the subscribers know that changes have been committed.
+func (b *eventBroadcaster) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		// Subscribers that already have a pending notification
+		// will pick up the changes when they read the events.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns an OutOfRange error when the events after the revision have been
+// compacted, which means the watch can no longer be resumed from it.
+func (r *resourceServer) checkCompacted(ctx context.Context, revision int64) error {
+	var compacted int64
+	if err := r.database.QueryRowContext(ctx, "SELECT compacted_revision FROM resource_revision WHERE id = 1").Scan(&compacted); err != nil {
+		return err
+	}
+	if revision < compacted {
+		return status.Errorf(codes.OutOfRange, "resource version %d has been compacted, watch again without a resource version", revision)
+	}
+	return nil
+}
+
+// Records a change to a resource in the transaction so it can be streamed to
+// watchers once the transaction is committed. The revision must have been
+// taken in the same transaction by commitWrite. The previous state of
+// the resource is nil for resources that were added or purged.
+func (r *resourceServer) recordEvent(ctx context.Context, tx *sql.Tx, revision int64, eventType serverpb.WatchResourcesResponse_EventType, parent string, resource, previous *anypb.Any) error {
+	name, err := resourceName(resource)
+	if err != nil {
+		return err
+	}
+
+	data, err := protojson.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	previousData, err := marshalNullableResource(previous)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO resource_event (revision, resource_type, name, parent, event_type, data, previous_data, create_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		revision,
+		string(resource.MessageName()),
+		name,
+		parent,
+		eventType.String(),
+		data,
+		previousData,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	return err
+}
+
+// Streams the current state of the resources followed by any changes to them.
+func (r *resourceServer) WatchResources(req *serverpb.WatchResourcesRequest, stream serverpb.Resources_WatchResourcesServer) error {
+	// Verify the requested resource type was registered.
+	resourceDescriptor, err := r.GetResourceDescriptor(req.ResourceType)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	selector, err := parseLabelSelector("label_selector", req.LabelSelector)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+
+	// Subscribe before reading the current state so no changes are missed.
+	notifications, unsubscribe := r.events.subscribe()
+	defer unsubscribe()
+
+	var revision int64
+	if req.ResourceVersion == "" {
+		// Send the current state of the resources to the watcher
+		revision, err = r.sendCurrentResources(ctx, stream, req, filter, selector)
+		if err != nil {
+			return err
+		}
+	} else if revision, err = parseResourceVersion("resource_version", req.ResourceVersion); err != nil {
+		return err
+	} else if err := r.checkCompacted(ctx, revision); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		events, err := r.listEvents(ctx, string(resourceDescriptor.FullName()), req.Parent, revision)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			revision = event.revision
+
+			matches, err := watchMatches(filter, selector, event.Resource)
+			if err != nil {
+				return err
+			}
+			matched := matches
+			if event.previous != nil {
+				if matched, err = watchMatches(filter, selector, event.previous); err != nil {
+					return err
+				}
+			}
+
+			// Resources that stop matching the watch are reported as deleted,
+			// and resources that start matching it are reported as added.
+			switch {
+			case matches && !matched:
+				event.Type = serverpb.WatchResourcesResponse_ADDED
+			case !matches && matched:
+				event.Type = serverpb.WatchResourcesResponse_DELETED
+			case !matches:
+				continue
+			}
+
+			if err := stream.Send(event.WatchResourcesResponse); err != nil {
+				return err
+			}
+		}
+
+		// Keep reading when there are more events waiting
+		if len(events) == watchBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-r.ctx.Done():
+			return status.Error(codes.Unavailable, "the server is shutting down, resume watching with the last received resource version")
+		case <-notifications:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks if a resource matches the filter and label selector of a watch.
+func watchMatches(filter resourceFilter, selector labelSelector, resource *anypb.Any) (bool, error) {
+	unpacked, err := resource.UnmarshalNew()
+	if err != nil {
+		return false, err
+	}
+	if matches, err := filter.matches(unpacked); err != nil || !matches {
+		return false, err
+	}
+	return selector.matches(unpacked), nil
+}
+
+// Sends the resources that currently exist as ADDED events. The revision the
+// state of the resources was read at is returned.
+func (r *resourceServer) sendCurrentResources(ctx context.Context, stream serverpb.Resources_WatchResourcesServer, req *serverpb.WatchResourcesRequest, filter resourceFilter, selector labelSelector) (int64, error) {
+	resourceDescriptor, err := r.GetResourceDescriptor(req.ResourceType)
+	if err != nil {
+		return 0, err
+	}
+
+	// Read the revision and the resources in the same transaction so the
+	// resources are consistent with the revision.
+	tx, err := r.database.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	revision, err := currentRevision(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The label selector is evaluated in the database, the filter is
+	// evaluated on the resources that are returned.
+	conditions, args := selector.sqlConditions(string(resourceDescriptor.FullName()), "r", []interface{}{req.Parent})
+	conditions = append([]string{"r.parent = $1", "r.delete_time IS NULL"}, conditions...)
+	res, err := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s AS r WHERE %s",
+		resourceColumns,
+		getResourceTableName(resourceDescriptor),
+		strings.Join(conditions, " AND "),
+	), args...)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var resources []*anypb.Any
+	for res.Next() {
+		resource, err := scanResource(res)
+		if err != nil {
+			return 0, err
+		}
+		resources = append(resources, resource)
+	}
+	if err := res.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	resourceVersion := strconv.FormatInt(revision, 10)
+	for _, resource := range resources {
+		unpacked, err := resource.UnmarshalNew()
+		if err != nil {
+			return 0, err
+		}
+		if matches, err := filter.matches(unpacked); err != nil {
+			return 0, err
+		} else if !matches {
+			continue
+		}
+
+		if err := stream.Send(&serverpb.WatchResourcesResponse{
+			Type:            serverpb.WatchResourcesResponse_ADDED,
+			Resource:        resource,
+			ResourceVersion: resourceVersion,
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	return revision, nil
+}
+
+// An event that was read from the database.
+type resourceEvent struct {
+	*serverpb.WatchResourcesResponse
+	revision int64
+	// The state of the resource before the change. Nil for resources that
+	// were added or purged, and for events recorded before it was stored.
+	previous *anypb.Any
+}
+
+// Returns the next batch of events for resources of the type and parent that
+// were recorded after the provided revision.
+func (r *resourceServer) listEvents(ctx context.Context, resourceType, parent string, after int64) ([]resourceEvent, error) {
+	res, err := r.database.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			"SELECT revision, event_type, data, previous_data FROM resource_event WHERE resource_type = $1 AND parent = $2 AND revision > $3 ORDER BY revision LIMIT %d",
+			watchBatchSize,
+		),
+		resourceType,
+		parent,
+		after,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var events []resourceEvent
+	for res.Next() {
+		var revision int64
+		var eventType, data string
+		var previousData sql.NullString
+		if err := res.Scan(&revision, &eventType, &data, &previousData); err != nil {
+			return nil, err
+		}
+
+		resource := &anypb.Any{}
+		if err := protojson.Unmarshal([]byte(data), resource); err != nil {
+			return nil, err
+		}
+		previous, err := unmarshalNullableResource(previousData)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, resourceEvent{
+			WatchResourcesResponse: &serverpb.WatchResourcesResponse{
+				Type:            serverpb.WatchResourcesResponse_EventType(serverpb.WatchResourcesResponse_EventType_value[eventType]),
+				Resource:        resource,
+				ResourceVersion: strconv.FormatInt(revision, 10),
+			},
+			revision: revision,
+			previous: previous,
+		})
+	}
+	return events, res.Err()
+}
@@ -0,0 +1,771 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/stackpath/control-plane/server/serverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The header that contains the HMAC-SHA256 signature of the webhook body.
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// The source of the CloudEvents that are sent as webhooks.
+const webhookEventSource = "//resourcemanager.stackpathapis.com"
+
+// The max number of pending webhooks that are read from the database at once.
+const webhookBatchSize = 100
+
+// The permission the principal of a subscription needs on a resource for
+// webhooks to be sent for it.
+const webhookResourcePermission = "resourcemanager.resources.get"
+
+// WebhookConfig configures how webhooks are sent to the subscriptions.
+type WebhookConfig struct {
+	// The client that is used to send webhooks. When no client is provided,
+	// a client that refuses to connect to private network addresses is used
+	// with the timeout below. Provided clients are used as they are.
+	Client *http.Client
+
+	// How long receivers have to respond to a webhook when no client is
+	// provided. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// Allows subscriptions to send webhooks to loopback, private and link-local
+	// addresses, such as receivers running next to the server. These addresses
+	// are rejected by default so subscriptions can not reach internal services.
+	AllowPrivateNetworks bool
+
+	// The authorizer that is used to check which resources and fields the
+	// principal of a subscription is allowed to read. Webhooks are sent for
+	// every resource with all of its fields when no authorizer is provided.
+	Authorizer Authorizer
+
+	// The number of times a webhook is sent before it is dead-lettered
+	// and no longer retried. Defaults to 10 attempts.
+	MaxAttempts int
+
+	// The delays between attempts to send a webhook. The delay doubles
+	// after every failed attempt until it reaches the max backoff.
+	// Defaults to a second and an hour.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Registers the WebhookSubscription resource and starts the background workers
+// that send webhooks to the subscriptions when resources change. Changes are
+// read from the outbox and queued for every matching subscription, so every
+// webhook is sent at least once and webhooks for a resource are sent in the
+// order the changes were committed.
+func (r *resourceServer) StartWebhooks(config WebhookConfig) error {
+	if err := r.CreateResourceDescriptor(&serverpb.WebhookSubscription{}); err != nil {
+		return err
+	}
+
+	// Subscriptions send webhooks with the permissions of the last principal
+	// that wrote them, and are verified before they are stored.
+	subscriptionType := string((&serverpb.WebhookSubscription{}).ProtoReflect().Descriptor().FullName())
+	if err := r.CreateDefaulter(subscriptionType, DefaulterFunc(defaultWebhookPrincipal)); err != nil {
+		return err
+	}
+	if err := r.CreateAdmissionHook(AdmissionHookConfig{
+		Name:          "webhook-subscriptions",
+		ResourceTypes: []string{subscriptionType},
+		Operations:    []AdmissionOperation{AdmissionCreate, AdmissionUpdate},
+		Hook: AdmissionHookFunc(func(ctx context.Context, req *AdmissionRequest) error {
+			return r.verifyWebhookSubscription(req, config.AllowPrivateNetworks)
+		}),
+	}); err != nil {
+		return err
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.Client == nil {
+		config.Client = newWebhookClient(config.Timeout, config.AllowPrivateNetworks)
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Hour
+	}
+
+	sender := &webhookSender{
+		server: r,
+		config: config,
+		queued: make(chan struct{}, 1),
+	}
+	r.StartDispatcher("webhooks", sender)
+	r.goBackground("webhook sender", sender.run)
+	return nil
+}
+
+// Queues webhooks for the changes that are dispatched from the outbox and
+// sends the queued webhooks to the subscriptions.
+type webhookSender struct {
+	server *resourceServer
+	config WebhookConfig
+	// Wakes the sender when new webhooks have been queued.
+	queued chan struct{}
+}
+
+// Queues a webhook for every subscription that is subscribed to the change.
+// Webhooks that were already queued for the change are left as they are, so
+// the change can safely be delivered again.
+func (s *webhookSender) Deliver(ctx context.Context, change *Change) error {
+	eventType, err := webhookEventType(change)
+	if err != nil {
+		return err
+	}
+
+	subscriptions, err := s.server.listWebhookSubscriptions(ctx, change.ResourceType)
+	if err != nil {
+		return err
+	}
+
+	var queued bool
+	for _, subscription := range subscriptions {
+		if !subscribedTo(subscription, eventType) || !withinParent(change.Name, subscription.Parent) {
+			continue
+		}
+
+		// The webhook is sent with what the principal of the subscription is
+		// allowed to see, which may be nothing at all.
+		payload, err := s.newPayload(ctx, subscription, change, eventType)
+		if err != nil {
+			return err
+		} else if payload == nil {
+			continue
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		if _, err := s.server.database.ExecContext(
+			ctx,
+			`INSERT INTO webhook_delivery (subscription, revision, resource_name, event_type, payload, state, next_attempt_time, create_time, update_time)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $7) ON CONFLICT (subscription, revision) DO NOTHING`,
+			subscription.Name,
+			change.Revision,
+			change.Name,
+			eventType.String(),
+			payload,
+			serverpb.WebhookDelivery_PENDING.String(),
+			now,
+		); err != nil {
+			return err
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case s.queued <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Creates the CloudEvent that is sent to the subscription for a change. The
+// fields the principal of the subscription is not allowed to read are removed
+// from the resources, and nil is returned when the principal is not allowed
+// to get the resource at all.
+func (s *webhookSender) newPayload(ctx context.Context, subscription *serverpb.WebhookSubscription, change *Change, eventType serverpb.WebhookSubscription_EventType) ([]byte, error) {
+	if s.config.Authorizer == nil {
+		return newCloudEvent(change, eventType)
+	}
+
+	principal := &Principal{Name: subscription.Principal}
+	allowed, err := s.config.Authorizer.TestPermissions(ctx, principal, change.Name, []string{webhookResourcePermission})
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+
+	ctx = context.WithValue(ctx, principalContextKey{}, principal)
+	redacted := *change
+	for _, resource := range []**anypb.Any{&redacted.Before, &redacted.After} {
+		if *resource == nil {
+			continue
+		}
+		clone := proto.Clone(*resource).(*anypb.Any)
+		if err := redactAnyResource(ctx, s.config.Authorizer, clone); err != nil {
+			return nil, err
+		}
+		*resource = clone
+	}
+	return newCloudEvent(&redacted, eventType)
+}
+
+// Sends the queued webhooks until the context is done.
+func (s *webhookSender) run(ctx context.Context) {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		sent, err := s.sendPending(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to send webhooks: %v", err)
+		}
+
+		// Keep sending when there are more webhooks waiting
+		if err == nil && sent == webhookBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.queued:
+		case <-ticker.C:
+		}
+	}
+}
+
+// A webhook that is waiting to be sent.
+type pendingWebhook struct {
+	subscription string
+	revision     int64
+	payload      []byte
+	attempts     int
+}
+
+// Sends the next batch of webhooks that are due and returns the number of
+// webhooks that were attempted. A webhook is only sent once every earlier
+// webhook for the same subscription and resource has been sent or
+// dead-lettered.
+func (s *webhookSender) sendPending(ctx context.Context) (int, error) {
+	res, err := s.server.database.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT d.subscription, d.revision, d.payload, d.attempts FROM webhook_delivery d
+			WHERE d.state = $1 AND d.next_attempt_time <= $2 AND NOT EXISTS (
+				SELECT 1 FROM webhook_delivery e WHERE e.subscription = d.subscription
+				AND e.resource_name = d.resource_name AND e.state = $1 AND e.revision < d.revision
+			) ORDER BY d.revision LIMIT %d`,
+			webhookBatchSize,
+		),
+		serverpb.WebhookDelivery_PENDING.String(),
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending []*pendingWebhook
+	for res.Next() {
+		webhook := &pendingWebhook{}
+		var payload string
+		if err := res.Scan(&webhook.subscription, &webhook.revision, &payload, &webhook.attempts); err != nil {
+			res.Close()
+			return 0, err
+		}
+		webhook.payload = []byte(payload)
+		pending = append(pending, webhook)
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, webhook := range pending {
+		subscription, err := s.server.getWebhookSubscription(ctx, webhook.subscription)
+		if err != nil {
+			return 0, err
+		}
+
+		// Webhooks for subscriptions that have been removed can never be sent.
+		if subscription == nil {
+			if err := s.recordAttempt(ctx, webhook, serverpb.WebhookDelivery_DEAD_LETTERED, fmt.Errorf("the subscription has been deleted")); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		webhook.attempts++
+		sendErr := s.send(ctx, subscription, webhook.payload)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		state := serverpb.WebhookDelivery_SUCCEEDED
+		if sendErr != nil {
+			state = serverpb.WebhookDelivery_PENDING
+			if webhook.attempts >= s.config.MaxAttempts {
+				state = serverpb.WebhookDelivery_DEAD_LETTERED
+			}
+			log.Printf("failed to send webhook %d to %s on attempt %d: %v", webhook.revision, webhook.subscription, webhook.attempts, sendErr)
+		}
+		if err := s.recordAttempt(ctx, webhook, state, sendErr); err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// Sends the webhook payload to the URL of the subscription. An error will be
+// returned when the receiver does not respond with a successful status code.
+func (s *webhookSender) send(ctx context.Context, subscription *serverpb.WebhookSubscription, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, subscription.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	if subscription.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(subscription.Secret, payload))
+	}
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read some of the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the receiver responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Records the outcome of an attempt to send a webhook. Pending webhooks are
+// retried once their backoff has passed.
+func (s *webhookSender) recordAttempt(ctx context.Context, webhook *pendingWebhook, state serverpb.WebhookDelivery_State, sendErr error) error {
+	now := time.Now().UTC()
+
+	var lastError string
+	if sendErr != nil {
+		lastError = sendErr.Error()
+	}
+
+	var nextAttempt sql.NullString
+	if state == serverpb.WebhookDelivery_PENDING {
+		nextAttempt = sql.NullString{
+			String: now.Add(s.backoff(webhook.attempts)).Format(time.RFC3339Nano),
+			Valid:  true,
+		}
+	}
+
+	_, err := s.server.database.ExecContext(
+		ctx,
+		"UPDATE webhook_delivery SET state = $1, attempts = $2, last_error = $3, next_attempt_time = $4, update_time = $5 WHERE subscription = $6 AND revision = $7",
+		state.String(),
+		webhook.attempts,
+		lastError,
+		nextAttempt,
+		now.Format(time.RFC3339Nano),
+		webhook.subscription,
+		webhook.revision,
+	)
+	return err
+}
+
+// Returns how long to wait before sending a webhook again after the
+// provided number of failed attempts.
+func (s *webhookSender) backoff(attempts int) time.Duration {
+	backoff := s.config.MinBackoff
+	for i := 1; i < attempts && backoff < s.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.config.MaxBackoff {
+		backoff = s.config.MaxBackoff
+	}
+	return backoff
+}
+
+// Returns the hex encoded HMAC-SHA256 signature of the payload in the
+// format of the webhook signature header.
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the webhook event type of a change. Modifications that clear the
+// delete time of a resource are reported as undeletes.
+func webhookEventType(change *Change) (serverpb.WebhookSubscription_EventType, error) {
+	switch change.Type {
+	case serverpb.WatchResourcesResponse_ADDED:
+		return serverpb.WebhookSubscription_CREATED, nil
+	case serverpb.WatchResourcesResponse_DELETED:
+		return serverpb.WebhookSubscription_DELETED, nil
+	case serverpb.WatchResourcesResponse_PURGED:
+		return serverpb.WebhookSubscription_PURGED, nil
+	}
+
+	before, err := change.Before.UnmarshalNew()
+	if err != nil {
+		return 0, err
+	}
+	after, err := change.After.UnmarshalNew()
+	if err != nil {
+		return 0, err
+	}
+
+	if deleteTime := before.ProtoReflect().Descriptor().Fields().ByName("delete_time"); deleteTime != nil {
+		if before.ProtoReflect().Has(deleteTime) && !after.ProtoReflect().Has(deleteTime) {
+			return serverpb.WebhookSubscription_UNDELETED, nil
+		}
+	}
+	return serverpb.WebhookSubscription_UPDATED, nil
+}
+
+// Checks if the subscription should receive webhooks for the event type.
+func subscribedTo(subscription *serverpb.WebhookSubscription, eventType serverpb.WebhookSubscription_EventType) bool {
+	if len(subscription.EventTypes) == 0 {
+		return true
+	}
+	for _, subscribed := range subscription.EventTypes {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// A CloudEvent in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// The data of the CloudEvents that are sent for changes to resources.
+type webhookEventData struct {
+	// The state of the resource after the change, or the last state
+	// of the resource when it was purged.
+	Resource json.RawMessage `json:"resource"`
+	// The state of the resource before the change.
+	PreviousResource json.RawMessage `json:"previousResource,omitempty"`
+	ResourceVersion  string          `json:"resourceVersion"`
+	Principal        string          `json:"principal"`
+}
+
+// Creates the CloudEvent that is sent for a change. The revision of the change
+// is used as the ID of the event so receivers can detect duplicate webhooks.
+func newCloudEvent(change *Change, eventType serverpb.WebhookSubscription_EventType) ([]byte, error) {
+	resource := change.After
+	if resource == nil {
+		resource = change.Before
+	}
+
+	data := webhookEventData{
+		ResourceVersion: strconv.FormatInt(change.Revision, 10),
+		Principal:       change.Principal,
+	}
+
+	var err error
+	if data.Resource, err = protojson.Marshal(resource); err != nil {
+		return nil, err
+	}
+	if change.After != nil && change.Before != nil {
+		if data.PreviousResource, err = protojson.Marshal(change.Before); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              strconv.FormatInt(change.Revision, 10),
+		Source:          webhookEventSource,
+		Type:            "com.stackpathapis.resourcemanager.resource." + strings.ToLower(eventType.String()),
+		Subject:         change.Name,
+		Time:            change.CreateTime.UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            encoded,
+	})
+}
+
+// Checks if a resource is the parent of a subscription or one of its descendants.
+// Every resource is within the empty parent.
+func withinParent(name, parent string) bool {
+	return parent == "" || name == parent || strings.HasPrefix(name, parent+"/")
+}
+
+// Sets the principal of a subscription to the caller that is writing it.
+func defaultWebhookPrincipal(ctx context.Context, existing, resource proto.Message) error {
+	principal := systemPrincipal
+	if p := principalFromContext(ctx); p != nil {
+		principal = p.Name
+	}
+	resource.(*serverpb.WebhookSubscription).Principal = principal
+	return nil
+}
+
+// Verifies a subscription is for a registered resource type that can be sent
+// as webhooks, and that its URL can be sent webhooks. Subscriptions for other
+// subscriptions are not allowed since they would include the secrets of the
+// subscriptions.
+func (r *resourceServer) verifyWebhookSubscription(req *AdmissionRequest, allowPrivateNetworks bool) error {
+	subscription := &serverpb.WebhookSubscription{}
+	if err := req.NewResource.UnmarshalTo(subscription); err != nil {
+		return err
+	}
+
+	if subscription.ResourceType == req.ResourceType {
+		return &AdmissionDenial{Message: "webhooks can not be sent for webhook subscriptions", Invalid: true}
+	}
+	if _, err := r.GetResourceDescriptor(subscription.ResourceType); err != nil {
+		return &AdmissionDenial{Message: fmt.Sprintf("unknown resource type %q", subscription.ResourceType), Invalid: true}
+	}
+
+	target, err := url.Parse(subscription.Url)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Hostname() == "" {
+		return &AdmissionDenial{Message: "the url must be an absolute http or https URL", Invalid: true}
+	}
+	if ip := net.ParseIP(target.Hostname()); ip != nil && !allowPrivateNetworks && !isPublicIP(ip) {
+		return &AdmissionDenial{Message: fmt.Sprintf("webhooks can not be sent to the private address %s", ip), Invalid: true}
+	}
+	return nil
+}
+
+// The address ranges that are not reachable from the internet.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// Checks if an IP address is reachable from the internet.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Creates the client that sends webhooks. Host names are resolved before the
+// client connects to them, so the addresses are checked when connecting rather
+// than when the subscription is created. Proxies are not used since they
+// would connect on behalf of the client.
+func newWebhookClient(timeout time.Duration, allowPrivateNetworks bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivateNetworks {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("webhooks can not be sent to the private address %s", host)
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// Returns the webhook subscriptions for the resource type that have not been deleted.
+func (r *resourceServer) listWebhookSubscriptions(ctx context.Context, resourceType string) ([]*serverpb.WebhookSubscription, error) {
+	res, err := r.database.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE delete_time IS NULL",
+		resourceColumns,
+		getResourceTableName((&serverpb.WebhookSubscription{}).ProtoReflect().Descriptor()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var subscriptions []*serverpb.WebhookSubscription
+	for res.Next() {
+		resource, err := scanResource(res)
+		if err != nil {
+			return nil, err
+		}
+
+		subscription := &serverpb.WebhookSubscription{}
+		if err := resource.UnmarshalTo(subscription); err != nil {
+			return nil, err
+		}
+		if subscription.ResourceType == resourceType {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions, res.Err()
+}
+
+// Returns the webhook subscription with the provided name. Nil will be
+// returned when the subscription has been deleted.
+func (r *resourceServer) getWebhookSubscription(ctx context.Context, name string) (*serverpb.WebhookSubscription, error) {
+	resource, err := r.getResource(ctx, r.database, &serverpb.GetResourceRequest{
+		Name:         name,
+		ResourceType: string((&serverpb.WebhookSubscription{}).ProtoReflect().Descriptor().FullName()),
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	subscription := &serverpb.WebhookSubscription{}
+	if err := resource.UnmarshalTo(subscription); err != nil {
+		return nil, err
+	}
+	if subscription.DeleteTime != nil {
+		return nil, nil
+	}
+	return subscription, nil
+}
+
+// Lists the webhooks that have been queued for a subscription in the order
+// they were queued.
+func (r *resourceServer) ListWebhookDeliveries(ctx context.Context, req *serverpb.ListWebhookDeliveriesRequest) (*serverpb.ListWebhookDeliveriesResponse, error) {
+	// Set the default page size when not provided.
+	if req.PageSize == 0 {
+		req.PageSize = 50
+	} else if req.PageSize < 0 {
+		errStatus, _ := status.New(codes.InvalidArgument, "invalid page size").WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{
+					Field:       "page_size",
+					Description: "The page size can not be negative",
+				},
+			},
+		})
+		return nil, errStatus.Err()
+	}
+
+	// Deliveries are listed in the order of their revisions so the page
+	// token can resume after the last delivery of the previous page.
+	pageStart, err := parsePageToken(req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	var afterRevision int64
+	if pageStart != "" {
+		if afterRevision, err = strconv.ParseInt(pageStart, 10, 64); err != nil {
+			return nil, invalidPageTokenError()
+		}
+	}
+
+	// Only filter by the state when one was provided.
+	conditions := "subscription = $1 AND revision > $2"
+	args := []interface{}{req.Parent, afterRevision}
+	if req.State != serverpb.WebhookDelivery_STATE_UNSPECIFIED {
+		conditions += " AND state = $3"
+		args = append(args, req.State.String())
+	}
+
+	// One extra delivery is read to find out if there is another page.
+	res, err := r.database.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			"SELECT revision, resource_name, event_type, state, attempts, last_error, next_attempt_time, create_time, update_time FROM webhook_delivery WHERE %s ORDER BY revision LIMIT %d",
+			conditions,
+			req.PageSize+1,
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var deliveries []*serverpb.WebhookDelivery
+	for res.Next() {
+		var revision int64
+		var resourceName, eventType, state, lastError, createTime, updateTime string
+		var attempts int32
+		var nextAttempt sql.NullString
+		if err := res.Scan(&revision, &resourceName, &eventType, &state, &attempts, &lastError, &nextAttempt, &createTime, &updateTime); err != nil {
+			return nil, err
+		}
+
+		delivery := &serverpb.WebhookDelivery{
+			Subscription:    req.Parent,
+			EventId:         strconv.FormatInt(revision, 10),
+			EventType:       serverpb.WebhookSubscription_EventType(serverpb.WebhookSubscription_EventType_value[eventType]),
+			Resource:        resourceName,
+			ResourceVersion: strconv.FormatInt(revision, 10),
+			State:           serverpb.WebhookDelivery_State(serverpb.WebhookDelivery_State_value[state]),
+			Attempts:        attempts,
+			LastError:       lastError,
+		}
+		if delivery.CreateTime, err = parseTimestamp(createTime); err != nil {
+			return nil, err
+		}
+		if delivery.UpdateTime, err = parseTimestamp(updateTime); err != nil {
+			return nil, err
+		}
+		if nextAttempt.Valid {
+			if delivery.NextAttemptTime, err = parseTimestamp(nextAttempt.String); err != nil {
+				return nil, err
+			}
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+
+	resp := &serverpb.ListWebhookDeliveriesResponse{Deliveries: deliveries}
+	if len(deliveries) > int(req.PageSize) {
+		resp.Deliveries = deliveries[:req.PageSize]
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(resp.Deliveries[len(resp.Deliveries)-1].EventId))
+	}
+	return resp, nil
+}
+
+func parseTimestamp(value string) (*timestamppb.Timestamp, error) {
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	return timestamppb.New(parsed), nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"log"
+)
+
+// Runs the provided function in the background as a worker of the server.
+// The worker will be provided a context that is cancelled when the server
+// is shutdown and must return once the context is done.
+func (r *resourceServer) goBackground(name string, worker func(ctx context.Context)) {
+	r.workers.Add(1)
+	go func() {
+		defer r.workers.Done()
+		log.Printf("Starting background worker %q", name)
+		worker(r.ctx)
+		log.Printf("Background worker %q has stopped", name)
+	}()
+}
+
+// Signals the background workers and any open watches to stop without
+// waiting for them to finish. Running operations are not cancelled, but no
+// new operations can be started.
+func (r *resourceServer) Drain() {
+	r.operationsMu.Lock()
+	r.draining = true
+	r.operationsMu.Unlock()
+	r.cancel()
+}
+
+// Stops all of the background workers and closes the database connection
+// pool once they have drained. A context error will be returned when the
+// workers do not stop before the context is done. Running operations are
+// cancelled and the database will still be closed in that case so that any
+// in-flight queries are aborted.
+func (r *resourceServer) Shutdown(ctx context.Context) error {
+	// Signal the background workers that they should stop.
+	r.Drain()
+	defer r.cancelOperations()
+
+	drained := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		r.cancelOperations()
+		err = ctx.Err()
+	}
+
+	if closeErr := r.database.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}